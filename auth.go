@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// auth holds the credentials that are allowed to access the HTTP listener.
+type auth struct {
+	tokens []string          // Bearer tokens.
+	users  map[string]string // Basic auth users and their passwords.
+}
+
+// readAuth reads the credentials from the file path. Each line is either <user>:<password> for basic auth, or
+// a bearer token. Empty lines and lines starting with a # are ignored.
+func readAuth(path string) (*auth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &auth{users: map[string]string{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if user, password, ok := strings.Cut(line, ":"); ok {
+			a.users[user] = password
+			continue
+		}
+		a.tokens = append(a.tokens, line)
+	}
+	return a, scanner.Err()
+}
+
+// valid returns true if the request carries valid credentials.
+func (a *auth) valid(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		p, ok := a.users[user]
+		return ok && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+	}
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Middleware rejects requests without valid credentials. The webhook is exempt as it carries its own signature.
+func (a *auth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/webhook" && !a.valid(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gitopper"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
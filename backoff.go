@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	jitterFraction = 0.1       // Poll intervals are randomly spread by this fraction, so a fleet doesn't poll in lockstep.
+	backoffMax     = time.Hour // Longest wait between pulls when they keep failing.
+)
+
+// jitter returns d spread randomly by up to jitterFraction in both directions.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*jitterFraction*float64(d))
+}
+
+// backoff returns the wait after failures consecutive failed pulls: d doubled for each failure, capped at
+// backoffMax. An interval that is already longer than backoffMax is left alone.
+func backoff(d time.Duration, failures int) time.Duration {
+	if d >= backoffMax {
+		return d
+	}
+	for i := 0; i < failures && d < backoffMax; i++ {
+		d *= 2
+	}
+	if d > backoffMax {
+		return backoffMax
+	}
+	return d
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		failures int
+		exp      time.Duration
+	}{
+		{30 * time.Second, 0, 30 * time.Second},
+		{30 * time.Second, 1, time.Minute},
+		{30 * time.Second, 3, 4 * time.Minute},
+		{30 * time.Second, 20, backoffMax},
+		{2 * time.Hour, 3, 2 * time.Hour},
+	}
+	for i, tc := range tests {
+		if got := backoff(tc.d, tc.failures); got != tc.exp {
+			t.Errorf("test %d, expected %s, got %s", i, tc.exp, got)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := time.Minute
+	for i := 0; i < 100; i++ {
+		if got := jitter(d); got < d-d/10 || got > d+d/10 {
+			t.Fatalf("expected %s within 10%% of %s", got, d)
+		}
+	}
+}
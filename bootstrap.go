@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"go.science.ru.nl/log"
+)
+
+// unitTemplate is the systemd unit file that is installed by bootstrap.
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=GitOps for the non-Kubernetes folks
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=all
+ExecStart={{.Binary}} -c {{.Config}} -h {{.Role}}
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// bootstrap checks out the repository holding our config, installs a systemd unit for gitopper and starts it.
+// This is meant to be called from cloud-init on first boot.
+func bootstrap(args []string) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	upstream := fs.String("upstream", "", "repository holding the config")
+	branch := fs.String("branch", "main", "branch to checkout")
+	role := fs.String("role", "", "machine name (role) this host has in the config")
+	config := fs.String("config", "config", "path of the config file in the repository")
+	mount := fs.String("mount", "/var/lib/gitopper/bootstrap", "directory to checkout the repository in")
+	unit := fs.String("unit", "/etc/systemd/system/gitopper.service", "systemd unit file to install")
+	enrollURL := fs.String("enroll", "", "URL of the hub to enroll at, it returns the flags not given")
+	token := fs.String("token", "", "one-time token to enroll with, or @<file> to read it from file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *enrollURL != "" {
+		tok, err := readToken(*token)
+		if err != nil {
+			return err
+		}
+		if tok == "" {
+			return fmt.Errorf("-enroll needs -token")
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		e, err := enroll(enrollClient, *enrollURL, tok, hostname, hostKeys())
+		if err != nil {
+			return err
+		}
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		for name, value := range map[string]string{"upstream": e.Upstream, "branch": e.Branch, "role": e.Role, "config": e.Config} {
+			if !set[name] && value != "" {
+				fs.Set(name, value)
+			}
+		}
+		log.Infof("Enrolled at %q as %q with %q", *enrollURL, *role, *upstream)
+		// The token is spent, don't leave it lying around.
+		if strings.HasPrefix(*token, "@") {
+			os.Remove((*token)[1:])
+		}
+	}
+	if *upstream == "" || *role == "" {
+		return fmt.Errorf("-upstream and -role are mandatory")
+	}
+
+	dirs := []string{}
+	if dir := path.Dir(*config); dir != "." {
+		dirs = append(dirs, dir)
+	}
+	gc := gitcmd.New(*upstream, *branch, *mount, "", dirs)
+	if err := gc.Checkout(); err != nil {
+		return fmt.Errorf("error pulling %q: %s", *upstream, err)
+	}
+	log.Infof("Bootstrap repository in %q with %q", gc.Repo(), gc.Hash())
+
+	configPath := path.Join(*mount, *config)
+	c, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, s := range c.Services {
+		if s.forMe([]string{*role}, nil) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("no services found for role %q in %q", *role, configPath)
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(*unit)
+	if err != nil {
+		return err
+	}
+	err = unitTemplate.Execute(f, struct{ Binary, Config, Role string }{binary, configPath, *role})
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write unit %q: %s", *unit, err)
+	}
+	log.Infof("Installed unit %q", *unit)
+
+	ctx := context.TODO()
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", "--now", path.Base(*unit)}} {
+		cmd := exec.CommandContext(ctx, "systemctl", args...)
+		log.Infof("running %v", cmd.Args)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to run %v: %s: %s", cmd.Args, err, out)
+		}
+	}
+	return nil
+}
+
+func (b *Bootstrap) newGitCmd() *gitcmd.Git {
+	branch := b.Branch
+	if branch == "" {
+		branch = "main"
+	}
+	dirs := []string{}
+	if dir := path.Dir(b.Config); dir != "." {
+		dirs = append(dirs, dir)
+	}
+	gc := gitcmd.New(b.Upstream, branch, b.Mount, "", dirs)
+	b.network.apply(gc)
+	return gc
+}
+
+// config checks out the bootstrap repository and returns the config in it. The upstreams in the config must be
+// allowed by the local config, and the network policy of the local config, if any, is used.
+func (b *Bootstrap) config(local Config) (Config, error) {
+	gc := b.newGitCmd()
+	if err := gc.Checkout(); err != nil {
+		return Config{}, fmt.Errorf("error pulling %q: %s", b.Upstream, err)
+	}
+	log.Infof("Bootstrap repository in %q with %q", gc.Repo(), gc.Hash())
+
+	c, err := readConfig(path.Join(b.Mount, b.Config))
+	if err != nil {
+		return c, err
+	}
+	if c.Bootstrap != nil {
+		return c, fmt.Errorf("config %q in bootstrap repository can't have a bootstrap", b.Config)
+	}
+	if err := c.allowed(local.Upstreams); err != nil {
+		return c, fmt.Errorf("config %q in bootstrap repository is not valid: %s", b.Config, err)
+	}
+	if local.Network != nil {
+		c.Network = local.Network
+		c.restrict(c.Network)
+	}
+	return c, nil
+}
+
+// trackConfig pulls the bootstrap repository every d, and when the config changes sends ourselves a SIGHUP, so we
+// reload the new config.
+func (b *Bootstrap) trackConfig(ctx context.Context, d time.Duration) {
+	gc := b.newGitCmd()
+	config := path.Join(b.Mount, b.Config)
+	for {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		}
+
+		before, err := os.ReadFile(config)
+		if err != nil {
+			log.Warningf("Failed to read config %q: %s", config, err)
+			continue
+		}
+		if _, err := gc.Pull(gitcmd.Reset, ""); err != nil {
+			log.Warningf("Error pulling bootstrap repo %q: %s", b.Upstream, err)
+			continue
+		}
+		after, err := os.ReadFile(config)
+		if err != nil {
+			log.Warningf("Failed to read config %q: %s", config, err)
+			continue
+		}
+		if bytes.Equal(before, after) {
+			continue
+		}
+		if _, err := readConfig(config); err != nil {
+			log.Warningf("Config %q changed, but not reloading: %s", config, err)
+			metricConfigReloads.WithLabelValues("failure").Inc()
+			continue
+		}
+		log.Infof("Config %q changed, reloading", config)
+		signals <- syscall.SIGHUP
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.science.ru.nl/log"
+)
+
+func TestTrackConfig(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+	}
+	const conf = `
+[global]
+upstream = "https://github.com/miekg/blah-origin"
+mount = "/tmp"
+
+[[services]]
+machine = "grafana.atoom.net"
+service = "grafana-server"
+branch = "%s"
+mount = "/tmp/grafana"
+`
+	upstream := t.TempDir()
+	git(upstream, "init", "-b", "main")
+	write := func(branch string) {
+		os.WriteFile(filepath.Join(upstream, "config"), []byte(strings.Replace(conf, "%s", branch, 1)), 0644)
+		git(upstream, "add", ".")
+		git(upstream, "commit", "-m", "branch "+branch)
+	}
+	write("main")
+
+	b := &Bootstrap{Upstream: upstream, Branch: "main", Config: "config", Mount: filepath.Join(t.TempDir(), "bootstrap")}
+	if err := b.newGitCmd().Checkout(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.trackConfig(ctx, 10*time.Millisecond)
+
+	// Each config change must lead to a reload, not just the first one.
+	for _, branch := range []string{"canary", "stable"} {
+		write(branch)
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				t.Fatalf("expected %s, got %s", syscall.SIGHUP, sig)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected reload after changing branch to %q", branch)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"go.science.ru.nl/log"
+)
+
+func TestBreaker(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+	}
+	upstream := t.TempDir()
+	git(upstream, "init", "-b", "main")
+	os.MkdirAll(filepath.Join(upstream, "etc"), 0755)
+	os.WriteFile(filepath.Join(upstream, "etc/a.conf"), []byte("0\n"), 0644)
+	git(upstream, "add", ".")
+	git(upstream, "commit", "-m", "initial")
+
+	gc := gitcmd.New(upstream, "main", filepath.Join(t.TempDir(), "checkout"), "", []string{"etc"})
+	if err := gc.Checkout(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{
+		Service: "grafana-server", Upstream: upstream, Branch: "main",
+		Action:   "exec:false",
+		Failures: 3,
+		machine:  newMachine(false),
+	}
+	s.SetHash(gc.Hash())
+	j := &job{s: s, gc: gc, ready: true}
+
+	// Each reconcile deploys a new commit whose action fails, and must count once.
+	for i := 1; i <= 3; i++ {
+		os.WriteFile(filepath.Join(upstream, "etc/a.conf"), []byte(fmt.Sprintf("%d\n", i)), 0644)
+		git(upstream, "commit", "-am", fmt.Sprintf("update %d", i))
+		j.Reconcile()
+
+		if s.st.Failures != i {
+			t.Fatalf("expected %d failures after %d failed reconciles, got %d", i, i, s.st.Failures)
+		}
+		state, info := s.State()
+		if i < 3 && state != StateBroken {
+			t.Fatalf("expected %s after %d failed reconciles, got %s with %q", StateBroken, i, state, info)
+		}
+		if i == 3 && state != StateFreeze {
+			t.Fatalf("expected the breaker to trip on failed reconcile %d, got %s with %q", i, state, info)
+		}
+	}
+}
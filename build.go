@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/gitopper/sandbox"
+	"go.science.ru.nl/log"
+)
+
+// buildTimeout is how long a build may take.
+const buildTimeout = 10 * time.Minute
+
+// buildSandbox returns the sandbox for the build and the requirements install of s: dirs, the temporary directory
+// and the build cache are writable and the network is only available if s.BuildNetwork is set.
+func (s *Service) buildSandbox(dirs ...string) *sandbox.Options {
+	return &sandbox.Options{Writable: append(dirs, os.TempDir(), s.buildCache()), Network: s.BuildNetwork}
+}
+
+// buildCache returns the cache directory for builds and pip, <mount>/<service>.cache, as the home directory of root
+// isn't writable in the sandbox.
+func (s *Service) buildCache() string { return path.Join(s.Mount, s.Service+".cache") }
+
+// buildEnv returns the environment for the build and the requirements install, with the caches in buildCache.
+func (s *Service) buildEnv() []string {
+	cache := s.buildCache()
+	return append(s.environ(), "XDG_CACHE_HOME="+cache, "GOMODCACHE="+path.Join(cache, "go-mod"))
+}
+
+// build runs the build command of the service in the checkout and installs the resulting artifact. The artifact
+// is copied next to Install and then renamed, so the swap is atomic. A hash is only built once.
+func (s *Service) build() error {
+	hash := s.Hash()
+	if hash != "" && hash == s.built {
+		return nil
+	}
+	repo := path.Join(s.Mount, s.Service)
+
+	ctx, cancel := context.WithTimeout(context.Background(), buildTimeout)
+	defer cancel()
+	cmd := sandbox.Command(ctx, *s.buildSandbox(repo, filepath.Dir(s.Install)), "/bin/sh", "-c", s.Build)
+	cmd.Dir = repo
+	cmd.Env = s.buildEnv()
+	if s.Toolchain != "" {
+		cmd.Env = append(cmd.Env, "GOTOOLCHAIN="+s.Toolchain)
+	}
+	log.Infof("running %v in %q", cmd.Args, repo)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to build %q: %s: %s", s.Service, err, out)
+	}
+
+	if err := install(path.Join(repo, s.Artifact), s.Install); err != nil {
+		return fmt.Errorf("failed to install %q: %s", s.Install, err)
+	}
+	log.Infof("Machine %q, service %q built at %s and installed in %q", s.Machine, s.Service, hash, s.Install)
+	s.built = hash
+	return nil
+}
+
+// install copies the executable src to dst via a temporary file in the same directory as dst.
+func install(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
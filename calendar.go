@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.science.ru.nl/log"
+)
+
+// changeFreeze prefixes the StateInfo of a service whose applies are deferred by its change-freeze calendar.
+const changeFreeze = "CHANGE FREEZE "
+
+// calendarRefresh is how often a calendar is fetched again.
+const calendarRefresh = 5 * time.Minute
+
+// event is a change-freeze period.
+type event struct {
+	start, end time.Time
+	summary    string
+}
+
+// calendar is a change-freeze calendar: an iCal file or an HTTP API that replies with
+// {"frozen": <bool>, "reason": <string>}.
+type calendar struct {
+	url     string
+	fetched time.Time
+	ical    bool
+	events  []event // If ical.
+	frozen  bool    // If not ical.
+	reason  string  // If not ical.
+	sync.Mutex
+}
+
+var (
+	calendars   = map[string]*calendar{}
+	calendarsMu sync.Mutex
+)
+
+// frozen returns true and the reason if the change-freeze calendar of s says we're in a freeze now. A calendar that
+// can't be fetched is logged and its last known contents are used, a calendar that has never been fetched doesn't
+// freeze.
+func (s *Service) frozen(now time.Time) (bool, string) {
+	if s.Calendar == "" {
+		return false, ""
+	}
+	calendarsMu.Lock()
+	c, ok := calendars[s.Calendar]
+	if !ok {
+		c = &calendar{url: s.Calendar}
+		calendars[s.Calendar] = c
+	}
+	calendarsMu.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
+	if now.Sub(c.fetched) > calendarRefresh {
+		if err := c.fetch(); err != nil {
+			log.Warningf("Machine %q, failed to fetch change-freeze calendar %q: %s", s.Machine, c.url, err)
+		}
+		c.fetched = now // also on failure, don't hammer the calendar
+	}
+	if !c.ical {
+		return c.frozen, c.reason
+	}
+	return inFreeze(c.events, now)
+}
+
+// fetch fetches the calendar, it must be called with c locked.
+func (c *calendar) fetch() error {
+	cl := http.Client{Timeout: 10 * time.Second}
+	resp, err := cl.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("BEGIN:VCALENDAR")) {
+		events, err := parseICal(data)
+		if err != nil {
+			return err
+		}
+		c.ical, c.events = true, events
+		return nil
+	}
+	api := struct {
+		Frozen bool
+		Reason string
+	}{}
+	if err := json.Unmarshal(data, &api); err != nil {
+		return err
+	}
+	c.ical, c.frozen, c.reason = false, api.Frozen, api.Reason
+	return nil
+}
+
+// inFreeze returns true and the summary of the event if now is inside one of the events.
+func inFreeze(events []event, now time.Time) (bool, string) {
+	for _, e := range events {
+		if !now.Before(e.start) && now.Before(e.end) {
+			return true, e.summary
+		}
+	}
+	return false, ""
+}
+
+// parseICal returns the events of the iCal (RFC 5545) calendar in data. Only DTSTART, DTEND and SUMMARY are used,
+// recurring events are not expanded; an event without DTEND lasts a day.
+func parseICal(data []byte) ([]event, error) {
+	events := []event{}
+	var (
+		e       event
+		inEvent bool
+	)
+	sc := bufio.NewScanner(bytes.NewReader(unfold(data)))
+	for sc.Scan() {
+		name, value, ok := strings.Cut(strings.TrimRight(sc.Text(), "\r"), ":")
+		if !ok {
+			continue
+		}
+		name, params, _ := strings.Cut(name, ";")
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			e, inEvent = event{}, true
+		case name == "END" && value == "VEVENT":
+			if e.start.IsZero() {
+				return nil, fmt.Errorf("event %q without DTSTART", e.summary)
+			}
+			if e.end.IsZero() {
+				e.end = e.start.AddDate(0, 0, 1)
+			}
+			events = append(events, e)
+			inEvent = false
+		case !inEvent:
+		case name == "SUMMARY":
+			e.summary = value
+		case name == "DTSTART", name == "DTEND":
+			t, err := icalTime(value, params)
+			if err != nil {
+				return nil, err
+			}
+			if name == "DTSTART" {
+				e.start = t
+			} else {
+				e.end = t
+			}
+		}
+	}
+	return events, sc.Err()
+}
+
+// unfold joins the folded lines in data: a line starting with a space or tab continues the previous one.
+func unfold(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n "), nil)
+	data = bytes.ReplaceAll(data, []byte("\r\n\t"), nil)
+	data = bytes.ReplaceAll(data, []byte("\n "), nil)
+	return bytes.ReplaceAll(data, []byte("\n\t"), nil)
+}
+
+// icalTime parses an iCal date or date-time, with the TZID from params if given. Times without a time zone are
+// taken as UTC.
+func icalTime(value, params string) (time.Time, error) {
+	loc := time.UTC
+	for _, p := range strings.Split(params, ";") {
+		if strings.HasPrefix(p, "TZID=") && !strings.HasSuffix(value, "Z") {
+			l, err := time.LoadLocation(strings.TrimPrefix(p, "TZID="))
+			if err != nil {
+				return time.Time{}, err
+			}
+			loc = l
+		}
+	}
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseICal(t *testing.T) {
+	const ics = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:End of year\r\n  freeze\r\nDTSTART;VALUE=DATE:20241220\r\nDTEND;VALUE=DATE:20250102\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Migration\r\nDTSTART;TZID=Europe/Amsterdam:20240301T090000\r\nDTEND:20240301T120000Z\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Release\r\nDTSTART:20240401T000000Z\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	events, err := parseICal([]byte(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+
+	tests := []struct {
+		now    time.Time
+		frozen bool
+		reason string
+	}{
+		{time.Date(2024, 12, 24, 12, 0, 0, 0, time.UTC), true, "End of year freeze"},
+		{time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), false, ""},
+		{time.Date(2024, 3, 1, 7, 59, 0, 0, time.UTC), false, ""}, // 08:59 in Amsterdam
+		{time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC), true, "Migration"},
+		{time.Date(2024, 4, 1, 23, 0, 0, 0, time.UTC), true, "Release"},
+		{time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC), false, ""},
+	}
+	for _, tc := range tests {
+		frozen, reason := inFreeze(events, tc.now)
+		if frozen != tc.frozen || reason != tc.reason {
+			t.Errorf("%s: expected %t %q, got %t %q", tc.now, tc.frozen, tc.reason, frozen, reason)
+		}
+	}
+}
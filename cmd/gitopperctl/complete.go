@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/gitopper/proto"
+	"github.com/urfave/cli/v2"
+)
+
+// complete is the shell completion for commands that take @machine <service> [<service>...]. The first argument
+// completes to the machines known by gitopper on localhost (or the --socket), the others to the services of the
+// machine given. Errors are ignored, there is just nothing to complete then.
+func complete(ctx *cli.Context) {
+	if ctx.NArg() == 0 {
+		cp, err := completions("localhost")
+		if err != nil {
+			return
+		}
+		for _, m := range cp.Machines {
+			fmt.Println("@" + m)
+		}
+		return
+	}
+	at := ctx.Args().First()
+	if !strings.HasPrefix(at, "@") {
+		return
+	}
+	cp, err := completions(at[1:])
+	if err != nil {
+		return
+	}
+	for _, s := range cp.Services {
+		fmt.Println(s)
+	}
+}
+
+func completions(at string) (proto.Complete, error) {
+	cp := proto.Complete{}
+	body, err := query(at, "GET", "complete")
+	if err != nil {
+		return cp, err
+	}
+	err = json.Unmarshal(body, &cp)
+	return cp, err
+}
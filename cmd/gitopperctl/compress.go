@@ -0,0 +1,41 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decoded is a response body that is decompressed while reading.
+type decoded struct {
+	io.Reader
+	close func() error
+}
+
+func (d decoded) Close() error { return d.close() }
+
+// decode makes resp.Body decompress the body as given in the Content-Encoding header.
+func decode(resp *http.Response) error {
+	body := resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		resp.Body = decoded{zr, func() error { zr.Close(); return body.Close() }}
+	case "gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		resp.Body = decoded{gr, body.Close}
+	default:
+		return nil
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.ContentLength = -1
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/proto"
+	"github.com/rodaine/table"
+	"github.com/urfave/cli/v2"
+)
+
+var journalFlags = []cli.Flag{
+	&cli.StringFlag{Name: "service", Aliases: []string{"s"}, Usage: "only show entries for this service"},
+	&cli.StringFlag{Name: "since", Usage: "only show entries since this time (RFC 3339) or duration ago (i.e. 24h)"},
+	&cli.StringFlag{Name: "until", Usage: "only show entries until this time (RFC 3339) or duration ago (i.e. 1h)"},
+}
+
+// entry is a journal entry of a machine.
+type entry struct {
+	machine string
+	start   time.Time
+	proto.JournalEntry
+}
+
+// parseSince parses s as a RFC 3339 time or as a duration before now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// journal queries the journal of all @machines on the command line and returns the entries that match the filters.
+func journal(ctx *cli.Context) ([]entry, error) {
+	now := time.Now()
+	since, err := parseSince(ctx.String("since"), now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --since: %s", err)
+	}
+	until, err := parseSince(ctx.String("until"), now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --until: %s", err)
+	}
+
+	if ctx.NArg() == 0 {
+		return nil, fmt.Errorf("expected @<machine>")
+	}
+	entries := []entry{}
+	for _, at := range ctx.Args().Slice() {
+		if !strings.HasPrefix(at, "@") {
+			return nil, fmt.Errorf("expected @<machine>")
+		}
+		err := stream(func(dec *json.Decoder) error {
+			e := proto.JournalEntry{}
+			if err := dec.Decode(&e); err != nil {
+				return err
+			}
+			if s := ctx.String("service"); s != "" && s != e.Service {
+				return nil
+			}
+			start, _ := time.Parse(time.RFC3339, e.Start)
+			if start.Before(since) || (!until.IsZero() && start.After(until)) {
+				return nil
+			}
+			entries = append(entries, entry{machine: at[1:], start: start, JournalEntry: e})
+			return nil
+		}, at[1:], "GET", "list", "journal")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// short shortens a git hash for display.
+func short(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+// by returns who initiated the apply.
+func by(operator bool) string {
+	if operator {
+		return "operator"
+	}
+	return "auto"
+}
+
+var journalCommand = &cli.Command{
+	Name:    "journal",
+	Aliases: []string{"j"},
+	Usage:   "list journal @machine [@machine...]",
+	Flags:   journalFlags,
+	Action: func(ctx *cli.Context) error {
+		entries, err := journal(ctx)
+		if err != nil {
+			return err
+		}
+		tbl := table.New("MACHINE", "SERVICE", "FROM", "TO", "START", "DURATION", "BY", "RESULT")
+		for _, e := range entries {
+			tbl.AddRow(e.machine, e.Service, short(e.From), short(e.To), e.Start, e.Duration, by(e.Operator), e.Result)
+		}
+		tbl.Print()
+		return nil
+	},
+}
+
+var timelineCommand = &cli.Command{
+	Name:    "timeline",
+	Aliases: []string{"t"},
+	Usage:   "show the journals of one or more machines merged into a single timeline",
+	Flags:   journalFlags,
+	Action: func(ctx *cli.Context) error {
+		entries, err := journal(ctx)
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].start.Before(entries[j].start) })
+
+		tbl := table.New("START", "MACHINE", "SERVICE", "CHANGE", "DURATION", "BY", "RESULT")
+		for _, e := range entries {
+			tbl.AddRow(e.Start, e.machine, e.Service, short(e.From)+".."+short(e.To), e.Duration, by(e.Operator), e.Result)
+		}
+		tbl.Print()
+		return nil
+	},
+}
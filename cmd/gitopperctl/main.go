@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -30,16 +33,79 @@ func atMachine(ctx *cli.Context) (string, error) {
 	return at[1:], nil
 }
 
-func query(at, method string, args ...string) (body []byte, err error) {
-	c := http.Client{Timeout: time.Duration(1) * time.Second}
-	url := "http://" + at + ":8000/" + strings.Join(args, "/")
-	var resp *http.Response
-	switch method {
-	case "GET":
-		resp, err = c.Get(url)
-	case "POST":
-		resp, err = c.Post(url, "", nil)
+var (
+	auth       string // <user>:<password> or a bearer token.
+	scheme     = "http"
+	socket     string // Unix socket to connect to, the machine is then ignored.
+	asJSON     bool   // Print the JSON replies as is.
+	compressed = true // Ask for compressed replies.
+)
+
+// transport is shared by all requests, so connections to a machine are kept open and reused (and multiplexed with
+// HTTP/2 over TLS) when many commands are sent, i.e. from the shell.
+var transport *http.Transport
+
+// send sends the request to machine at and returns the response. The timeout only covers the connection and
+// waiting for the response header, not reading the body. It is a second, or until the deadline of ctx if that is
+// later. Compressed replies are decompressed.
+func send(ctx context.Context, at, method string, args ...string) (*http.Response, error) {
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		if socket != "" {
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			}
+		}
+		transport.DisableCompression = !compressed
+	}
+	timeout := time.Duration(1) * time.Second
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) > timeout {
+		timeout = time.Until(deadline)
+	}
+	url := scheme + "://" + at + ":8000/" + strings.Join(args, "/")
+	if socket != "" {
+		url = "http://unix/" + strings.Join(args, "/")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if compressed {
+		req.Header.Set("Accept-Encoding", "zstd, gzip")
+	}
+	if user, password, ok := strings.Cut(auth, ":"); ok {
+		req.SetBasicAuth(user, password)
+	} else if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+	c := http.Client{Transport: transport}
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := c.Do(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
 	}
+	body := resp.Body
+	resp.Body = decoded{body, func() error { defer cancel(); return body.Close() }}
+	if err := decode(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func query(at, method string, args ...string) (body []byte, err error) {
+	return queryTimeout(time.Duration(1)*time.Second, at, method, args...)
+}
+
+// queryTimeout is like query, but waits up to timeout for the reply.
+func queryTimeout(timeout time.Duration, at, method string, args ...string) (body []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := send(ctx, at, method, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,8 +113,97 @@ func query(at, method string, args ...string) (body []byte, err error) {
 	return ioutil.ReadAll(resp.Body)
 }
 
+// stream is like query, but decodes the list in the {"key":[...]} reply item by item, calling fn with a decoder
+// positioned at each item. This keeps memory use flat for large replies.
+func stream(fn func(*json.Decoder) error, at, method string, args ...string) error {
+	resp, err := send(context.Background(), at, method, args...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	// {"key":[
+	for i := 0; i < 3; i++ {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	for dec.More() {
+		if err := fn(dec); err != nil {
+			return err
+		}
+	}
+	// ]}
+	for i := 0; i < 2; i++ {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// command parses the command line of a state or machine subcommand, with the extra flag fields, into a
+// proto.Command. The machine must be given.
+func command(ctx *cli.Context, verb string, flags ...string) (proto.Command, error) {
+	args := ctx.Args().Slice()
+	if len(args) == 0 || !strings.HasPrefix(args[0], "@") {
+		return proto.Command{}, fmt.Errorf("expected @<machine>")
+	}
+	fields := append([]string{args[0], verb}, flags...)
+	return proto.ParseCommand(append(fields, args[1:]...))
+}
+
+// waitTimeout is how long we wait for approve, which waits for a running reconcile and may fetch, and for
+// disable --stop, which also stops the unit.
+const waitTimeout = 2 * time.Minute
+
+// stateBulk applies the state change verb to all services given on the command line and prints the result for
+// each service.
+func stateBulk(ctx *cli.Context, verb string, flags ...string) error {
+	c, err := command(ctx, verb, flags...)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(1) * time.Second
+	if verb == "approve" || c.Flags["stop"] == "true" {
+		timeout = waitTimeout
+	}
+	body, err := queryTimeout(timeout, c.Machine, "POST", c.Path())
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		fmt.Print(string(body))
+		return nil
+	}
+	sr := proto.StateResults{}
+	if err := json.Unmarshal(body, &sr); err != nil {
+		return err
+	}
+	tbl := table.New("SERVICE", "RESULT")
+	for _, r := range sr.StateResults {
+		tbl.AddRow(r.Service, r.Result)
+	}
+	tbl.Print()
+	return nil
+}
+
 func main() {
 	app := &cli.App{
+		EnableBashCompletion: true,
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "auth", EnvVars: []string{"GITOPPER_AUTH"}, Usage: "<user>:<password> or a bearer token", Destination: &auth},
+			&cli.BoolFlag{Name: "tls", Usage: "use TLS"},
+			&cli.StringFlag{Name: "socket", Usage: "connect to this unix socket, the @machine is ignored", Destination: &socket},
+			&cli.BoolFlag{Name: "json", Usage: "print the JSON replies instead of tables", Destination: &asJSON},
+			&cli.BoolFlag{Name: "compress", Value: true, Usage: "ask for zstd or gzip compressed replies, large replies are then compressed", Destination: &compressed},
+		},
+		Before: func(ctx *cli.Context) error {
+			if ctx.Bool("tls") {
+				scheme = "https"
+			}
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:    "list",
@@ -68,13 +223,17 @@ func main() {
 							if err != nil {
 								return err
 							}
+							if asJSON {
+								fmt.Print(string(body))
+								return nil
+							}
 							lm := proto.ListMachines{}
 							if err := json.Unmarshal(body, &lm); err != nil {
 								return err
 							}
-							tbl := table.New("#", "MACHINE", "ACTUAL")
+							tbl := table.New("#", "MACHINE", "ACTUAL", "SKEW", "MAINTENANCE", "FACTS")
 							for i, m := range lm.ListMachines {
-								tbl.AddRow(i, m.Machine, m.Actual)
+								tbl.AddRow(i, m.Machine, m.Actual, m.Skew, m.Maintenance, facts(m.Facts))
 							}
 							tbl.Print()
 							return nil
@@ -92,6 +251,10 @@ func main() {
 							if err != nil {
 								return err
 							}
+							if asJSON {
+								fmt.Print(string(body))
+								return nil
+							}
 							ls := proto.ListServices{}
 							if err := json.Unmarshal(body, &ls); err != nil {
 								return err
@@ -105,9 +268,10 @@ func main() {
 						},
 					},
 					{
-						Name:    "service",
-						Aliases: []string{"s"},
-						Usage:   "list service @machine <service>",
+						Name:         "service",
+						Aliases:      []string{"s"},
+						Usage:        "list service @machine <service>",
+						BashComplete: complete,
 						Action: func(ctx *cli.Context) error {
 							at, err := atMachine(ctx)
 							if err != nil {
@@ -121,76 +285,158 @@ func main() {
 							if err != nil {
 								return err
 							}
+							if asJSON {
+								fmt.Print(string(body))
+								return nil
+							}
 							ls := proto.ListService{}
 							if err := json.Unmarshal(body, &ls); err != nil {
 								return err
 							}
-							tbl := table.New("SERVICE", "HASH", "STATE", "INFO", "SINCE")
-							tbl.AddRow(ls.Service, ls.Hash, ls.State, ls.StateInfo, timeIsZero(ls.StateChange))
+							tbl := table.New("SERVICE", "HASH", "STATE", "INFO", "SINCE", "UPSTREAM")
+							tbl.AddRow(ls.Service, ls.Hash, ls.State, ls.StateInfo, timeIsZero(ls.StateChange), ls.Upstream)
 							tbl.Print()
 							return nil
 						},
 					},
+					journalCommand,
 				},
 			},
+			timelineCommand,
+			reportCommand,
+			restartCommand,
+			shellCommand,
 			{
 				Name:    "state",
 				Aliases: []string{"st"},
 				Usage:   "apply state changes to a service on a machine",
 				Subcommands: []*cli.Command{
 					{
-						Name:    "freeze",
-						Aliases: []string{"f"},
-						Usage:   "state freeze @machine <service>",
+						Name:         "freeze",
+						Aliases:      []string{"f"},
+						Usage:        "state freeze @machine <service> [<service>...]",
+						BashComplete: complete,
 						Action: func(ctx *cli.Context) error {
-							at, err := atMachine(ctx)
+							return stateBulk(ctx, "freeze")
+						},
+					},
+					{
+						Name:         "unfreeze",
+						Aliases:      []string{"u"},
+						Usage:        "state unfreeze @machine <service> [<service>...]",
+						BashComplete: complete,
+						Action: func(ctx *cli.Context) error {
+							return stateBulk(ctx, "unfreeze")
+						},
+					},
+					{
+						Name:         "disable",
+						Usage:        "state disable [--stop] @machine <service> [<service>...]",
+						BashComplete: complete,
+						Flags:        []cli.Flag{&cli.BoolFlag{Name: "stop", Usage: "also stop the unit"}},
+						Action: func(ctx *cli.Context) error {
+							if ctx.Bool("stop") {
+								return stateBulk(ctx, "disable", "--stop")
+							}
+							return stateBulk(ctx, "disable")
+						},
+					},
+					{
+						Name:         "enable",
+						Usage:        "state enable @machine <service> [<service>...]",
+						BashComplete: complete,
+						Action: func(ctx *cli.Context) error {
+							return stateBulk(ctx, "enable")
+						},
+					},
+					{
+						Name:         "reset",
+						Usage:        "state reset @machine <service> [<service>...]",
+						BashComplete: complete,
+						Action: func(ctx *cli.Context) error {
+							return stateBulk(ctx, "reset")
+						},
+					},
+					{
+						Name:         "rollback",
+						Aliases:      []string{"r"},
+						Usage:        "state rollback @machine <service> <hash|tag|ref>",
+						BashComplete: complete,
+						Action: func(ctx *cli.Context) error {
+							c, err := command(ctx, "rollback")
 							if err != nil {
 								return err
 							}
-							service := ctx.Args().Get(1)
-							if service == "" {
-								return fmt.Errorf("need service")
-							}
-							_, err = query(at, "POST", "state", "freeze", service)
-							return err
+							return rollback(c)
 						},
 					},
 					{
-						Name:    "unfreeze",
-						Aliases: []string{"u"},
-						Usage:   "state unfreeze @machine <service>",
+						Name:         "approve",
+						Usage:        "state approve @machine <service> <hash|tag|ref>",
+						BashComplete: complete,
 						Action: func(ctx *cli.Context) error {
-							at, err := atMachine(ctx)
+							return stateBulk(ctx, "approve")
+						},
+					},
+				},
+			},
+			{
+				Name:    "machine",
+				Aliases: []string{"m"},
+				Usage:   "apply state changes to a machine",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "promote",
+						Usage: "machine promote @machine",
+						Action: func(ctx *cli.Context) error {
+							c, err := command(ctx, "promote")
 							if err != nil {
 								return err
 							}
-							service := ctx.Args().Get(1)
-							if service == "" {
-								return fmt.Errorf("need service")
+							body, err := query(c.Machine, "POST", c.Path())
+							if err != nil {
+								return err
 							}
-							_, err = query(at, "POST", "state", "unfreeze", service)
-							return err
+							fmt.Print(string(body))
+							return nil
 						},
 					},
 					{
-						Name:    "rollback",
-						Aliases: []string{"r"},
-						Usage:   "state rollback @machine <service> <hash>",
+						Name:  "override",
+						Usage: "machine override [--ttl <duration>] @machine",
+						Flags: []cli.Flag{&cli.DurationFlag{Name: "ttl", Value: time.Hour, Usage: "override the change freeze for this long, 0s ends the override"}},
 						Action: func(ctx *cli.Context) error {
-							at, err := atMachine(ctx)
+							c, err := command(ctx, "override", "--ttl="+ctx.Duration("ttl").String())
 							if err != nil {
 								return err
 							}
-							service := ctx.Args().Get(1)
-							if service == "" {
-								return fmt.Errorf("need service")
+							body, err := query(c.Machine, "POST", c.Path())
+							if err != nil {
+								return err
 							}
-							hash := ctx.Args().Get(2)
-							if hash == "" {
-								return fmt.Errorf("need hash to rollback to")
+							fmt.Print(string(body))
+							return nil
+						},
+					},
+					{
+						Name:  "maintenance",
+						Usage: "machine maintenance [--ttl <duration>] @machine on|off",
+						Flags: []cli.Flag{&cli.DurationFlag{Name: "ttl", Usage: "end the maintenance by itself after this long"}},
+						Action: func(ctx *cli.Context) error {
+							flags := []string{}
+							if ttl := ctx.Duration("ttl"); ttl > 0 {
+								flags = append(flags, "--ttl="+ttl.String())
 							}
-							_, err = query(at, "POST", "state", "rollback", service, hash)
-							return err
+							c, err := command(ctx, "maintenance", flags...)
+							if err != nil {
+								return err
+							}
+							body, err := query(c.Machine, "POST", c.Path())
+							if err != nil {
+								return err
+							}
+							fmt.Print(string(body))
+							return nil
 						},
 					},
 				},
@@ -215,3 +461,13 @@ func timeIsZero(s string) string {
 	}
 	return s
 }
+
+// facts returns the facts as sorted key=value pairs.
+func facts(f map[string]string) string {
+	s := make([]string, 0, len(f))
+	for k, v := range f {
+		s = append(s, k+"="+v)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
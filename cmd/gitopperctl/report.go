@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/proto"
+	"github.com/rodaine/table"
+	"github.com/urfave/cli/v2"
+)
+
+// exception returns true if state is one that should be temporary.
+func exception(state string) bool {
+	return state == "FREEZE" || state == "ROLLBACK" || state == "BROKEN"
+}
+
+var reportCommand = &cli.Command{
+	Name:    "report",
+	Aliases: []string{"r"},
+	Usage:   "report the services that are frozen, pinned or broken on one or more machines, longest first",
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() == 0 {
+			return fmt.Errorf("expected @<machine>")
+		}
+		type service struct {
+			machine string
+			since   time.Time
+			proto.ListService
+		}
+		services := []service{}
+		for _, at := range ctx.Args().Slice() {
+			if !strings.HasPrefix(at, "@") {
+				return fmt.Errorf("expected @<machine>")
+			}
+			err := stream(func(dec *json.Decoder) error {
+				ls := proto.ListService{}
+				if err := dec.Decode(&ls); err != nil {
+					return err
+				}
+				if exception(ls.State) {
+					since, _ := time.Parse(time.RFC1123, ls.StateChange)
+					services = append(services, service{machine: at[1:], since: since, ListService: ls})
+				}
+				return nil
+			}, at[1:], "GET", "list", "services")
+			if err != nil {
+				return err
+			}
+		}
+		sort.SliceStable(services, func(i, j int) bool { return services[i].since.Before(services[j].since) })
+
+		now := time.Now()
+		tbl := table.New("MACHINE", "SERVICE", "STATE", "FOR", "INFO")
+		for _, s := range services {
+			tbl.AddRow(s.machine, s.Service, s.State, now.Sub(s.since).Round(time.Minute), s.StateInfo)
+		}
+		tbl.Print()
+		return nil
+	},
+}
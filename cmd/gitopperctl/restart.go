@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/proto"
+	"github.com/urfave/cli/v2"
+)
+
+// restartTimeout is how long we wait for a machine to restart a service, it covers the daemon's probe timeout.
+const restartTimeout = 2 * time.Minute
+
+var restartCommand = &cli.Command{
+	Name:  "restart",
+	Usage: "restart <service> @machine [@machine...], one machine at a time, waiting for the health probe to pass",
+	Action: func(ctx *cli.Context) error {
+		service := ctx.Args().First()
+		machines := ctx.Args().Tail()
+		if service == "" || strings.HasPrefix(service, "@") {
+			return fmt.Errorf("need service")
+		}
+		if len(machines) == 0 {
+			return fmt.Errorf("expected @<machine>")
+		}
+		for _, at := range machines {
+			if !strings.HasPrefix(at, "@") {
+				return fmt.Errorf("expected @<machine>")
+			}
+		}
+		for i, at := range machines {
+			if err := restart(at[1:], service); err != nil {
+				return fmt.Errorf("machine %q: %s, not restarting %s", at[1:], err, strings.Join(machines[i+1:], " "))
+			}
+			fmt.Printf("%s: restarted %s\n", at[1:], service)
+		}
+		return nil
+	},
+}
+
+// restart restarts service on machine at and returns when its health probe passes.
+func restart(at, service string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), restartTimeout)
+	defer cancel()
+	resp, err := send(ctx, at, "POST", "service", "restart", service)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	sr := proto.StateResults{}
+	if err := json.Unmarshal(body, &sr); err != nil {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	for _, r := range sr.StateResults {
+		if r.Result != "OK" {
+			return fmt.Errorf("%s", r.Result)
+		}
+	}
+	return nil
+}
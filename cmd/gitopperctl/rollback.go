@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/proto"
+	"github.com/rodaine/table"
+)
+
+// rollbackTimeout is how long we wait for a machine to roll back a service: a fetch, a checkout and the action.
+const rollbackTimeout = 2 * time.Minute
+
+// rollback executes the rollback command c: it rolls the service back to a hash, tag or ref like HEAD~1 and prints
+// the result and the deployed hash.
+func rollback(c proto.Command) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	resp, err := send(ctx, c.Machine, "POST", c.Path())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		fmt.Print(string(body))
+	}
+	rr := proto.RollbackResult{}
+	if err := json.Unmarshal(body, &rr); err != nil {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if !asJSON {
+		tbl := table.New("SERVICE", "HASH", "DEPLOYED", "RESULT")
+		tbl.AddRow(rr.Service, rr.Hash, rr.Deployed, rr.Result)
+		tbl.Print()
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("rollback of %q failed", c.Services[0])
+	}
+	return nil
+}
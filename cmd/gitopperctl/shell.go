@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+var shellCommand = &cli.Command{
+	Name:  "shell",
+	Usage: "shell, run the commands read from standard input, reusing the connections to the machines",
+	Action: func(ctx *cli.Context) error {
+		if ctx.Args().Present() {
+			return fmt.Errorf("shell takes no arguments")
+		}
+		// Each command is run as a new command line, with the global flags (i.e. --auth) given to us.
+		global := os.Args[:len(os.Args)-1]
+		// And errors are returned to us, instead of exiting.
+		ctx.App.ExitErrHandler = func(*cli.Context, error) {}
+		interactive := false
+		if fi, err := os.Stdin.Stat(); err == nil {
+			interactive = fi.Mode()&os.ModeCharDevice != 0
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for {
+			if interactive {
+				fmt.Print("gitopper> ")
+			}
+			if !scanner.Scan() {
+				break
+			}
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if fields[0] == "exit" || fields[0] == "quit" {
+				return nil
+			}
+			err := fmt.Errorf("can't start a shell in the shell")
+			if fields[0] != "shell" {
+				err = ctx.App.Run(append(append([]string{}, global...), fields...))
+			}
+			if err != nil {
+				// Interactively we carry on, a script stops at the first error.
+				if !interactive {
+					return err
+				}
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		return scanner.Err()
+	},
+}
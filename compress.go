@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressMin is the size from which replies are compressed, smaller replies (i.e. the results of state changes)
+// aren't worth the CPU nor the extra round trip of the decoder setup.
+const compressMin = 1400
+
+// compress compresses large replies with zstd or gzip, when the client accepts that in its Accept-Encoding. It is
+// meant for listings, journals and reports sent over slow links.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := encoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressWriter{ResponseWriter: w, encoding: enc, status: http.StatusOK}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// encoding returns the encoding to use for the Accept-Encoding header, zstd is preferred over gzip.
+func encoding(accept string) string {
+	zstd, gz := false, false
+	for _, a := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(a, ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "zstd":
+			zstd = true
+		case "gzip":
+			gz = true
+		}
+	}
+	switch {
+	case zstd:
+		return "zstd"
+	case gz:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressWriter buffers the reply until it knows if it is large enough to compress: when compressMin bytes are
+// written or when the handler flushes.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	wrote    bool // WriteHeader was called by the handler.
+	buf      bytes.Buffer
+	w        io.WriteCloser // The compressor, nil while buffering.
+	plain    bool           // The reply is sent as is.
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if !c.wrote {
+		c.status, c.wrote = status, true
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	switch {
+	case c.plain:
+		return c.ResponseWriter.Write(p)
+	case c.w != nil:
+		return c.w.Write(p)
+	}
+	c.buf.Write(p)
+	if c.buf.Len() >= compressMin {
+		if err := c.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start writes the header and the buffered data, compressed if large is true.
+func (c *compressWriter) start(large bool) error {
+	h := c.Header()
+	// Already encoded (i.e. the metrics handler does its own gzip), or a reply without a body.
+	if !large || h.Get("Content-Encoding") != "" || c.status < http.StatusOK || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		c.plain = true
+		c.ResponseWriter.WriteHeader(c.status)
+		_, err := c.ResponseWriter.Write(c.buf.Bytes())
+		return err
+	}
+	h.Set("Content-Encoding", c.encoding)
+	h.Del("Content-Length")
+	c.ResponseWriter.WriteHeader(c.status)
+	switch c.encoding {
+	case "zstd":
+		zw, err := zstd.NewWriter(c.ResponseWriter, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		c.w = zw
+	default:
+		c.w = gzip.NewWriter(c.ResponseWriter)
+	}
+	_, err := c.w.Write(c.buf.Bytes())
+	return err
+}
+
+// Flush implements http.Flusher, the reply is compressed from now on, as a flushing handler streams.
+func (c *compressWriter) Flush() {
+	if !c.plain && c.w == nil {
+		if err := c.start(true); err != nil {
+			return
+		}
+	}
+	if f, ok := c.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends what is still buffered and finishes the compressed stream.
+func (c *compressWriter) Close() error {
+	if !c.plain && c.w == nil {
+		return c.start(false)
+	}
+	if c.w != nil {
+		return c.w.Close()
+	}
+	return nil
+}
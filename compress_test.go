@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                     "",
+		"gzip":                 "gzip",
+		"gzip, zstd":           "zstd",
+		"zstd;q=0, gzip":       "gzip",
+		"br, deflate":          "",
+		"gzip;q=0.5, identity": "gzip",
+	}
+	for accept, exp := range tests {
+		if got := encoding(accept); got != exp {
+			t.Errorf("%q: expected %q, got %q", accept, exp, got)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := bytes.Repeat([]byte("gitopper "), compressMin)
+	h := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			w.Write([]byte("OK"))
+			return
+		}
+		w.Write(large)
+	}))
+
+	for _, enc := range []string{"gzip", "zstd"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/small", nil)
+		r.Header.Set("Accept-Encoding", enc)
+		h.ServeHTTP(w, r)
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("Expected small reply to be uncompressed, got %q", ce)
+		}
+		if w.Body.String() != "OK" {
+			t.Errorf("Expected %q, got %q", "OK", w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/large", nil)
+		r.Header.Set("Accept-Encoding", enc)
+		h.ServeHTTP(w, r)
+		if ce := w.Header().Get("Content-Encoding"); ce != enc {
+			t.Fatalf("Expected large reply to be %s compressed, got %q", enc, ce)
+		}
+		var rd io.Reader
+		switch enc {
+		case "gzip":
+			gr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rd = gr
+		case "zstd":
+			zr, err := zstd.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			rd = zr
+		}
+		body, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, large) {
+			t.Errorf("Expected %s reply to decompress to the original", enc)
+		}
+	}
+}
@@ -2,33 +2,415 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/miekg/gitopper/gitcmd"
+	"github.com/miekg/gitopper/ospkg"
 	toml "github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
 )
 
 // Config holds the gitopper config file. It's is updated every so often to pick up new changes.
 type Config struct {
-	Global   *Service
-	Services []*Service
+	Bootstrap *Bootstrap          // If set the services are defined in the config in this repository.
+	Include   []string            // Glob patterns of config files whose services are merged in, relative to the config's directory.
+	Groups    map[string][]string // Host groups, a service's machine of "@<group>" matches all hosts in the group.
+	Templates map[string]*Service // Service templates, a service extends one with Extends.
+	Upstreams []string            // Allowed upstreams (URLs, globs or /regexp/), if empty all are allowed.
+	Network   *Network            // Restricts the servers git may contact.
+	Global    *Service
+	Services  []*Service
 }
 
-func parseConfig(doc []byte) (c Config, err error) {
-	t := toml.NewDecoder(bytes.NewReader(doc))
-	t.DisallowUnknownFields()
-	err = t.Decode(&c)
+// Bootstrap points to the repository that holds the config with the service definitions.
+type Bootstrap struct {
+	Upstream string // The URL of the Git repository holding the config.
+	Branch   string // The branch to track (defaults to 'main').
+	Config   string // Path of the config file in the repository.
+	Mount    string // Directory where the repository is checked out.
+	Machine  string // Identity of this machine, used to match services in addition to the hostname.
+
+	network *Network // See Config.Network.
+}
+
+// readConfig reads the config from path, if needed verifies its signature, parses and validates it. If path is a
+// directory all config files in it are read (in lexical order) and merged. Files matched by Include are merged
+// as well.
+func readConfig(path string) (Config, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Config{}, err
+	}
+	c := Config{}
+	dir := filepath.Dir(path)
+	if fi.IsDir() {
+		dir = path
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return Config{}, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || !isConfig(e.Name()) {
+				continue
+			}
+			if err := c.include(filepath.Join(path, e.Name()), true); err != nil {
+				return Config{}, err
+			}
+		}
+	} else {
+		if c, err = readConfigFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid include %q: %s", pattern, err)
+		}
+		for _, m := range matches {
+			if err := c.include(m, false); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+
+	if err := c.extend(); err != nil {
+		return Config{}, fmt.Errorf("the configuration is not valid: %s", err)
+	}
+	if err := c.delegate(); err != nil {
+		return Config{}, fmt.Errorf("the delegated configuration is not valid: %s", err)
+	}
+	// Delegated services may extend templates too, extending twice is harmless.
+	if err := c.extend(); err != nil {
+		return Config{}, fmt.Errorf("the configuration is not valid: %s", err)
+	}
+	if err := c.Valid(); err != nil {
+		return Config{}, fmt.Errorf("the configuration is not valid: %s", err)
+	}
+	c.expandGroups()
+	c.restrict(c.Network)
+	return c, nil
+}
+
+// readConfigFile reads the config from path, if needed verifies its signature and parses it.
+func readConfigFile(path string) (Config, error) {
+	doc, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if configPublicKey != "" {
+		sig, err := os.ReadFile(path + ".sig")
+		if err != nil {
+			return Config{}, fmt.Errorf("config signature is mandatory: %s", err)
+		}
+		if err := verifyConfig(configPublicKey, doc, sig); err != nil {
+			return Config{}, fmt.Errorf("the configuration's signature is not valid: %s", err)
+		}
+	}
+	c, err := parseConfig(doc, configFormat(path))
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %s", path, err)
+	}
+	return c, nil
+}
+
+// include reads the config in path and merges its services into c. If top is true the file may also define
+// global, bootstrap and include, but only once across all files.
+func (c *Config) include(path string, top bool) error {
+	f, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if !top && (f.Global != nil || f.Bootstrap != nil || len(f.Include) > 0 || len(f.Groups) > 0 || len(f.Templates) > 0 || len(f.Upstreams) > 0 || f.Network != nil) {
+		return fmt.Errorf("included config %q may only define services", path)
+	}
+	for g, hosts := range f.Groups {
+		if _, ok := c.Groups[g]; ok {
+			return fmt.Errorf("config %q redefines group %q", path, g)
+		}
+		if c.Groups == nil {
+			c.Groups = map[string][]string{}
+		}
+		c.Groups[g] = hosts
+	}
+	for name, t := range f.Templates {
+		if _, ok := c.Templates[name]; ok {
+			return fmt.Errorf("config %q redefines template %q", path, name)
+		}
+		if c.Templates == nil {
+			c.Templates = map[string]*Service{}
+		}
+		c.Templates[name] = t
+	}
+	if f.Global != nil {
+		if c.Global != nil {
+			return fmt.Errorf("config %q redefines global", path)
+		}
+		c.Global = f.Global
+	}
+	if f.Network != nil {
+		if c.Network != nil {
+			return fmt.Errorf("config %q redefines network", path)
+		}
+		c.Network = f.Network
+	}
+	if len(f.Upstreams) > 0 {
+		if len(c.Upstreams) > 0 {
+			return fmt.Errorf("config %q redefines upstreams", path)
+		}
+		c.Upstreams = f.Upstreams
+	}
+	if f.Bootstrap != nil {
+		if c.Bootstrap != nil {
+			return fmt.Errorf("config %q redefines bootstrap", path)
+		}
+		c.Bootstrap = f.Bootstrap
+	}
+	c.Include = append(c.Include, f.Include...)
+	c.Services = append(c.Services, f.Services...)
+	return nil
+}
+
+// allowed returns an error if the upstream of the bootstrap or of any service doesn't match one of the patterns
+// in allow. If allow is empty all upstreams are allowed.
+func (c Config) allowed(allow []string) error {
+	if len(allow) == 0 {
+		return nil
+	}
+	if c.Bootstrap != nil && !matchAny(allow, c.Bootstrap.Upstream) {
+		return fmt.Errorf("bootstrap upstream %q is not allowed", c.Bootstrap.Upstream)
+	}
+	for i, s := range c.Services {
+		upstream := s.Upstream
+		if c.Global != nil && c.Global.Upstream != "" {
+			upstream = c.Global.Upstream // see merge
+		}
+		if upstream != "" && !matchAny(allow, upstream) {
+			return fmt.Errorf("machine #%d %q, upstream %q is not allowed", i, s.Machine, upstream)
+		}
+		mirrors := s.Mirrors
+		if len(mirrors) == 0 && c.Global != nil {
+			mirrors = c.Global.Mirrors // see merge
+		}
+		for _, m := range mirrors {
+			if !matchAny(allow, m) {
+				return fmt.Errorf("machine #%d %q, mirror %q is not allowed", i, s.Machine, m)
+			}
+		}
+	}
+	return nil
+}
+
+// restrict makes the services and the bootstrap of c honor the network policy n.
+func (c Config) restrict(n *Network) {
+	if c.Bootstrap != nil {
+		c.Bootstrap.network = n
+	}
+	for _, s := range c.Services {
+		s.network = n
+	}
+}
+
+// byPriority orders the services of c on priority, highest first. Services with the same priority keep their order.
+func (c Config) byPriority() {
+	sort.SliceStable(c.Services, func(i, j int) bool { return c.Services[i].Priority > c.Services[j].Priority })
+}
+
+// expandGroups sets the hosts of each service whose machine is a group.
+func (c Config) expandGroups() {
+	for _, s := range c.Services {
+		if g, ok := group(s.Machine); ok {
+			s.group = c.Groups[g]
+		}
+	}
+}
+
+// group returns the group name if machine is of the form "@<group>".
+func group(machine string) (string, bool) {
+	if strings.HasPrefix(machine, "@") {
+		return machine[1:], true
+	}
+	return "", false
+}
+
+// isConfig returns true if name looks like a config file, i.e. has a .toml, .yaml, .yml or .json extension.
+func isConfig(name string) bool {
+	switch filepath.Ext(name) {
+	case ".toml", ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// configFormat returns the format of the config in path: the -format flag if given, otherwise it is derived from
+// the extension: .yaml or .yml is YAML, .json is JSON and anything else is TOML.
+func configFormat(path string) string {
+	if *flagFormat != "" {
+		return *flagFormat
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	}
+	return "toml"
+}
+
+// parseConfig parses doc in format (toml, yaml or json). Unknown fields are an error in all formats, the error
+// has the line and column of the offending field.
+func parseConfig(doc []byte, format string) (c Config, err error) {
+	switch format {
+	case "toml":
+		t := toml.NewDecoder(bytes.NewReader(doc))
+		t.DisallowUnknownFields()
+		t.EnableUnmarshalerInterface() // For Dir.
+		err = tomlError(t.Decode(&c))
+	case "yaml":
+		// yaml.v3 errors already have the line.
+		y := yaml.NewDecoder(bytes.NewReader(doc))
+		y.KnownFields(true)
+		err = y.Decode(&c)
+	case "json":
+		j := json.NewDecoder(bytes.NewReader(doc))
+		j.DisallowUnknownFields()
+		if err = j.Decode(&c); err != nil {
+			line, col := position(doc, j.InputOffset())
+			err = fmt.Errorf("line %d, column %d: %s", line, col, err)
+		}
+	default:
+		err = fmt.Errorf("unknown config format %q", format)
+	}
 	return c, err
 }
 
+// tomlError adds the line and column to the errors of the TOML decoder.
+func tomlError(err error) error {
+	var strict *toml.StrictMissingError
+	if errors.As(err, &strict) {
+		s := make([]string, len(strict.Errors))
+		for i, e := range strict.Errors {
+			line, col := e.Position()
+			s[i] = fmt.Sprintf("line %d, column %d: unknown field %q", line, col, strings.Join(e.Key(), "."))
+		}
+		return errors.New(strings.Join(s, "; "))
+	}
+	var decode *toml.DecodeError
+	if errors.As(err, &decode) {
+		line, col := decode.Position()
+		return fmt.Errorf("line %d, column %d: %s", line, col, decode)
+	}
+	return err
+}
+
+// position returns the line and column of offset in doc, both start at 1.
+func position(doc []byte, offset int64) (line, col int) {
+	if offset > int64(len(doc)) {
+		offset = int64(len(doc))
+	}
+	before := doc[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// configPublicKey is the base64 encoded ed25519 public key used to verify the signature of the config. It is
+// set at build time with: -ldflags "-X main.configPublicKey=<key>". If empty no verification is done.
+var configPublicKey = ""
+
+// verifyConfig verifies the detached signature sig of the config in doc with the public key pub.
+func verifyConfig(pub string, doc, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(pub)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key: length should be %d, got %d", ed25519.PublicKeySize, len(key))
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), doc, sig) {
+		return errors.New("signature does not verify")
+	}
+	return nil
+}
+
 // Valid checks the config in c and returns nil of all mandatory fields have been set.
 func (c Config) Valid() error {
+	if b := c.Bootstrap; b != nil {
+		if b.Upstream == "" {
+			return fmt.Errorf("bootstrap has empty upstream")
+		}
+		if b.Config == "" {
+			return fmt.Errorf("bootstrap has empty config")
+		}
+		if b.Mount == "" {
+			return fmt.Errorf("bootstrap has empty mount")
+		}
+	}
+	for _, u := range c.Upstreams {
+		if _, err := matchMachine(u, ""); err != nil {
+			return fmt.Errorf("upstreams, has invalid pattern %q: %s", u, err)
+		}
+	}
+	if err := c.allowed(c.Upstreams); err != nil {
+		return err
+	}
+	if err := c.Network.valid(); err != nil {
+		return err
+	}
+	for g, hosts := range c.Groups {
+		for _, h := range hosts {
+			if _, err := matchMachine(h, ""); err != nil {
+				return fmt.Errorf("group %q, has invalid pattern %q: %s", g, h, err)
+			}
+		}
+	}
 	for i, s := range c.Services {
 		s1 := s.merge(c.Global, 0) // don't care about duration here
-		if s1.Machine == "" {
+		if s1.Machine == "" && len(s1.Labels) == 0 {
 			return fmt.Errorf("machine #%d, has empty machine name", i)
 		}
-		if s1.Upstream == "" {
-			return fmt.Errorf("machine #%d %q, has empty upstream", i, s1.Machine)
+		if g, ok := group(s1.Machine); ok {
+			if _, ok := c.Groups[g]; !ok {
+				return fmt.Errorf("machine #%d %q, has unknown group %q", i, s1.Machine, g)
+			}
+		}
+		for _, p := range append([]string{strings.TrimPrefix(s1.Machine, "!")}, s1.Exclude...) {
+			if _, err := matchMachine(p, ""); err != nil {
+				return fmt.Errorf("machine #%d %q, has invalid pattern %q: %s", i, s1.Machine, p, err)
+			}
+		}
+		if s1.Upstream == "" && s1.Bundle == "" {
+			return fmt.Errorf("machine #%d %q, has empty upstream and bundle", i, s1.Machine)
+		}
+		if d := filepath.Clean(s1.Delegate); s1.Delegate != "" && (filepath.IsAbs(d) || d == ".." || strings.HasPrefix(d, "../")) {
+			return fmt.Errorf("machine #%d %q, delegate %q is not in the repository", i, s1.Machine, s1.Delegate)
+		}
+		if s1.DelegateRoot != "" && (s1.Delegate == "" || !filepath.IsAbs(s1.DelegateRoot)) {
+			return fmt.Errorf("machine #%d %q, delegateroot %q must be absolute and needs delegate", i, s1.Machine, s1.DelegateRoot)
+		}
+		if len(s1.Mirrors) > 0 && s1.Bundle != "" {
+			return fmt.Errorf("machine #%d %q, has mirrors and a bundle", i, s1.Machine)
+		}
+		seen := map[string]bool{s1.Upstream: true}
+		for _, m := range s1.Mirrors {
+			if m == "" || seen[m] {
+				return fmt.Errorf("machine #%d %q, has empty or duplicate mirror %q", i, s1.Machine, m)
+			}
+			seen[m] = true
 		}
 		if s1.Mount == "" {
 			return fmt.Errorf("machine #%d %q, has empty mount", i, s1.Machine)
@@ -36,6 +418,167 @@ func (c Config) Valid() error {
 		if s1.Service == "" {
 			return fmt.Errorf("machine #%d %q, has empty service", i, s1.Service)
 		}
+		if strings.ContainsAny(s1.Service, `/\`) || strings.Contains(s1.Service, "..") {
+			return fmt.Errorf("machine #%d %q, service %q can't contain a path separator or \"..\"", i, s1.Machine, s1.Service)
+		}
+		if s1.PackageManager != "" {
+			if _, err := ospkg.Lookup(s1.PackageManager); err != nil {
+				return fmt.Errorf("machine #%d %q, %s", i, s1.Machine, err)
+			}
+		}
+		if s1.Build != "" && (s1.Artifact == "" || s1.Install == "") {
+			return fmt.Errorf("machine #%d %q, build needs artifact and install", i, s1.Machine)
+		}
+		if s1.Manifest != "" && s1.Install == "" {
+			return fmt.Errorf("machine #%d %q, manifest needs install", i, s1.Machine)
+		}
+		if s1.Build != "" && s1.Manifest != "" {
+			return fmt.Errorf("machine #%d %q, has both build and manifest", i, s1.Machine)
+		}
+		for k := range s1.Env {
+			if k == "" || strings.ContainsAny(k, "=\x00") {
+				return fmt.Errorf("machine #%d %q, has invalid environment variable %q", i, s1.Machine, k)
+			}
+		}
+		if s1.Interval < 0 {
+			return fmt.Errorf("machine #%d %q, has negative interval %s", i, s1.Machine, time.Duration(s1.Interval))
+		}
+		if s1.Schedule != "" {
+			if _, err := parseSchedule(s1.Schedule); err != nil {
+				return fmt.Errorf("machine #%d %q, %s", i, s1.Machine, err)
+			}
+		}
+		if strings.HasPrefix(s1.Action, zonePrefix) {
+			if _, ok := nameservers[strings.TrimPrefix(s1.Action, zonePrefix)]; !ok {
+				return fmt.Errorf("machine #%d %q, has unknown name server in action %q", i, s1.Machine, s1.Action)
+			}
+		}
+		if _, glob, ok := validator(s1.Validate); ok {
+			if _, err := filepath.Match(glob, ""); err != nil {
+				return fmt.Errorf("machine #%d %q, has invalid validate glob %q: %s", i, s1.Machine, glob, err)
+			}
+		}
+		if s1.Secret != "" && !strings.HasPrefix(s1.Secret, secretFile) && !strings.HasPrefix(s1.Secret, secretEnv) && !strings.HasPrefix(s1.Secret, secretExec) {
+			return fmt.Errorf("machine #%d %q, has unknown secret source %q", i, s1.Machine, s1.Secret)
+		}
+		if u, err := url.Parse(s1.Upstream); err == nil {
+			if _, ok := u.User.Password(); ok {
+				return fmt.Errorf("machine #%d %q, upstream has embedded credentials, use secret or credentialhelper", i, s1.Machine)
+			}
+		}
+		if s1.Proxy != "" && s1.Proxy != proxyNone {
+			if err := validProxy(s1.Proxy); err != nil {
+				return fmt.Errorf("machine #%d %q, %s", i, s1.Machine, err)
+			}
+		}
+		if s1.CredentialHelper != "" && gitcmd.IsSSH(s1.Upstream) {
+			return fmt.Errorf("machine #%d %q, has credentialhelper, but upstream %q is SSH", i, s1.Machine, s1.Upstream)
+		}
+		switch gitcmd.Strategy(s1.Strategy) {
+		case "", gitcmd.FastForward, gitcmd.Rebase, gitcmd.Reset:
+		default:
+			return fmt.Errorf("machine #%d %q, has unknown strategy %q", i, s1.Machine, s1.Strategy)
+		}
+		switch s1.OnForcePush {
+		case "", "freeze", "reset", "fail":
+		default:
+			return fmt.Errorf("machine #%d %q, has unknown onforcepush %q", i, s1.Machine, s1.OnForcePush)
+		}
+		if s1.OnForcePush != "" && s1.Strategy != "" && gitcmd.Strategy(s1.Strategy) != gitcmd.FastForward {
+			return fmt.Errorf("machine #%d %q, has onforcepush, but strategy %q isn't ff-only", i, s1.Machine, s1.Strategy)
+		}
+		if s1.MaxLoad < 0 {
+			return fmt.Errorf("machine #%d %q, has negative maxload %g", i, s1.Machine, s1.MaxLoad)
+		}
+		if s1.Depth < 0 {
+			return fmt.Errorf("machine #%d %q, has negative depth %d", i, s1.Machine, s1.Depth)
+		}
+		if s1.Filter != "" && !validFilter(s1.Filter) {
+			return fmt.Errorf("machine #%d %q, has invalid filter %q", i, s1.Machine, s1.Filter)
+		}
+		if s1.IdentityFile != "" {
+			if !filepath.IsAbs(s1.IdentityFile) {
+				return fmt.Errorf("machine #%d %q, identityfile %q isn't an absolute path", i, s1.Machine, s1.IdentityFile)
+			}
+			if !gitcmd.IsSSH(s1.Upstream) {
+				return fmt.Errorf("machine #%d %q, has identityfile, but upstream %q isn't SSH", i, s1.Machine, s1.Upstream)
+			}
+		}
+		if s1.RequireSigned && len(s1.Signers) == 0 {
+			return fmt.Errorf("machine #%d %q, requires signed commits, but has no signers", i, s1.Machine)
+		}
+		for _, k := range s1.Signers {
+			if err := validSigner(k); err != nil {
+				return fmt.Errorf("machine #%d %q, %s", i, s1.Machine, err)
+			}
+		}
+		if s1.Commit != "" {
+			if (len(s1.Commit) != 40 && len(s1.Commit) != 64) || strings.Trim(s1.Commit, "0123456789abcdef") != "" {
+				return fmt.Errorf("machine #%d %q, commit %q isn't a full hash", i, s1.Machine, s1.Commit)
+			}
+			if s1.Tag != "" {
+				return fmt.Errorf("machine #%d %q, has both commit and tag", i, s1.Machine)
+			}
+		}
+		if s1.Tag != "" {
+			if err := validTag(s1.Tag); err != nil {
+				return fmt.Errorf("machine #%d %q, has invalid tag %q: %s", i, s1.Machine, s1.Tag, err)
+			}
+		}
+		switch s1.Backend {
+		case "", backendGit:
+		case backendGoGit:
+			if s1.Tag != "" || s1.Commit != "" {
+				return fmt.Errorf("machine #%d %q, tags and commits aren't supported by backend %q", i, s1.Machine, s1.Backend)
+			}
+			if gitcmd.Strategy(s1.Strategy) == gitcmd.Rebase {
+				return fmt.Errorf("machine #%d %q, strategy %q isn't supported by backend %q", i, s1.Machine, s1.Strategy, s1.Backend)
+			}
+			if s1.Bundle != "" {
+				return fmt.Errorf("machine #%d %q, bundles aren't supported by backend %q", i, s1.Machine, s1.Backend)
+			}
+			if s1.CredentialHelper != "" {
+				return fmt.Errorf("machine #%d %q, credential helpers aren't supported by backend %q", i, s1.Machine, s1.Backend)
+			}
+			if s1.Submodules {
+				return fmt.Errorf("machine #%d %q, submodules aren't supported by backend %q", i, s1.Machine, s1.Backend)
+			}
+			if strings.HasPrefix(s1.Proxy, "socks4") {
+				return fmt.Errorf("machine #%d %q, SOCKS4 proxies aren't supported by backend %q", i, s1.Machine, s1.Backend)
+			}
+			// These fetch, stage, verify or diff commits, which is only done with the git binary.
+			for _, f := range []struct {
+				name string
+				set  bool
+			}{
+				{"policy", s1.Policy != ""},
+				{"validate", s1.Validate != ""},
+				{"requiresigned", s1.RequireSigned},
+				{"control", s1.Control != ""},
+				{"config", s1.Config != ""},
+				{"delegate", s1.Delegate != ""},
+				{"zone action", strings.HasPrefix(s1.Action, zonePrefix)},
+			} {
+				if f.set {
+					return fmt.Errorf("machine #%d %q, %s needs git and isn't supported by backend %q", i, s1.Machine, f.name, s1.Backend)
+				}
+			}
+		default:
+			return fmt.Errorf("machine #%d %q, has unknown backend %q", i, s1.Machine, s1.Backend)
+		}
 	}
 	return nil
 }
+
+// validFilter returns true if filter is "none" or one of git's filter specs (see git-rev-list(1), --filter).
+func validFilter(filter string) bool {
+	if filter == filterNone || filter == "blob:none" {
+		return true
+	}
+	for _, prefix := range []string{"blob:limit=", "tree:", "object:type=", "sparse:oid=", "combine:"} {
+		if strings.HasPrefix(filter, prefix) && len(filter) > len(prefix) && !strings.ContainsAny(filter, " \t\n") {
+			return true
+		}
+	}
+	return false
+}
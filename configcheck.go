@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/systemd"
+)
+
+// checkCommand validates a config and checks the environment it needs: the upstreams are reachable, the files
+// with credentials are readable, the mount directories are writable and the systemd units exist. It returns the
+// exit code: 0 if everything is fine, 1 if a check failed and 2 if the config isn't valid.
+func checkCommand(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	config := fs.String("c", "", "config file to check")
+	auth := fs.String("auth", "", "file with credentials to check")
+	cert := fs.String("cert", "", "TLS certificate file to check")
+	key := fs.String("key", "", "TLS key file to check")
+	asJSON := fs.Bool("json", false, "report in JSON")
+	var hosts sliceFlag
+	fs.Var(&hosts, "h", "only check the services of these hosts, can be given multiple times")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *config == "" {
+		fmt.Fprintln(os.Stderr, "-c flag is mandatory")
+		return 2
+	}
+
+	c, err := readConfig(*config)
+	checks := []check{{"config " + *config, func() (string, error) {
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d services", len(c.Services)), nil
+	}}}
+	if err != nil {
+		report(os.Stdout, checks, *asJSON)
+		return 2
+	}
+
+	for _, f := range []string{*auth, *cert, *key} {
+		f := f
+		if f != "" {
+			checks = append(checks, check{"read " + f, func() (string, error) { return "readable", readable(f) }})
+		}
+	}
+	if b := c.Bootstrap; b != nil {
+		checks = append(checks, check{"upstream " + b.Upstream, func() (string, error) { return reachable(b.Upstream, b.Branch) }})
+	}
+
+	seen := map[string]bool{}
+	add := func(name string, fn func() (string, error)) {
+		if !seen[name] {
+			seen[name] = true
+			checks = append(checks, check{name, fn})
+		}
+	}
+	for _, s := range c.Services {
+		if len(hosts) > 0 && !s.forMe(hosts, nil) {
+			continue
+		}
+		s := s.merge(c.Global, 0)
+		if s.Bundle != "" {
+			add("bundle "+s.Bundle, func() (string, error) { return "readable", readable(s.Bundle) })
+		} else {
+			add("upstream "+s.Upstream, func() (string, error) { return reachable(s.Upstream, s.Branch) })
+		}
+		if s.IdentityFile != "" {
+			add("read "+s.IdentityFile, func() (string, error) { return "readable", readable(s.IdentityFile) })
+		}
+		add("mount "+s.Mount, func() (string, error) { return writable(s.Mount) })
+		if s.Action != "" && !strings.HasPrefix(s.Action, execPrefix) {
+			add("unit "+systemd.Unit(s.Service), func() (string, error) { return unitExists(s.Service) })
+		}
+	}
+
+	if !report(os.Stdout, checks, *asJSON) {
+		return 1
+	}
+	return 0
+}
+
+func readable(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// reachable checks if branch exists upstream.
+func reachable(upstream, branch string) (string, error) {
+	if branch == "" {
+		branch = "main"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--exit-code", upstream, "refs/heads/"+branch)
+	cmd.Env = []string{"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null", "GIT_TERMINAL_PROMPT=0"}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("branch %q: %s %s", branch, err, strings.TrimSpace(string(out)))
+	}
+	hash, _, _ := strings.Cut(string(out), "\t")
+	return branch + " at " + hash, nil
+}
+
+// writable checks if dir, or the first parent that exists if dir doesn't, is a writable directory. Nothing is
+// created.
+func writable(dir string) (string, error) {
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return "", fmt.Errorf("%q is not a directory", dir)
+			}
+			f, err := os.CreateTemp(dir, ".gitopper-check")
+			if err != nil {
+				return "", err
+			}
+			f.Close()
+			return dir + " is writable", os.Remove(f.Name())
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", err
+		}
+		dir = parent
+	}
+}
+
+func unitExists(service string) (string, error) {
+	state, err := run("systemctl", "show", "--property=LoadState", "--value", systemd.Unit(service))
+	if err != nil {
+		return "", err
+	}
+	if state != "loaded" {
+		return "", fmt.Errorf("unit is %s", state)
+	}
+	return state, nil
+}
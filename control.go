@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"github.com/miekg/gitopper/proto"
+	"go.science.ru.nl/log"
+)
+
+// control reads the control file from the control branch and applies the commands in it, if it changed since
+// the last time. If s requires signed commits, the commit the control file is read from must be signed. The control file holds one command per line:
+//
+//	[@<machine>] freeze <service>[,<service>...]
+//	[@<machine>] unfreeze <service>[,<service>...]
+//	[@<machine>] reset <service>[,<service>...]
+//	[@<machine>] disable [--stop] <service>[,<service>...]
+//	[@<machine>] enable <service>[,<service>...]
+//	[@<machine>] restart <service>[,<service>...]
+//	[@<machine>] rollback <service> <hash|tag|ref>
+//	[@<machine>] approve <service> <hash|tag|ref>
+//
+// See proto.Command for the syntax, <machine> is one of the hostnames of this machine, not a machine pattern from
+// the config. Commands for other services or machines are ignored, as are empty lines and lines starting with a #.
+// This allows controlling gitopper without a reachable HTTP port.
+func (s *Service) control(gc *gitcmd.Git) {
+	branch := s.ControlBranch
+	if branch == "" {
+		branch = s.Branch
+	}
+	data, commit, err := gc.Show(branch, s.Control)
+	if err != nil {
+		log.Warningf("Machine %q, error reading control file %q from branch %q: %s", s.Machine, s.Control, branch, err)
+		return
+	}
+	sum := sha1.Sum(data)
+	hash := hex.EncodeToString(sum[:])
+	s.RLock()
+	applied := hash == s.st.Control
+	s.RUnlock()
+	if applied {
+		return
+	}
+	// Anyone who can push could otherwise freeze, rollback or approve.
+	if s.RequireSigned {
+		if err := gc.VerifyCommit(commit, s.Signers); err != nil {
+			log.Warningf("Machine %q, signature of %s for control file %q: %s, ignoring it", s.Machine, commit, s.Control, err)
+			return
+		}
+	}
+	s.Lock()
+	// Saved in the store, so the commands aren't applied again after a restart.
+	s.st.Control = hash
+	s.save()
+	s.Unlock()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		c, err := proto.ParseCommand(fields)
+		if err != nil {
+			log.Warningf("Machine %q, error in control file %q: %s", s.Machine, s.Control, err)
+			continue
+		}
+		if c.Machine != "" && !s.machine.Is(c.Machine) {
+			continue
+		}
+		if !c.IsMachine() && !contains(c.Services, s.Service) {
+			continue
+		}
+		if err := s.command(gc, c); err != nil {
+			log.Warningf("Machine %q, error in control file %q: %s", s.Machine, s.Control, err)
+			continue
+		}
+		log.Infof("Machine %q, service %q, applied %q from control file", s.Machine, s.Service, c)
+	}
+}
+
+// command applies the control command c to s, a rollback target is resolved with gc.
+func (s *Service) command(gc *gitcmd.Git, c proto.Command) error {
+	switch c.Verb {
+	case "freeze":
+		s.SetState(StateFreeze, "")
+	case "unfreeze":
+		s.SetState(StateOK, "")
+	case "disable":
+		s.SetState(StateDisabled, "")
+		if c.Flags["stop"] == "true" {
+			return s.stop()
+		}
+	case "enable":
+		return s.enable()
+	case "reset":
+		s.ResetFailures()
+		s.SetState(StateOK, "")
+	case "restart":
+		return s.restart()
+	case "rollback":
+		full, err := gc.Resolve(c.Args[0])
+		if err != nil {
+			return err
+		}
+		s.SetState(StateRollback, full)
+	case "approve":
+		full, err := gc.Resolve(c.Args[0])
+		if err != nil {
+			return err
+		}
+		s.Approve(full)
+	default:
+		return fmt.Errorf("%s is not allowed in the control file", c.Verb)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"go.science.ru.nl/log"
+)
+
+func TestControl(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	upstream := t.TempDir()
+	git(upstream, "init", "-b", "main")
+	os.WriteFile(filepath.Join(upstream, "control"), []byte("freeze grafana-server\napprove grafana-server HEAD\n"), 0644)
+	git(upstream, "add", ".")
+	git(upstream, "commit", "-m", "control")
+	head := git(upstream, "rev-parse", "HEAD")
+
+	gc := gitcmd.New(upstream, "main", filepath.Join(t.TempDir(), "checkout"), "", nil)
+	if err := gc.Checkout(); err != nil {
+		t.Fatal(err)
+	}
+	m := newMachine(false)
+	s := &Service{Service: "grafana-server", Branch: "main", Control: "control", machine: m}
+	s.control(gc)
+	if state, _ := s.State(); state != StateFreeze {
+		t.Errorf("expected %s, got %s", StateFreeze, state)
+	}
+	if approved := s.Approved(); approved != head {
+		t.Errorf("expected %s to be approved, got %q", head, approved)
+	}
+
+	// After a restart the state is loaded from the store, the control file isn't applied again.
+	s1 := &Service{Service: "grafana-server", Branch: "main", Control: "control", machine: m}
+	s1.load()
+	s1.SetState(StateOK, "")
+	s1.control(gc)
+	if state, _ := s1.State(); state != StateOK {
+		t.Errorf("expected control file not to be applied again, got %s", state)
+	}
+}
+
+// controlRepo returns a checkout of a new repository that has control as its control file.
+func controlRepo(t *testing.T, control string) *gitcmd.Git {
+	t.Helper()
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+	}
+	upstream := t.TempDir()
+	git(upstream, "init", "-b", "main")
+	os.WriteFile(filepath.Join(upstream, "control"), []byte(control), 0644)
+	git(upstream, "add", ".")
+	git(upstream, "commit", "-m", "control")
+
+	gc := gitcmd.New(upstream, "main", filepath.Join(t.TempDir(), "checkout"), "", nil)
+	if err := gc.Checkout(); err != nil {
+		t.Fatal(err)
+	}
+	return gc
+}
+
+func TestControlEnable(t *testing.T) {
+	log.Discard()
+	gc := controlRepo(t, "enable grafana-server\n")
+	tests := []struct {
+		state State
+		exp   State
+	}{
+		{StateDisabled, StateOK},
+		{StateFreeze, StateFreeze},
+		{StateRollback, StateRollback},
+		{StateBroken, StateBroken},
+	}
+	for _, tc := range tests {
+		s := &Service{Service: "grafana-server", Branch: "main", Control: "control", machine: newMachine(false)}
+		s.SetState(tc.state, "")
+		s.control(gc)
+		if state, _ := s.State(); state != tc.exp {
+			t.Errorf("enable of %s service: expected %s, got %s", tc.state, tc.exp, state)
+		}
+	}
+}
+
+func TestControlMachine(t *testing.T) {
+	log.Discard()
+	gc := controlRepo(t, "@web-1 freeze grafana-server\n@web-2 disable grafana-server\n")
+	m := newMachine(false)
+	m.Hosts = []string{"web-1"}
+	// The machine in the config is a pattern, the prefix is matched against our hostnames.
+	s := &Service{Machine: "web-*", Service: "grafana-server", Branch: "main", Control: "control", machine: m}
+	s.control(gc)
+	if state, _ := s.State(); state != StateFreeze {
+		t.Errorf("expected %s, got %s", StateFreeze, state)
+	}
+}
+
+func TestControlUnsigned(t *testing.T) {
+	log.Discard()
+	gc := controlRepo(t, "freeze grafana-server\n")
+	s := &Service{
+		Service: "grafana-server", Branch: "main", Control: "control", machine: newMachine(false),
+		RequireSigned: true, Signers: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFakeKeyForTesting test@example.org"},
+	}
+	s.control(gc)
+	if state, _ := s.State(); state != StateOK {
+		t.Errorf("expected unsigned control file to be ignored, got %s", state)
+	}
+}
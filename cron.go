@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is a parsed cron-style schedule: "minute hour day-of-month month day-of-week". Each field is a "*",
+// a number, a range "a-b", a step "*/n" or "a-b/n", or a comma separated list of those.
+type schedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool // True if the field was "*", needed to match the day like cron does.
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+// parseSchedule parses the cron-style schedule in spec.
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q: expected %d fields, got %d", spec, len(cronFields), len(fields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %s: %s", spec, cronFields[i].name, err)
+		}
+		bits[i] = b
+	}
+	return &schedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		anyDom: fields[2] == "*", anyDow: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(f string, min, max int) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", s)
+			}
+			part, step = r, n
+		}
+		lo, hi := min, max
+		if part != "*" {
+			a, b, isRange := strings.Cut(part, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", a)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value %q", b)
+				}
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+			}
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (sc *schedule) day(t time.Time) bool {
+	dom := sc.dom&(1<<uint(t.Day())) != 0
+	dow := sc.dow&(1<<uint(t.Weekday())) != 0
+	if sc.anyDom || sc.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t that matches the schedule, or the zero time if there is none within
+// five years.
+func (sc *schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case sc.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !sc.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case sc.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case sc.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2023, 3, 14, 10, 17, 30, 0, time.UTC) // a Tuesday
+	tests := []struct {
+		spec string
+		exp  time.Time
+	}{
+		{"* * * * *", time.Date(2023, 3, 14, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2023, 3, 14, 10, 30, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2023, 3, 14, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2023, 3, 15, 2, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2023, 3, 15, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2023, 3, 19, 0, 0, 0, 0, time.UTC)}, // day of month or day of week, like cron
+	}
+	for _, tc := range tests {
+		sc, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.spec, err)
+		}
+		if got := sc.next(from); !got.Equal(tc.exp) {
+			t.Errorf("%q: expected %s, got %s", tc.spec, tc.exp, got)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q: expected error, got none", spec)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+
+	"go.science.ru.nl/log"
+)
+
+// delegate reads the service definitions from the Delegate directory in the checkout of each service that has
+// one, and adds them to c. The directory only exists on the machines that run the delegating service, so delegated
+// services can't escape those: without a machine they get the machine (and labels) of the delegating service. They
+// are always checked out in the mount of the delegating service.
+// Delegated services may only set the fields in delegatedFields, see delegatedBy.
+func (c *Config) delegate() error {
+	services := c.Services
+	for _, s := range services {
+		if s.Delegate == "" {
+			continue
+		}
+		dir := path.Join(s.Mount, s.Service, s.Delegate)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // not checked out (yet)
+			}
+			return err
+		}
+		s.delegated = true
+
+		names := []string{}
+		for _, e := range entries {
+			if !e.IsDir() && isConfig(e.Name()) {
+				names = append(names, e.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			file := filepath.Join(dir, name)
+			f, err := readConfigFile(file)
+			if err != nil {
+				return err
+			}
+			if f.Global != nil || f.Bootstrap != nil || len(f.Include) > 0 || len(f.Groups) > 0 || len(f.Templates) > 0 || len(f.Upstreams) > 0 || f.Network != nil {
+				return fmt.Errorf("delegated config %q may only define services", file)
+			}
+			for _, d := range f.Services {
+				if err := d.delegatedBy(s); err != nil {
+					return fmt.Errorf("delegated service %q in %q %s", d.Service, file, err)
+				}
+				d.Mount = s.Mount
+				if d.Machine == "" && len(d.Labels) == 0 {
+					d.Machine, d.Labels, d.Exclude = s.Machine, s.Labels, s.Exclude
+				}
+				log.Infof("Machine %q, service %q delegates service %q", s.Machine, s.Service, d.Service)
+			}
+			c.Services = append(c.Services, f.Services...)
+		}
+	}
+	return nil
+}
+
+// delegatedFields are the fields a delegated service may set. The others run commands, use files or credentials of
+// the machine, or change how upstream is contacted, and may only be set in the config itself.
+var delegatedFields = []string{"Upstream", "Mirrors", "Branch", "Tag", "Commit", "Service", "Enabled", "Machine", "Labels", "Exclude", "Action", "Probe", "Dirs", "Priority", "Failures", "Notify", "Control", "ControlBranch", "Extends", "Interval", "Schedule"}
+
+// delegatedBy returns an error if the delegated service d sets a field that isn't in delegatedFields, has an
+// action that isn't a systemd action, a probe that isn't a URL, or a local directory that isn't in the
+// DelegateRoot of s.
+func (d *Service) delegatedBy(s *Service) error {
+	v := reflect.ValueOf(d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.IsExported() && !v.Field(i).IsZero() && !contains(delegatedFields, f.Name) {
+			return fmt.Errorf("can't set %s", strings.ToLower(f.Name))
+		}
+	}
+	if strings.Contains(d.Action, ":") {
+		return fmt.Errorf("can't have action %q, only systemd actions", d.Action)
+	}
+	if d.Probe != "" && !strings.HasPrefix(d.Probe, "http://") && !strings.HasPrefix(d.Probe, "https://") {
+		return fmt.Errorf("can't have probe %q, only URLs", d.Probe)
+	}
+	for _, dir := range d.Dirs {
+		if s.DelegateRoot == "" {
+			return fmt.Errorf("can't have dirs, service %q has no delegateroot", s.Service)
+		}
+		rel, err := filepath.Rel(s.DelegateRoot, filepath.Clean(dir.Local))
+		if err != nil || !filepath.IsAbs(dir.Local) || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("can't have local dir %q, it's not in %q", dir.Local, s.DelegateRoot)
+		}
+	}
+	return nil
+}
+
+// reloadDelegated asks for a reload when s delegates services, but they weren't read when the config was loaded
+// because s wasn't checked out yet.
+func (s *Service) reloadDelegated() {
+	if s.Delegate == "" || s.delegated {
+		return
+	}
+	log.Infof("Machine %q, service %q is checked out, reloading for its delegated services", s.Machine, s.Service)
+	select {
+	case signals <- syscall.SIGHUP:
+	default: // reload already pending
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+)
+
+// The TOML and JSON decoders would hand tables to an UnmarshalText method as well, so Dir implements the unmarshaler
+// of each format, these all take either the short form string or a table with local and link.
+
+// UnmarshalTOML implements unstable.Unmarshaler. Tables written as [[services.dirs]] do not end up here.
+func (d *Dir) UnmarshalTOML(n *unstable.Node) error {
+	switch n.Kind {
+	case unstable.String:
+		return d.short(string(n.Data))
+	case unstable.InlineTable:
+		m := map[string]string{}
+		it := n.Children()
+		for it.Next() {
+			kv := it.Node()
+			key := kv.Key()
+			key.Next()
+			if kv.Value().Kind != unstable.String {
+				return fmt.Errorf("dir field %q must be a string", key.Node().Data)
+			}
+			m[string(key.Node().Data)] = string(kv.Value().Data)
+		}
+		return d.fields(m)
+	}
+	return fmt.Errorf("dir must be a string or a table")
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Dir) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return d.short(n.Value)
+	}
+	m := map[string]string{}
+	if err := n.Decode(&m); err != nil {
+		return err
+	}
+	return d.fields(m)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Dir) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		return d.short(s)
+	}
+	m := map[string]string{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	return d.fields(m)
+}
+
+// short parses "<link>[:<local>]", local defaults to /<link>.
+func (d *Dir) short(s string) error {
+	link, local, _ := strings.Cut(s, ":")
+	if link == "" {
+		return fmt.Errorf("dir %q has empty link", s)
+	}
+	if local == "" {
+		local = "/" + strings.TrimPrefix(link, "/")
+	}
+	d.Link, d.Local = link, local
+	return nil
+}
+
+// fields sets d from the table m, unknown keys are an error.
+func (d *Dir) fields(m map[string]string) error {
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "local":
+			d.Local = v
+		case "link":
+			d.Link = v
+		default:
+			return fmt.Errorf("unknown dir field %q", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml/v2"
+	"go.science.ru.nl/log"
+)
+
+// downloadTimeout is how long downloading a binary may take.
+const downloadTimeout = 5 * time.Minute
+
+// manifest names a release binary and its checksum, it lives in the repository.
+//
+//	url = "https://example.org/releases/app-v1.2.3-linux-amd64"
+//	sha256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+type manifest struct {
+	URL    string `toml:"url"`
+	SHA256 string `toml:"sha256"`
+}
+
+func parseManifest(doc []byte) (m manifest, err error) {
+	t := toml.NewDecoder(bytes.NewReader(doc))
+	t.DisallowUnknownFields()
+	if err := t.Decode(&m); err != nil {
+		return m, err
+	}
+	if m.URL == "" {
+		return m, fmt.Errorf("manifest has empty url")
+	}
+	m.SHA256 = strings.ToLower(m.SHA256)
+	if b, err := hex.DecodeString(m.SHA256); err != nil || len(b) != sha256.Size {
+		return m, fmt.Errorf("manifest has invalid sha256 %q", m.SHA256)
+	}
+	return m, nil
+}
+
+// download downloads the binary named in the manifest of the service, verifies its checksum and installs it
+// in Install. If Install already has the right checksum nothing is done.
+func (s *Service) download() error {
+	doc, err := os.ReadFile(path.Join(s.Mount, s.Service, s.Manifest))
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %s", err)
+	}
+	m, err := parseManifest(doc)
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest: %s", err)
+	}
+	if sum, err := sha256File(s.Install); err == nil && sum == m.SHA256 {
+		return nil
+	}
+
+	log.Infof("Machine %q, service %q downloading %q", s.Machine, s.Service, m.URL)
+	c := http.Client{Timeout: downloadTimeout}
+	resp, err := c.Get(m.URL)
+	if err != nil {
+		return fmt.Errorf("failed to download %q: %s", m.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %q: %s", m.URL, resp.Status)
+	}
+
+	tmp := s.Install + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), resp.Body)
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != m.SHA256 {
+			err = fmt.Errorf("checksum mismatch for %q: expected %s, got %s", m.URL, m.SHA256, sum)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.Install); err != nil {
+		return fmt.Errorf("failed to install %q: %s", s.Install, err)
+	}
+	log.Infof("Machine %q, service %q installed %q with sha256 %s", s.Machine, s.Service, s.Install, m.SHA256)
+	return nil
+}
+
+func sha256File(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
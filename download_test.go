@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestParseManifest(t *testing.T) {
+	m, err := parseManifest([]byte(`url = "https://example.org/app"
+sha256 = "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SHA256 != "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" {
+		t.Errorf("expected lower case checksum, got %s", m.SHA256)
+	}
+
+	for _, doc := range []string{
+		`sha256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"`,
+		`url = "https://example.org/app"`,
+		`url = "https://example.org/app"` + "\n" + `sha256 = "9f86d0"`,
+		`url = "https://example.org/app"` + "\n" + `md5 = "d41d8cd98f00b204e9800998ecf8427e"`,
+	} {
+		if _, err := parseManifest([]byte(doc)); err == nil {
+			t.Errorf("expected error for %q", doc)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/gitopper/systemd"
+)
+
+// dropIn writes a systemd drop-in for the unit of this service, that sets GITOPPER_HASH and GITOPPER_APPLIED in
+// the unit's environment and reloads systemd. Note the environment is only picked up when the unit is (re)started.
+func (s *Service) dropIn() error {
+	s.RLock()
+	conf := fmt.Sprintf("[Service]\nEnvironment=GITOPPER_HASH=%s GITOPPER_APPLIED=%s\n", s.st.Hash, s.st.Applied.Format(time.RFC3339))
+	s.RUnlock()
+	return systemd.DropIn(s.Service, "gitopper", []byte(conf))
+}
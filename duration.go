@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string with a unit in the config, i.e. "30s" or "5m". A bare
+// number is an error, as its unit would be ambiguous.
+type Duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	t, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, it needs a unit, i.e. \"30s\" or \"5m\"", text)
+	}
+	*d = Duration(t)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) { return []byte(time.Duration(d).String()), nil }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// enrollClient talks to the hub.
+var enrollClient = &http.Client{Timeout: 30 * time.Second}
+
+// enrollment is what the hub returns for a host that presented a valid token. It fills in the bootstrap flags that
+// weren't given.
+type enrollment struct {
+	Upstream string `json:"upstream"`
+	Branch   string `json:"branch"`
+	Role     string `json:"role"`
+	Config   string `json:"config"`
+}
+
+// enrollRequest is sent to the hub, the host keys allow it to add us to the operators' known_hosts.
+type enrollRequest struct {
+	Hostname string   `json:"hostname"`
+	HostKeys []string `json:"hostkeys"`
+}
+
+// enroll presents the one-time token to the hub at url, together with our hostname and SSH host keys, and returns
+// our enrollment.
+func enroll(client *http.Client, url, token, hostname string, hostkeys []string) (enrollment, error) {
+	e := enrollment{}
+	if !strings.HasPrefix(url, "https://") {
+		return e, fmt.Errorf("enroll URL %q must be https", url)
+	}
+	body, err := json.Marshal(enrollRequest{Hostname: hostname, HostKeys: hostkeys})
+	if err != nil {
+		return e, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return e, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return e, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return e, fmt.Errorf("enroll at %q failed: %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&e); err != nil {
+		return e, fmt.Errorf("enroll at %q returned an invalid reply: %s", url, err)
+	}
+	if e.Upstream == "" || e.Role == "" {
+		return e, fmt.Errorf("enroll at %q returned no upstream or role", url)
+	}
+	return e, nil
+}
+
+// hostKeys returns the public SSH host keys of this host.
+func hostKeys() []string {
+	files, _ := filepath.Glob("/etc/ssh/ssh_host_*_key.pub")
+	keys := []string{}
+	for _, f := range files {
+		if key, err := os.ReadFile(f); err == nil {
+			keys = append(keys, strings.TrimSpace(string(key)))
+		}
+	}
+	return keys
+}
+
+// readToken returns the token, when token starts with @ it's read from the file named by the rest.
+func readToken(token string) (string, error) {
+	if !strings.HasPrefix(token, "@") {
+		return token, nil
+	}
+	buf, err := os.ReadFile(token[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
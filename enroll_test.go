@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEnroll(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := enrollRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("Authorization") != "Bearer secret" || req.Hostname != "web-1" || len(req.HostKeys) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(enrollment{Upstream: "https://github.com/miekg/blah-origin", Role: "web-1.atoom.net"})
+	}))
+	defer srv.Close()
+
+	e, err := enroll(srv.Client(), srv.URL, "secret", "web-1", []string{"ssh-ed25519 AAAA root@web-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Role != "web-1.atoom.net" {
+		t.Errorf("expected role %q, got %q", "web-1.atoom.net", e.Role)
+	}
+	if _, err := enroll(srv.Client(), srv.URL, "spent", "web-1", []string{"ssh-ed25519 AAAA root@web-1"}); err == nil {
+		t.Errorf("expected error for invalid token")
+	}
+	if _, err := enroll(srv.Client(), "http://hub.example.org", "secret", "web-1", nil); err == nil {
+		t.Errorf("expected error for plain HTTP")
+	}
+}
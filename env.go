@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"sort"
+)
+
+// envs returns the Env of s as key=value, sorted on key.
+func (s *Service) envs() []string {
+	env := make([]string, 0, len(s.Env))
+	for k, v := range s.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// environ returns the environment for the commands run for s: our own environment with Env added.
+func (s *Service) environ() []string { return append(os.Environ(), s.envs()...) }
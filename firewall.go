@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"go.science.ru.nl/log"
+)
+
+// Actions that apply a firewall ruleset from the repository instead of running systemctl.
+const (
+	nftPrefix      = "nft:"
+	iptablesPrefix = "iptables:"
+)
+
+// firewall knows how to validate, save and restore the ruleset of a firewall.
+type firewall struct {
+	name    string
+	check   []string // Validates the ruleset given on standard input.
+	save    []string // Prints the current ruleset.
+	restore []string // Applies the ruleset given on standard input, atomically.
+}
+
+var (
+	nft = firewall{
+		name:    "nftables",
+		check:   []string{"nft", "-c", "-f", "-"},
+		save:    []string{"nft", "list", "ruleset"},
+		restore: []string{"nft", "-f", "-"},
+	}
+	iptables = firewall{
+		name:    "iptables",
+		check:   []string{"iptables-restore", "--test"},
+		save:    []string{"iptables-save"},
+		restore: []string{"iptables-restore"},
+	}
+)
+
+// firewallAction returns the firewall and ruleset of action, or false if action isn't a firewall action.
+func firewallAction(action string) (firewall, string, bool) {
+	if strings.HasPrefix(action, nftPrefix) {
+		return nft, strings.TrimPrefix(action, nftPrefix), true
+	}
+	if strings.HasPrefix(action, iptablesPrefix) {
+		return iptables, strings.TrimPrefix(action, iptablesPrefix), true
+	}
+	return firewall{}, "", false
+}
+
+// firewall validates the ruleset, which is relative to the checkout, saves the current ruleset and applies the
+// new one. If applying fails the saved ruleset is restored.
+func (s *Service) firewall(fw firewall, ruleset string) error {
+	if !path.IsAbs(ruleset) {
+		ruleset = path.Join(s.Mount, s.Service, ruleset)
+	}
+	rules, err := os.ReadFile(ruleset)
+	if err != nil {
+		return fmt.Errorf("failed to read %s ruleset: %s", fw.name, err)
+	}
+	if out, err := fwRun(fw.check, rules, s.environ()); err != nil {
+		return fmt.Errorf("%s ruleset %q is invalid: %s: %s", fw.name, ruleset, err, out)
+	}
+	saved, err := fwRun(fw.save, nil, s.environ())
+	if err != nil {
+		return fmt.Errorf("failed to save %s ruleset: %s", fw.name, err)
+	}
+	if fw.name == nft.name {
+		// nft adds to the ruleset, the saved one must replace whatever is partially applied.
+		saved = append([]byte("flush ruleset\n"), saved...)
+	}
+	out, err := fwRun(fw.restore, rules, s.environ())
+	if err == nil {
+		log.Infof("Machine %q, service %q applied %s ruleset %q", s.Machine, s.Service, fw.name, ruleset)
+		return nil
+	}
+	log.Warningf("Machine %q, service %q failed to apply %s ruleset %q, rolling back: %s", s.Machine, s.Service, fw.name, ruleset, err)
+	if out1, err1 := fwRun(fw.restore, saved, s.environ()); err1 != nil {
+		return fmt.Errorf("failed to apply %s ruleset: %s: %s, and failed to roll back: %s: %s", fw.name, err, out, err1, out1)
+	}
+	return fmt.Errorf("failed to apply %s ruleset, rolled back: %s: %s", fw.name, err, out)
+}
+
+func fwRun(args []string, stdin []byte, env []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = env
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	log.Infof("running %v", cmd.Args)
+	if stdin == nil {
+		return cmd.Output()
+	}
+	out, err := cmd.CombinedOutput()
+	return bytes.TrimSpace(out), err
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package gitcmd
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/miekg/gitopper/osutil"
+)
+
+// credential makes cmd run as user.
+func credential(cmd *exec.Cmd, user string) {
+	uid, gid := osutil.User(user)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+}
+
+// chown makes user the owner of everything in dir, go-git writes the checkout as the user gitopper runs as.
+func chown(dir, user string) error {
+	if user == "" {
+		return nil
+	}
+	uid, gid := osutil.User(user)
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(uid), int(gid))
+	})
+}
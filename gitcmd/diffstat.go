@@ -42,3 +42,22 @@ func (g *Git) OfInterest(data []byte) bool {
 	}
 	return false
 }
+
+// Summary returns a short summary of the changes between from and to in the directories we care about: the
+// number of files changed, insertions and deletions, and the subjects of (at most 10) commits.
+func (g *Git) Summary(from, to string) (string, error) {
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	args := append([]string{"diff", "--shortstat", from, to, "--"}, g.dirs...)
+	stat, err := g.run(args...)
+	if err != nil {
+		return "", err
+	}
+	args = append([]string{"log", "-n", "10", "--format=%h %s", from + ".." + to, "--"}, g.dirs...)
+	subjects, err := g.run(args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(stat)) + "\n" + strings.TrimSpace(string(subjects)), nil
+}
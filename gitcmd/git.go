@@ -4,13 +4,16 @@ package gitcmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
-	"syscall"
+	"time"
 
-	"github.com/miekg/gitopper/osutil"
+	"github.com/miekg/gitopper/sandbox"
 	"go.science.ru.nl/log"
 )
 
@@ -20,6 +23,20 @@ type Git struct {
 	mount    string
 	dirs     []string
 	user     string
+	depth    int
+	filter   string
+	subs     bool
+	tag      string
+	pin      string
+	config   []string // Extra git config key value pairs for the next commands, see Verify.
+	secret   func() (string, error)
+	identity string
+	helper   string
+	observe  func(network bool, d time.Duration)
+	guard    func(host string) error
+	proxy    string
+	env      []string
+	gogit    bool
 
 	cwd string
 }
@@ -33,24 +50,26 @@ func New(upstream, branch, mount, user string, dirs []string) *Git {
 		dirs:     dirs,
 		user:     user,
 		branch:   branch,
+		filter:   "blob:none",
 	}
 	return g
 }
 
 func (g *Git) run(args ...string) ([]byte, error) {
-	ctx := context.TODO()
-	cmd := exec.CommandContext(ctx, "git", args...)
-	cmd.Dir = g.cwd
-	cmd.Env = []string{"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null"}
-	if g.user != "" {
-		uid, gid := osutil.User(g.user)
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
-		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if g.guard != nil && isNetwork(args) {
+		if host := Host(g.upstream); host != "" {
+			if err := g.guard(host); err != nil {
+				metricGitFail.Inc()
+				return nil, err
+			}
+		}
 	}
-
-	log.Infof("running in %q as %q %v", cmd.Dir, g.user, cmd.Args)
-
+	cmd := g.command(context.TODO(), args...)
+	start := time.Now()
 	out, err := cmd.CombinedOutput()
+	if g.observe != nil {
+		g.observe(isNetwork(args), time.Since(start))
+	}
 	if len(out) > 0 {
 		log.Debug(string(out))
 	}
@@ -62,6 +81,32 @@ func (g *Git) run(args ...string) ([]byte, error) {
 	return out, err
 }
 
+// command returns the git command with args, to be run in g.cwd as g.user.
+func (g *Git) command(ctx context.Context, args ...string) *exec.Cmd {
+	// git may only write in the parent of the checkout, as clone creates the checkout itself.
+	cmd := sandbox.Command(ctx, sandbox.Options{Writable: []string{path.Dir(g.mount)}, Network: true}, "git", args...)
+	cmd.Dir = g.cwd
+	// Without a terminal git would hang asking for credentials it wasn't given.
+	cmd.Env = append([]string{"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null", "GIT_TERMINAL_PROMPT=0"}, g.env...)
+	if g.user != "" {
+		credential(cmd, g.user)
+	}
+	cfg := append([]string{}, g.config...)
+	if g.proxy != "" {
+		cfg = append(cfg, "http.proxy", g.proxy)
+	}
+	cfg = g.auth(cmd, cfg)
+	if len(cfg) > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(cfg)/2))
+		for i := 0; i < len(cfg); i += 2 {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i/2, cfg[i]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i/2, cfg[i+1]))
+		}
+	}
+
+	log.Infof("running in %q as %q %v", cmd.Dir, g.user, cmd.Args)
+	return cmd
+}
+
 // IsCheckedOut will check g.mount and if it has an .git sub directory we assume the checkout has been done.
 func (g *Git) IsCheckedOut() bool {
 	info, err := os.Stat(path.Join(g.mount, ".git"))
@@ -77,40 +122,249 @@ func (g *Git) Checkout() error {
 	if g.IsCheckedOut() {
 		return nil
 	}
+	if g.gogit {
+		return g.goCheckout()
+	}
 
 	g.cwd = ""
-	_, err := g.run("clone", "-b", g.branch, "--filter=blob:none", "--no-checkout", "--sparse", g.upstream, g.mount)
+	args := []string{"clone", "-b", g.branch, "--no-checkout", "--sparse"}
+	if g.filter != "" {
+		args = append(args, "--filter="+g.filter)
+	}
+	if g.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(g.depth))
+	}
+	_, err := g.run(append(args, g.upstream, g.mount)...)
 	if err != nil {
 		return err
 	}
 
 	g.cwd = g.mount
 	defer func() { g.cwd = "" }()
-	args := []string{"sparse-checkout", "set"}
+	args = []string{"sparse-checkout", "set"}
 	args = append(args, g.dirs...)
 	_, err = g.run(args...)
 	if err != nil {
 		return err
 	}
 
-	_, err = g.run("checkout")
+	if _, err = g.run("checkout"); err != nil {
+		return err
+	}
+	return g.submodules()
+}
+
+// Guard sets the function that is called with the host of upstream before git contacts it. If it returns an
+// error the git command isn't run.
+func (g *Git) Guard(fn func(host string) error) { g.guard = fn }
+
+// Observe sets the function that is called with the duration of every git command, network is true if the command
+// contacted upstream.
+func (g *Git) Observe(fn func(network bool, d time.Duration)) { g.observe = fn }
+
+// Env sets extra environment variables (key=value) for git.
+func (g *Git) Env(env []string) { g.env = env }
+
+// Proxy makes git use the HTTP(S) proxy at url.
+func (g *Git) Proxy(url string) { g.proxy = url }
+
+// Depth makes Checkout do a shallow clone, with only the latest n commits. Zero clones all history.
+func (g *Git) Depth(n int) { g.depth = n }
+
+// Filter sets the partial clone filter Checkout uses, it defaults to blob:none, the empty string clones without
+// a filter.
+func (g *Git) Filter(spec string) { g.filter = spec }
+
+// Submodules makes Checkout, Pull and Rollback also check out the submodules in the sparse directories.
+func (g *Git) Submodules() { g.subs = true }
+
+// submodules checks out the submodules in the sparse directories, recursively, if enabled.
+func (g *Git) submodules() error {
+	if !g.subs {
+		return nil
+	}
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+	_, err := g.run(append([]string{"submodule", "update", "--init", "--recursive", "--"}, g.dirs...)...)
 	return err
 }
 
-// Pull pulls from upstream. If the returned bool is true there were updates.
-func (g *Git) Pull() (bool, error) {
+// Track makes Remote, Fetch and Pull follow tag instead of the branch, Pull checks the tag out on a detached HEAD.
+func (g *Git) Track(tag string) { g.tag = tag }
+
+// Pin makes Remote, Fetch and Pull use commit hash instead of following the branch or tag: Fetch fetches the commit
+// if needed and Pull checks it out on a detached HEAD.
+func (g *Git) Pin(hash string) { g.pin = hash }
+
+// ref returns the ref we follow upstream: the tag set with Track or the branch.
+func (g *Git) ref() string {
+	if g.tag != "" {
+		return "refs/tags/" + g.tag
+	}
+	return "refs/heads/" + g.branch
+}
+
+// Remote returns the hash of the tracked branch (or the commit of the tracked tag) upstream, without fetching
+// anything.
+func (g *Git) Remote() (string, error) {
+	if g.pin != "" {
+		return g.pin, nil
+	}
+	if g.gogit {
+		return g.goRemote()
+	}
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	out, err := g.run("ls-remote", "origin", g.ref(), g.ref()+"^{}")
+	if err != nil {
+		return "", err
+	}
+	// An annotated tag is listed twice, the peeled one (^{}) is the commit and comes last.
+	hash := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			hash = fields[0]
+		}
+	}
+	switch {
+	case hash == "" && g.tag != "":
+		return "", fmt.Errorf("tag %q not found upstream", g.tag)
+	case hash == "":
+		return "", fmt.Errorf("branch %q not found upstream", g.branch)
+	}
+	return hash, nil
+}
+
+// Tags returns the names of the tags upstream, without fetching anything.
+func (g *Git) Tags() ([]string, error) {
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	out, err := g.run("ls-remote", "--tags", "--refs", "origin")
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && strings.HasPrefix(fields[1], "refs/tags/") {
+			tags = append(tags, strings.TrimPrefix(fields[1], "refs/tags/"))
+		}
+	}
+	return tags, nil
+}
+
+// Strategy determines how Pull advances the checkout to upstream.
+type Strategy string
+
+const (
+	FastForward Strategy = "ff-only" // Only fast-forward, this is the default.
+	Rebase      Strategy = "rebase"  // Rebase local commits onto upstream.
+	Reset       Strategy = "reset"   // Hard reset to upstream, local changes are lost.
+)
+
+// ErrNotFastForward is returned by Pull when upstream is not a descendant of HEAD and the strategy is FastForward.
+var ErrNotFastForward = errors.New("upstream is not a descendant of HEAD")
+
+// Pull pulls from upstream using strategy. If the returned bool is true there were updates. When a commit is pinned
+// or a tag is tracked it is fetched and checked out, strategy is then ignored as these don't need to descend from
+// each other. If hash is not empty it must have been fetched already (see Fetch), the checkout is then advanced to
+// exactly that commit and upstream isn't contacted, so what was verified is what is deployed.
+func (g *Git) Pull(strategy Strategy, hash string) (bool, error) {
+	if g.gogit {
+		return g.goPull(strategy, hash)
+	}
+	if g.pin != "" || g.tag != "" {
+		return g.detach(hash)
+	}
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	target := hash
+	if target == "" && strategy != Rebase {
+		if _, err := g.run("fetch", "origin", g.branch); err != nil {
+			return false, err
+		}
+		target = "FETCH_HEAD"
+	}
+
+	var (
+		out []byte
+		err error
+	)
+	switch strategy {
+	case "", FastForward:
+		if _, err = g.run("merge-base", "--is-ancestor", "HEAD", target); err != nil {
+			if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+				return false, ErrNotFastForward
+			}
+			return false, err
+		}
+		out, err = g.run("merge", "--ff-only", "--stat", target)
+
+	case Rebase:
+		if target == "" {
+			out, err = g.run("pull", "--rebase", "--stat", "origin", g.branch)
+			break
+		}
+		out, err = g.run("rebase", "--stat", target)
+
+	case Reset:
+		if out, err = g.run("diff", "--stat", "HEAD", target); err != nil {
+			return false, err
+		}
+		_, err = g.run("reset", "--hard", target)
+
+	default:
+		return false, fmt.Errorf("unknown strategy: %q", strategy)
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := g.submodules(); err != nil {
+		return false, err
+	}
+	return g.OfInterest(out), nil
+}
+
+// detach fetches the pinned commit or the tracked tag and checks it out on a detached HEAD. If hash is not empty
+// that (already fetched) commit is checked out instead.
+func (g *Git) detach(hash string) (bool, error) {
+	target := hash
+	if target == "" && g.pin != "" {
+		full, err := g.Resolve(g.pin)
+		if err != nil {
+			return false, err
+		}
+		target = full
+	}
 	g.cwd = g.mount
 	defer func() { g.cwd = "" }()
 
-	out, err := g.run("pull", "--stat", "origin", g.branch)
+	if target == "" {
+		if _, err := g.run("fetch", "origin", "+"+g.ref()+":"+g.ref()); err != nil {
+			return false, err
+		}
+		target = g.ref() + "^{commit}"
+	}
+	out, err := g.run("diff", "--stat", "HEAD", target)
 	if err != nil {
 		return false, err
 	}
+	if _, err := g.run("checkout", "--detach", target); err != nil {
+		return false, err
+	}
+	if err := g.submodules(); err != nil {
+		return false, err
+	}
 	return g.OfInterest(out), nil
 }
 
 // Hash returns the git hash of HEAD in the repo in g.mount. Empty string is returned in case of an error.
 func (g *Git) Hash() string {
+	if g.gogit {
+		return g.goHash()
+	}
 	g.cwd = g.mount
 	defer func() { g.cwd = "" }()
 
@@ -121,12 +375,227 @@ func (g *Git) Hash() string {
 	return strings.TrimSpace(string(out))
 }
 
+// Time returns the commit time of HEAD in the repo in g.mount. The zero time is returned in case of an error.
+func (g *Git) Time() time.Time {
+	if g.gogit {
+		return g.goTime()
+	}
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	out, err := g.run("log", "-1", "--format=%ct")
+	if err != nil {
+		return time.Time{}
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+
+// Show fetches branch from upstream and returns the contents of file in it and the hash of the commit it was read
+// from, the checkout itself isn't changed.
+func (g *Git) Show(branch, file string) (data []byte, hash string, err error) {
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	if _, err := g.run("fetch", "origin", branch); err != nil {
+		return nil, "", err
+	}
+	out, err := g.run("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	hash = strings.TrimSpace(string(out))
+	data, err = g.run("show", hash+":"+file)
+	return data, hash, err
+}
+
+// Fetch fetches the tracked branch (or tag, or pinned commit) from upstream and returns the hash of the commit
+// fetched, the checkout itself isn't changed.
+func (g *Git) Fetch() (string, error) {
+	if g.pin != "" {
+		return g.Resolve(g.pin)
+	}
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	refspec := g.ref()
+	if g.tag != "" {
+		refspec = "+" + g.ref() + ":" + g.ref() // keep the tag, Verify needs it
+	}
+	if _, err := g.run("fetch", "origin", refspec); err != nil {
+		return "", err
+	}
+	out, err := g.run("rev-parse", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Commit returns the author of commit hash and the paths that changed between HEAD and hash, limited to the
+// directories we care about.
+func (g *Git) Commit(hash string) (author string, paths []string, err error) {
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	out, err := g.run("log", "-1", "--format=%an <%ae>", hash)
+	if err != nil {
+		return "", nil, err
+	}
+	author = strings.TrimSpace(string(out))
+
+	args := append([]string{"diff", "--name-only", "HEAD", hash, "--"}, g.dirs...)
+	if out, err = g.run(args...); err != nil {
+		return "", nil, err
+	}
+	return author, strings.Fields(string(out)), nil
+}
+
+// Signer returns the signer of commit hash, it is empty when the commit isn't signed or the signature can't be
+// verified.
+func (g *Git) Signer(hash string) (string, error) {
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	out, err := g.run("log", "-1", "--format=%G?%n%GS", hash)
+	if err != nil {
+		return "", err
+	}
+	status, signer, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if status != "G" && status != "U" {
+		return "", nil
+	}
+	return signer, nil
+}
+
+// Diff returns the files, relative to the repository, that were added or modified between commit from and to.
+// Only files in the sparse directories are considered.
+func (g *Git) Diff(from, to string) ([]string, error) {
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	args := append([]string{"diff", "--name-only", "--diff-filter=d", from, to, "--"}, g.dirs...)
+	out, err := g.run(args...)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Changed returns true if file differs between commit from and to.
+func (g *Git) Changed(from, to, file string) (bool, error) {
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	_, err := g.run("diff", "--quiet", from, to, "--", file)
+	if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+		return true, nil
+	}
+	return false, err
+}
+
+// Prune removes remote-tracking refs that no longer exist upstream and deletes the local branches that tracked
+// them. The checked out branch is never deleted.
+func (g *Git) Prune() error {
+	if g.gogit {
+		return nil // go-git only fetches the tracked branch, there is nothing to prune.
+	}
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	if _, err := g.run("remote", "prune", "origin"); err != nil {
+		return err
+	}
+	out, err := g.run("for-each-ref", "--format=%(HEAD) %(refname:short) %(upstream:track)", "refs/heads")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		// "  <branch> [gone]", the current branch starts with a "*".
+		if len(fields) != 2 || fields[1] != "[gone]" {
+			continue
+		}
+		if _, err := g.run("branch", "-D", fields[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrUnknownCommit is returned by Resolve when the commit isn't found, not even upstream.
+var ErrUnknownCommit = errors.New("unknown commit")
+
+// Resolve returns the full hash of the commit rev points to. Rev is anything git understands: an abbreviated hash,
+// a tag, a branch or a relative ref like HEAD~1, which is resolved against the checkout. If the commit isn't in the
+// repository the tracked branch and the tags are fetched, and if rev is a full hash the commit itself is fetched as
+// well.
+func (g *Git) Resolve(rev string) (string, error) {
+	if strings.HasPrefix(rev, "-") || strings.ContainsAny(rev, " \t\n\x00") {
+		return "", fmt.Errorf("%w: invalid revision %q", ErrUnknownCommit, rev)
+	}
+	if g.gogit {
+		return g.goResolve(rev)
+	}
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	verify := func() (string, bool) {
+		out, err := g.run("rev-parse", "--verify", "--quiet", rev+"^{commit}")
+		return strings.TrimSpace(string(out)), err == nil
+	}
+	if full, ok := verify(); ok {
+		return full, nil
+	}
+	if _, err := g.run("fetch", "--tags", "origin", g.branch); err != nil {
+		return "", err
+	}
+	if full, ok := verify(); ok {
+		return full, nil
+	}
+	// Older than a shallow clone, or not on the branch: upstream may still hand it out by its full hash.
+	if len(rev) == 40 && strings.Trim(rev, "0123456789abcdef") == "" {
+		if _, err := g.run("fetch", "origin", rev); err == nil {
+			if full, ok := verify(); ok {
+				return full, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownCommit, rev)
+}
+
 // Rollback checks out commit <hash>, and return nil if no errors are encountered.
 func (g *Git) Rollback(hash string) error {
+	if g.gogit {
+		return g.goRollback(hash)
+	}
 	g.cwd = g.mount
 	defer func() { g.cwd = "" }()
-	_, err := g.run("checkout", hash)
-	return err
+	if _, err := g.run("checkout", hash); err != nil {
+		return err
+	}
+	return g.submodules()
 }
 
 func (g *Git) Repo() string { return g.mount }
+
+// Upstream returns the upstream g uses.
+func (g *Git) Upstream() string { return g.upstream }
+
+// Switch makes g use upstream from now on, i.e. a mirror, the origin remote of the checkout is pointed to it.
+func (g *Git) Switch(upstream string) error {
+	g.upstream = upstream
+	if !g.IsCheckedOut() {
+		return nil
+	}
+	if g.gogit {
+		return g.goSwitch()
+	}
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+	_, err := g.run("remote", "set-url", "origin", upstream)
+	return err
+}
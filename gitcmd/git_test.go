@@ -1,7 +1,13 @@
 package gitcmd
 
 import (
+	"archive/tar"
+	"bytes"
 	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"go.science.ru.nl/log"
@@ -69,3 +75,184 @@ Fast-forward
 		t.Fatal("Expected to find _no_ paths of interest, but got some")
 	}
 }
+
+func TestSummary(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	repo := t.TempDir()
+	git(repo, "init", "-b", "main")
+	os.MkdirAll(filepath.Join(repo, "etc"), 0755)
+	os.WriteFile(filepath.Join(repo, "etc/a.conf"), []byte("a\n"), 0644)
+	os.WriteFile(filepath.Join(repo, "README"), []byte("a\n"), 0644)
+	git(repo, "add", ".")
+	git(repo, "commit", "-m", "initial")
+	from := git(repo, "rev-parse", "HEAD")
+	os.WriteFile(filepath.Join(repo, "etc/a.conf"), []byte("b\nc\n"), 0644)
+	git(repo, "commit", "-am", "update a.conf")
+	os.WriteFile(filepath.Join(repo, "README"), []byte("b\n"), 0644)
+	git(repo, "commit", "-am", "update README")
+	to := git(repo, "rev-parse", "HEAD")
+
+	g := New("", "", repo, "", []string{"etc"})
+	summary, err := g.Summary(from, to)
+	if err != nil {
+		t.Fatalf("Failed to get summary: %s", err)
+	}
+	exp := "1 file changed, 2 insertions(+), 1 deletion(-)\n" + git(repo, "rev-parse", "--short", "HEAD~1") + " update a.conf"
+	if summary != exp {
+		t.Errorf("Expected summary %q, got %q", exp, summary)
+	}
+}
+
+func TestUntar(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "etc/nginx.conf", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	dir := t.TempDir()
+	if err := untar(buf, dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "etc/nginx.conf")); err != nil || string(data) != "hello" {
+		t.Errorf("expected %q, got %q: %v", "hello", data, err)
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+	if err := untar(buf, dir); err == nil {
+		t.Errorf("expected error for path outside of dir, got nil")
+	}
+}
+
+func TestIsSSH(t *testing.T) {
+	tests := map[string]bool{
+		"ssh://git@github.com/miekg/gitopper":      true,
+		"git@github.com:miekg/gitopper.git":        true,
+		"https://github.com/miekg/gitopper":        false,
+		"https://user@github.com/miekg/gitopper":   false,
+		"/var/lib/bundles/gitopper.bundle":         false,
+		"sftp::user@example.org:/srv/gitopper.git": false,
+	}
+	for upstream, exp := range tests {
+		if got := IsSSH(upstream); got != exp {
+			t.Errorf("%q: expected %t, got %t", upstream, exp, got)
+		}
+	}
+}
+
+func TestHost(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/miekg/gitopper":      "github.com",
+		"https://user@github.com:8443/miekg/x":   "github.com",
+		"ssh://git@[2001:db8::1]:22/miekg/x":     "2001:db8::1",
+		"git@github.com:miekg/gitopper.git":      "github.com",
+		"/var/lib/bundles/gitopper.bundle":       "",
+		"file:///srv/git/gitopper":               "",
+		`C:\bundles\gitopper.bundle`:             "",
+		"sftp::https://git.example.org/gitopper": "git.example.org",
+		"./relative/path:with-colon":             "",
+	}
+	for upstream, exp := range tests {
+		if got := Host(upstream); got != exp {
+			t.Errorf("%q: expected %q, got %q", upstream, exp, got)
+		}
+	}
+}
+
+func TestSubmodules(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "protocol.file.allow=always", "-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+	}
+	sub, upstream := t.TempDir(), t.TempDir()
+	git(sub, "init", "-b", "main")
+	os.WriteFile(filepath.Join(sub, "snippet.conf"), []byte("a"), 0644)
+	git(sub, "add", ".")
+	git(sub, "commit", "-m", "snippet")
+	git(upstream, "init", "-b", "main")
+	git(upstream, "submodule", "add", sub, "etc/shared")
+	git(upstream, "commit", "-m", "submodule")
+
+	mount := filepath.Join(t.TempDir(), "checkout")
+	g := New(upstream, "main", mount, "", []string{"etc"})
+	g.config = []string{"protocol.file.allow", "always"}
+	g.Submodules()
+	if err := g.Checkout(); err != nil {
+		t.Fatalf("failed to checkout: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(mount, "etc/shared/snippet.conf")); err != nil {
+		t.Errorf("expected submodule to be checked out: %s", err)
+	}
+
+	os.WriteFile(filepath.Join(sub, "snippet.conf"), []byte("b"), 0644)
+	git(sub, "commit", "-am", "snippet")
+	git(filepath.Join(upstream, "etc/shared"), "pull", "origin", "main")
+	git(upstream, "commit", "-am", "bump")
+	if changed, err := g.Pull(FastForward, ""); err != nil || !changed {
+		t.Fatalf("expected changes of interest, got %t: %v", changed, err)
+	}
+	if buf, _ := os.ReadFile(filepath.Join(mount, "etc/shared/snippet.conf")); string(buf) != "b" {
+		t.Errorf("expected submodule to be updated, got %q", buf)
+	}
+}
+
+func TestPullHash(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	upstream := t.TempDir()
+	git(upstream, "init", "-b", "main")
+	os.MkdirAll(filepath.Join(upstream, "etc"), 0755)
+	os.WriteFile(filepath.Join(upstream, "etc/a.conf"), []byte("a"), 0644)
+	git(upstream, "add", ".")
+	git(upstream, "commit", "-m", "a")
+
+	g := New(upstream, "main", filepath.Join(t.TempDir(), "checkout"), "", []string{"etc"})
+	if err := g.Checkout(); err != nil {
+		t.Fatalf("failed to checkout: %s", err)
+	}
+
+	os.WriteFile(filepath.Join(upstream, "etc/a.conf"), []byte("b"), 0644)
+	git(upstream, "commit", "-am", "b")
+	hash, err := g.Fetch()
+	if err != nil {
+		t.Fatalf("failed to fetch: %s", err)
+	}
+	if exp := git(upstream, "rev-parse", "HEAD"); hash != exp {
+		t.Fatalf("expected fetched %s, got %s", exp, hash)
+	}
+	// this commit is pushed after the fetch, it must not be deployed
+	os.WriteFile(filepath.Join(upstream, "etc/a.conf"), []byte("c"), 0644)
+	git(upstream, "commit", "-am", "c")
+
+	if changed, err := g.Pull(FastForward, hash); err != nil || !changed {
+		t.Fatalf("expected changes of interest, got %t: %v", changed, err)
+	}
+	if got := g.Hash(); got != hash {
+		t.Errorf("expected HEAD to be %s, got %s", hash, got)
+	}
+}
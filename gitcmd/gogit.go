@@ -0,0 +1,370 @@
+package gitcmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"go.science.ru.nl/log"
+)
+
+// go-git's file transport runs git-upload-pack, serve local upstreams in-process so we don't need git at all.
+func init() { client.InstallProtocol("file", server.NewServer(loader{})) }
+
+// loader loads local repositories, both bare ones and those with a worktree.
+type loader struct{}
+
+func (loader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	s, err := server.DefaultLoader.Load(ep)
+	if err == transport.ErrRepositoryNotFound {
+		ep1 := *ep
+		ep1.Path = path.Join(ep.Path, ".git")
+		return server.DefaultLoader.Load(&ep1)
+	}
+	return s, err
+}
+
+// GoGit makes Checkout, Pull, Hash, Time, Remote and Rollback use go-git instead of the git binary, so these work
+// on hosts without git. The other methods still run git. go-git doesn't do partial clones, the filter is ignored.
+func (g *Git) GoGit() { g.gogit = true }
+
+// counted counts the go-git operation that returned err in the metrics.
+func counted(err error) error {
+	metricGitOps.Inc()
+	if err != nil {
+		metricGitFail.Inc()
+	}
+	return err
+}
+
+// goGuard calls the guard, if any, with the host of upstream.
+func (g *Git) goGuard() error {
+	if g.guard == nil {
+		return nil
+	}
+	if host := Host(g.upstream); host != "" {
+		return g.guard(host)
+	}
+	return nil
+}
+
+// goAuth returns the go-git auth method for the secret.
+func (g *Git) goAuth() (transport.AuthMethod, error) {
+	if g.identity != "" && IsSSH(g.upstream) {
+		return ssh.NewPublicKeysFromFile(sshUser(g.upstream), g.identity, "")
+	}
+	if g.secret == nil {
+		return nil, nil
+	}
+	secret, err := g.secret()
+	if err != nil {
+		return nil, err
+	}
+	if IsSSH(g.upstream) {
+		return ssh.NewPublicKeysFromFile(sshUser(g.upstream), secret, "")
+	}
+	user, password, ok := strings.Cut(secret, ":")
+	if !ok {
+		user, password = "gitopper", secret // the user is ignored for tokens
+	}
+	return &http.BasicAuth{Username: user, Password: password}, nil
+}
+
+// sshUser returns the user in the SSH URL upstream, defaulting to git.
+func sshUser(upstream string) string {
+	u := strings.TrimPrefix(upstream, "ssh://")
+	if at := strings.Index(u, "@"); at > 0 && !strings.ContainsAny(u[:at], "/:") {
+		return u[:at]
+	}
+	return "git"
+}
+
+func (g *Git) goCheckout() error {
+	if err := g.goGuard(); err != nil {
+		return counted(err)
+	}
+	auth, err := g.goAuth()
+	if err != nil {
+		return counted(err)
+	}
+	branch := plumbing.NewBranchReferenceName(g.branch)
+	opts := &git.CloneOptions{
+		URL:           g.upstream,
+		Auth:          auth,
+		ReferenceName: branch,
+		SingleBranch:  true,
+		NoCheckout:    true,
+		ProxyOptions:  transport.ProxyOptions{URL: g.proxy},
+	}
+	opts.Depth = g.depth
+	log.Infof("cloning %q into %q with go-git", g.upstream, g.mount)
+	r, err := git.PlainClone(g.mount, false, opts)
+	if err != nil {
+		return counted(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return counted(err)
+	}
+	if err := w.Checkout(&git.CheckoutOptions{Branch: branch}); err != nil {
+		return counted(err)
+	}
+	return counted(g.goSparse(r))
+}
+
+func (g *Git) goPull(strategy Strategy, hash string) (bool, error) {
+	if strategy == Rebase {
+		return false, errors.New("strategy rebase isn't supported with go-git")
+	}
+	r, err := git.PlainOpen(g.mount)
+	if err != nil {
+		return false, counted(err)
+	}
+	target := plumbing.NewHash(hash)
+	if hash == "" {
+		remote, err := g.goFetch(r, git.TagFollowing)
+		if err != nil {
+			return false, counted(err)
+		}
+		ref, err := r.Reference(remote, true)
+		if err != nil {
+			return false, counted(err)
+		}
+		target = ref.Hash()
+	}
+	head, err := r.Head()
+	if err != nil {
+		return false, counted(err)
+	}
+	if target == head.Hash() {
+		return false, counted(nil)
+	}
+	from, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return false, counted(err)
+	}
+	to, err := r.CommitObject(target)
+	if err != nil {
+		return false, counted(err)
+	}
+	if strategy == "" || strategy == FastForward {
+		ok, err := from.IsAncestor(to)
+		if err != nil {
+			return false, counted(err)
+		}
+		if !ok {
+			return false, ErrNotFastForward
+		}
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return false, counted(err)
+	}
+	log.Infof("resetting %q to %s with go-git", g.mount, to.Hash)
+	if err := w.ResetSparsely(&git.ResetOptions{Commit: to.Hash, Mode: git.HardReset}, g.dirs); err != nil {
+		return false, counted(err)
+	}
+	if err := g.goSparse(r); err != nil {
+		return false, counted(err)
+	}
+	changed, err := g.goChanged(from, to)
+	return changed, counted(err)
+}
+
+// goFetch fetches the tracked branch into its remote-tracking ref, which is returned, and the tags as per tags.
+func (g *Git) goFetch(r *git.Repository, tags git.TagMode) (plumbing.ReferenceName, error) {
+	if err := g.goGuard(); err != nil {
+		return "", err
+	}
+	auth, err := g.goAuth()
+	if err != nil {
+		return "", err
+	}
+	remote := plumbing.NewRemoteReferenceName("origin", g.branch)
+	if g.observe != nil {
+		defer func(start time.Time) { g.observe(true, time.Since(start)) }(time.Now())
+	}
+	err = r.Fetch(&git.FetchOptions{
+		RemoteName:   "origin",
+		RefSpecs:     []config.RefSpec{config.RefSpec("+refs/heads/" + g.branch + ":" + remote.String())},
+		Tags:         tags,
+		Auth:         auth,
+		ProxyOptions: transport.ProxyOptions{URL: g.proxy},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", err
+	}
+	return remote, nil
+}
+
+// goSparse removes the files that aren't in our directories from the worktree and marks them skip-worktree in the
+// index, and chowns the checkout to g.user. go-git's sparse checkout only marks the entries that were already in
+// the index, so we do this ourselves after every checkout or reset.
+func (g *Git) goSparse(r *git.Repository) error {
+	if len(g.dirs) > 0 {
+		idx, err := r.Storer.Index()
+		if err != nil {
+			return err
+		}
+		for _, e := range idx.Entries {
+			if e.SkipWorktree || inDirs(e.Name, g.dirs) {
+				continue
+			}
+			e.SkipWorktree = true
+			if err := os.Remove(filepath.Join(g.mount, filepath.FromSlash(e.Name))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			// Remove the now empty parent directories, os.Remove fails on the first non-empty one.
+			for dir := path.Dir(e.Name); dir != "."; dir = path.Dir(dir) {
+				if os.Remove(filepath.Join(g.mount, filepath.FromSlash(dir))) != nil {
+					break
+				}
+			}
+		}
+		if err := r.Storer.SetIndex(idx); err != nil {
+			return err
+		}
+	}
+	return chown(g.mount, g.user)
+}
+
+// inDirs returns true if the file name is in one of dirs.
+func inDirs(name string, dirs []string) bool {
+	for _, d := range dirs {
+		if strings.HasPrefix(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// goChanged returns true if any of the files changed between from and to is in one of our directories.
+func (g *Git) goChanged(from, to *object.Commit) (bool, error) {
+	patch, err := from.Patch(to)
+	if err != nil {
+		return false, err
+	}
+	for _, fp := range patch.FilePatches() {
+		a, b := fp.Files()
+		for _, f := range []diff.File{a, b} {
+			if f != nil && inDirs(f.Path(), g.dirs) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (g *Git) goHead() (*object.Commit, error) {
+	r, err := git.PlainOpen(g.mount)
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	return r.CommitObject(head.Hash())
+}
+
+func (g *Git) goHash() string {
+	c, err := g.goHead()
+	if counted(err) != nil {
+		return ""
+	}
+	return c.Hash.String()
+}
+
+func (g *Git) goTime() time.Time {
+	c, err := g.goHead()
+	if counted(err) != nil {
+		return time.Time{}
+	}
+	return c.Committer.When
+}
+
+func (g *Git) goRemote() (string, error) {
+	if err := g.goGuard(); err != nil {
+		return "", counted(err)
+	}
+	auth, err := g.goAuth()
+	if err != nil {
+		return "", counted(err)
+	}
+	rem := git.NewRemote(nil, &config.RemoteConfig{Name: "origin", URLs: []string{g.upstream}})
+	refs, err := rem.List(&git.ListOptions{Auth: auth, ProxyOptions: transport.ProxyOptions{URL: g.proxy}})
+	if err != nil {
+		return "", counted(err)
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.NewBranchReferenceName(g.branch) {
+			return ref.Hash().String(), counted(nil)
+		}
+	}
+	return "", counted(fmt.Errorf("branch %q not found upstream", g.branch))
+}
+
+func (g *Git) goResolve(rev string) (string, error) {
+	r, err := git.PlainOpen(g.mount)
+	if err != nil {
+		return "", counted(err)
+	}
+	if h, err := r.ResolveRevision(plumbing.Revision(rev)); err == nil {
+		return h.String(), counted(nil)
+	}
+	if _, err := g.goFetch(r, git.AllTags); err != nil {
+		return "", counted(err)
+	}
+	if h, err := r.ResolveRevision(plumbing.Revision(rev)); err == nil {
+		return h.String(), counted(nil)
+	}
+	return "", counted(fmt.Errorf("%w: %s", ErrUnknownCommit, rev))
+}
+
+func (g *Git) goRollback(hash string) error {
+	r, err := git.PlainOpen(g.mount)
+	if err != nil {
+		return counted(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return counted(err)
+	}
+	log.Infof("checking out %s in %q with go-git", hash, g.mount)
+	if err := w.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(hash), SparseCheckoutDirectories: g.dirs, Force: true}); err != nil {
+		return counted(err)
+	}
+	return counted(g.goSparse(r))
+}
+
+func (g *Git) goSwitch() error {
+	r, err := git.PlainOpen(g.mount)
+	if err != nil {
+		return counted(err)
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return counted(err)
+	}
+	origin, ok := cfg.Remotes["origin"]
+	if !ok {
+		return counted(fmt.Errorf("no origin remote in %q", g.mount))
+	}
+	origin.URLs = []string{g.upstream}
+	return counted(r.SetConfig(cfg))
+}
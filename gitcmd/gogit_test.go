@@ -0,0 +1,111 @@
+package gitcmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.science.ru.nl/log"
+)
+
+// commit writes the files into the worktree of r and commits them, it returns the new hash.
+func commit(t *testing.T, r *git.Repository, files map[string]string) string {
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		p := filepath.Join(w.Filesystem.Root(), name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.org", When: time.Now()}
+	h, err := w.Commit("test", &git.CommitOptions{Author: sig, Committer: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.String()
+}
+
+func TestGoGit(t *testing.T) {
+	log.Discard()
+	upstream := t.TempDir()
+	r, err := git.PlainInitWithOptions(upstream, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commit(t, r, map[string]string{"etc/a.conf": "a", "other/b": "b"})
+
+	mount := filepath.Join(t.TempDir(), "checkout")
+	g := New(upstream, "main", mount, "", []string{"etc"})
+	g.GoGit()
+	if err := g.Checkout(); err != nil {
+		t.Fatalf("failed to checkout: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(mount, "etc/a.conf")); err != nil {
+		t.Errorf("expected etc/a.conf to be checked out: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(mount, "other/b")); err == nil {
+		t.Errorf("expected other/b not to be checked out")
+	}
+	if h := g.Hash(); h != first {
+		t.Errorf("expected hash %s, got %s", first, h)
+	}
+
+	middle := commit(t, r, map[string]string{"other/b": "b2"})
+	if changed, err := g.Pull(FastForward, ""); err != nil || changed {
+		t.Errorf("expected no changes of interest, got %t: %v", changed, err)
+	}
+	if _, err := os.Stat(filepath.Join(mount, "other/b")); err == nil {
+		t.Errorf("expected other/b not to be checked out after pull")
+	}
+	second := commit(t, r, map[string]string{"etc/a.conf": "a2"})
+	if remote, err := g.Remote(); err != nil || remote != second {
+		t.Errorf("expected remote %s, got %s: %v", second, remote, err)
+	}
+	if changed, err := g.Pull(FastForward, ""); err != nil || !changed {
+		t.Errorf("expected changes of interest, got %t: %v", changed, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(mount, "etc/a.conf")); string(data) != "a2" {
+		t.Errorf("expected %q, got %q", "a2", data)
+	}
+
+	if err := g.Rollback(first); err != nil {
+		t.Fatalf("failed to rollback: %s", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(mount, "etc/a.conf")); string(data) != "a" {
+		t.Errorf("expected %q after rollback, got %q", "a", data)
+	}
+	if full, err := g.Resolve(second[:7]); err != nil || full != second {
+		t.Errorf("expected %s, got %s: %v", second, full, err)
+	}
+	third := commit(t, r, map[string]string{"etc/a.conf": "a3"})
+	if full, err := g.Resolve(third); err != nil || full != third {
+		t.Errorf("expected %s to be fetched, got %s: %v", third, full, err)
+	}
+	if full, err := g.Resolve(second + "~1"); err != nil || full != middle {
+		t.Errorf("expected %s~1 to be %s, got %s: %v", second, middle, full, err)
+	}
+	if _, err := g.Resolve("--upload-pack=x"); !errors.Is(err, ErrUnknownCommit) {
+		t.Errorf("expected %s for an option, got %v", ErrUnknownCommit, err)
+	}
+	if _, err := g.Resolve("deadbeef"); !errors.Is(err, ErrUnknownCommit) {
+		t.Errorf("expected %s, got %v", ErrUnknownCommit, err)
+	}
+
+	if _, err := g.Pull(Rebase, ""); err == nil {
+		t.Errorf("expected error for strategy rebase")
+	}
+}
@@ -0,0 +1,48 @@
+package gitcmd
+
+import (
+	"encoding/base64"
+	"os/exec"
+	"strings"
+
+	"go.science.ru.nl/log"
+)
+
+// Secret sets the function that returns the secret used to authenticate to upstream. For an HTTP(S) upstream the
+// secret is a token or "<user>:<password>", for an SSH upstream it's the path of the private key. The function is
+// called for every git command, as with a partial clone any command may need to fetch from upstream.
+func (g *Git) Secret(fn func() (string, error)) { g.secret = fn }
+
+// IdentityFile sets the private key used to authenticate to an SSH upstream, it takes precedence over the secret.
+func (g *Git) IdentityFile(path string) { g.identity = path }
+
+// CredentialHelper sets the git credential helper (as in git's credential.helper) that provides the username and
+// password for an HTTP(S) upstream. It takes precedence over the secret.
+func (g *Git) CredentialHelper(helper string) { g.helper = helper }
+
+// auth adds the secret to the environment of cmd, or to the git config key value pairs in cfg.
+func (g *Git) auth(cmd *exec.Cmd, cfg []string) []string {
+	if g.identity != "" && IsSSH(g.upstream) {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -i "+g.identity+" -o IdentitiesOnly=yes")
+		return cfg
+	}
+	if g.helper != "" && !IsSSH(g.upstream) {
+		return append(cfg, "credential.helper", g.helper)
+	}
+	if g.secret == nil {
+		return cfg
+	}
+	secret, err := g.secret()
+	if err != nil {
+		log.Warningf("Failed to get secret for %q: %s", g.upstream, err)
+		return cfg
+	}
+	if IsSSH(g.upstream) {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -i "+secret+" -o IdentitiesOnly=yes")
+		return cfg
+	}
+	if !strings.Contains(secret, ":") {
+		secret = "gitopper:" + secret // the user is ignored for tokens
+	}
+	return append(cfg, "http.extraHeader", "Authorization: Basic "+base64.StdEncoding.EncodeToString([]byte(secret)))
+}
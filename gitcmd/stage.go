@@ -0,0 +1,73 @@
+package gitcmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stage writes the tree of commit hash, limited to the directories we care about, to dir. The checkout itself
+// isn't changed. Only regular files, directories and symbolic links are written.
+func (g *Git) Stage(hash, dir string) error {
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	args := append([]string{"archive", "--format=tar", hash, "--"}, g.dirs...)
+	cmd := g.command(context.TODO(), args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	metricGitOps.Inc()
+	err = untar(out, dir)
+	io.Copy(io.Discard, out)
+	if err1 := cmd.Wait(); err1 != nil {
+		metricGitFail.Inc()
+		return fmt.Errorf("%s: %s", err1, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(h.Name))
+		if !strings.HasPrefix(name, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in archive: %q", h.Name)
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, 0755)
+		case tar.TypeSymlink:
+			err = os.Symlink(h.Linkname, name)
+		case tar.TypeReg:
+			var f *os.File
+			if f, err = os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(h.Mode)&0777); err == nil {
+				_, err = io.Copy(f, tr)
+				if err1 := f.Close(); err == nil {
+					err = err1
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package gitcmd
+
+import (
+	"net/url"
+	"strings"
+)
+
+// IsSSH returns true if upstream is an SSH URL, either ssh://... or the scp-like user@host:path.
+func IsSSH(upstream string) bool {
+	if strings.HasPrefix(upstream, "ssh://") || strings.HasPrefix(upstream, "git+ssh://") {
+		return true
+	}
+	if strings.Contains(upstream, "://") {
+		return false
+	}
+	at, colon := strings.Index(upstream, "@"), strings.Index(upstream, ":")
+	return at > 0 && colon > at
+}
+
+// Host returns the host git contacts for upstream, or the empty string if upstream is local (a path or a bundle).
+// For a remote helper, <scheme>::<address>, the host of address is returned.
+func Host(upstream string) string {
+	if i := strings.Index(upstream, "::"); i > 0 && !strings.Contains(upstream[:i], "/") {
+		upstream = upstream[i+2:]
+	}
+	if strings.Contains(upstream, "://") {
+		u, err := url.Parse(upstream)
+		if err != nil || u.Scheme == "file" {
+			return ""
+		}
+		return u.Hostname()
+	}
+	// scp-like: [user@]host:path, a colon before any slash. A single letter is a Windows drive.
+	colon := strings.Index(upstream, ":")
+	if colon <= 1 || strings.Contains(upstream[:colon], "/") {
+		return ""
+	}
+	host := upstream[:colon]
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[at+1:]
+	}
+	return strings.Trim(host, "[]")
+}
+
+// isNetwork returns true if the git command args (may) contact upstream.
+func isNetwork(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "clone", "fetch", "pull", "ls-remote", "submodule":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package gitcmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUntrusted is returned by Verify when the signature is missing, bad or made with a key that isn't trusted.
+var ErrUntrusted = errors.New("not signed by a trusted key")
+
+// Verify verifies the signature of commit hash, or of the tag when one is tracked, against the trusted keys. A key
+// is an SSH public key ("ssh-ed25519 AAAA...") or the full fingerprint of a GPG (sub)key, which must be in the
+// keyring of the user git runs as.
+func (g *Git) Verify(hash string, keys []string) error {
+	if g.tag != "" {
+		return g.verify("verify-tag", g.ref(), keys)
+	}
+	return g.verify("verify-commit", hash, keys)
+}
+
+// VerifyCommit is like Verify, but always verifies commit hash, even when a tag is tracked.
+func (g *Git) VerifyCommit(hash string, keys []string) error {
+	return g.verify("verify-commit", hash, keys)
+}
+
+// verify runs verb (verify-commit or verify-tag) on rev and checks the signature was made by one of keys.
+func (g *Git) verify(verb, rev string, keys []string) error {
+	var sshKeys, gpgKeys []string
+	for _, k := range keys {
+		if strings.HasPrefix(k, "ssh-") || strings.HasPrefix(k, "ecdsa-") || strings.HasPrefix(k, "sk-") {
+			sshKeys = append(sshKeys, k)
+			continue
+		}
+		gpgKeys = append(gpgKeys, strings.ToUpper(strings.ReplaceAll(k, " ", "")))
+	}
+
+	// SSH signatures are verified against the allowed signers file, which holds only the trusted keys.
+	if len(sshKeys) > 0 {
+		f, err := os.CreateTemp("", "gitopper-signers")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		for _, k := range sshKeys {
+			fmt.Fprintf(f, "* %s\n", k)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(f.Name(), 0644); err != nil { // git may run as another user
+			return err
+		}
+		g.config = []string{"gpg.ssh.allowedSignersFile", f.Name()}
+		defer func() { g.config = nil }()
+	}
+
+	g.cwd = g.mount
+	defer func() { g.cwd = "" }()
+
+	out, err := g.run(verb, "--raw", rev)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUntrusted, firstLine(out))
+	}
+	// A GPG signature is good if made by any key in the keyring, so check the fingerprint of the (primary) key.
+	gpg := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" || fields[1] != "VALIDSIG" {
+			continue
+		}
+		gpg = true
+		for _, fpr := range []string{fields[2], fields[len(fields)-1]} {
+			for _, k := range gpgKeys {
+				if fpr == k {
+					return nil
+				}
+			}
+		}
+	}
+	if gpg || len(sshKeys) == 0 {
+		return fmt.Errorf("%w: signed by an unknown key", ErrUntrusted)
+	}
+	return nil
+}
+
+// firstLine returns the first non-empty line of out.
+func firstLine(out []byte) string {
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package gitcmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.science.ru.nl/log"
+)
+
+func TestVerifySSH(t *testing.T) {
+	log.Discard()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("no ssh-keygen")
+	}
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("failed to generate key: %s: %s", err, out)
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := filepath.Join(dir, "repo")
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.org",
+			"-c", "gpg.format=ssh", "-c", "user.signingkey=" + key}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	os.MkdirAll(repo, 0755)
+	git("init", "-q")
+	git("commit", "-q", "--allow-empty", "-m", "unsigned")
+	unsigned := git("rev-parse", "HEAD")
+	git("commit", "-q", "--allow-empty", "-S", "-m", "signed")
+	signed := git("rev-parse", "HEAD")
+
+	g := New("", "", repo, "", nil)
+	trusted := []string{strings.TrimSpace(string(pub))}
+	if err := g.Verify(signed, trusted); err != nil {
+		t.Errorf("expected %s to verify, got %s", signed, err)
+	}
+	if err := g.Verify(unsigned, trusted); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("expected %s for unsigned commit, got %v", ErrUntrusted, err)
+	}
+	other := []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"}
+	if err := g.Verify(signed, other); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("expected %s for untrusted key, got %v", ErrUntrusted, err)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/miekg/gitopper/osutil"
+	"go.science.ru.nl/log"
+)
+
+const (
+	listenFDs = "GITOPPER_LISTEN_FDS" // Number of listeners handed over by the previous gitopper, they start at fd 3.
+	listenPID = "GITOPPER_LISTEN_PID" // PID of the previous gitopper.
+)
+
+// handoverSignals make us hand the listeners over to a new gitopper.
+var handoverSignals = []os.Signal{syscall.SIGUSR2}
+
+// previous is the PID of the gitopper that handed over its listeners to us.
+var previous int
+
+// inherited returns the listeners handed over by the previous gitopper, or nil if we weren't started by one. When
+// there are, systemd is told we are the main process now.
+func inherited() ([]net.Listener, error) {
+	env := os.Getenv(listenFDs)
+	if env == "" {
+		return nil, nil
+	}
+	previous, _ = strconv.Atoi(os.Getenv(listenPID))
+	os.Unsetenv(listenFDs)
+	os.Unsetenv(listenPID)
+	n, err := strconv.Atoi(env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %s", listenFDs, env, err)
+	}
+	listeners := []net.Listener{}
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if err := osutil.Notify(fmt.Sprintf("MAINPID=%d", os.Getpid())); err != nil {
+		log.Warningf("Failed to notify systemd of our PID: %s", err)
+	}
+	return listeners, nil
+}
+
+// handover starts the gitopper binary, which may have been upgraded, with our arguments and listeners.
+func handover(listeners []net.Listener) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files := []*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("can't hand over listener on %s", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), listenFDs+"="+strconv.Itoa(len(files)), listenPID+"="+strconv.Itoa(os.Getpid()))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Infof("Handed %d listeners over to %q with PID %d", len(files), binary, cmd.Process.Pid)
+	return nil
+}
+
+// waitParent waits until the gitopper that handed over its listeners to us has exited, so we don't both
+// reconcile the same services. It gives up after timeout.
+func waitParent(timeout time.Duration) {
+	if previous <= 0 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for syscall.Kill(previous, 0) == nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
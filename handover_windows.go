@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// handoverSignals is empty, Windows has no signal to ask for a handover.
+var handoverSignals = []os.Signal{}
+
+func inherited() ([]net.Listener, error) { return nil, nil }
+
+func handover(listeners []net.Listener) error {
+	return errors.New("handover is not supported on Windows")
+}
+
+func waitParent(timeout time.Duration) {}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errHostUnsupported = errors.New("not supported on this platform")
+
+func hostFree(dir string) (uint64, error) { return 0, errHostUnsupported }
+
+func hostLoad() (float64, error) { return 0, errHostUnsupported }
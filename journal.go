@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/gitopper/ospkg"
+	"github.com/miekg/gitopper/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.science.ru.nl/log"
+)
+
+// journal records the apply of hash to (coming from hash from) of s, that started at start, in the journal of
+// the machine's store, together with the summary of the changes (see gitcmd.Summary) and its provenance: where it
+// came from, who signed it and the version of the package. If s.Attest is set the provenance is also POSTed there.
+func (s *Service) journal(from, to, summary string, start time.Time, operator bool, err error) {
+	if s.machine == nil {
+		return
+	}
+	e := JournalEntry{
+		Service:  s.Service,
+		From:     from,
+		To:       to,
+		Summary:  summary,
+		Start:    start.UTC(),
+		Duration: time.Since(start),
+		Result:   "OK",
+		Operator: operator,
+		Upstream: s.remote(),
+		Phases:   s.timing.Phases(),
+	}
+	result := "ok"
+	if err != nil {
+		e.Result = err.Error()
+		result = "error"
+	}
+	metricServiceApply.WithLabelValues(s.Service, result).(prometheus.ExemplarAdder).AddWithExemplar(1, s.exemplar(to))
+
+	e.Signer, e.Package, e.Version = s.provenance(to)
+	if s.machine.Store != nil {
+		if err := s.machine.Store.Append(e); err != nil {
+			log.Warningf("Machine %q, failed to add journal entry for service %q: %s", s.Machine, s.Service, err)
+		}
+	}
+	s.attest(e)
+}
+
+// provenance returns the signer of commit hash and the package of s with its installed version.
+func (s *Service) provenance(hash string) (signer, pkg, version string) {
+	if hash != "" {
+		var err error
+		if signer, err = s.newGitCmd().Signer(hash); err != nil {
+			log.Warningf("Machine %q, failed to get signer of %s: %s", s.Machine, hash, err)
+		}
+	}
+	if v, ok := s.pkg().(ospkg.Versioner); ok {
+		pkg = s.Package
+		var err error
+		if version, err = v.Version(pkg); err != nil {
+			log.Warningf("Machine %q, failed to get version of package %q: %s", s.Machine, pkg, err)
+		}
+	}
+	return signer, pkg, version
+}
+
+// attest POSTs the provenance in e to s.Attest. If s.Attest is empty this is a noop.
+func (s *Service) attest(e JournalEntry) {
+	if s.Attest == "" {
+		return
+	}
+	p := proto.Provenance{
+		Machine:  s.Machine,
+		Service:  s.Service,
+		Upstream: e.Upstream,
+		Commit:   e.To,
+		Signer:   e.Signer,
+		Package:  e.Package,
+		Version:  e.Version,
+		Applied:  e.Start.Format(time.RFC3339),
+		Result:   e.Result,
+	}
+	if err := post(s.Attest, p); err != nil {
+		log.Warningf("Machine %q, failed to send provenance to %q: %s", s.Machine, s.Attest, err)
+	}
+}
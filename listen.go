@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// listen returns listeners for addr (host:port) on network, which is tcp (dual-stack), tcp4 or tcp6. If iface
+// is not empty, the port of addr is bound on each address of that interface (that fits network) instead. An
+// error is returned if the interface doesn't exist or if the host in addr isn't an address of this machine.
+func listen(network, addr, iface string) ([]net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unknown network %q, must be tcp, tcp4 or tcp6", network)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{}
+	if iface != "" {
+		if host != "" {
+			return nil, fmt.Errorf("can't bind %q and interface %q at the same time", addr, iface)
+		}
+		ifi, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %s", iface, err)
+		}
+		ifaddrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %s", iface, err)
+		}
+		for _, a := range ifaddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || !fits(network, ipnet.IP) {
+				continue
+			}
+			ip := ipnet.IP.String()
+			if ipnet.IP.IsLinkLocalUnicast() && ipnet.IP.To4() == nil {
+				ip += "%" + iface
+			}
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("interface %q has no %s addresses", iface, network)
+		}
+	} else {
+		if host != "" {
+			if err := local(network, host); err != nil {
+				return nil, err
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+
+	listeners := []net.Listener{}
+	for _, a := range addrs {
+		l, err := net.Listen(network, a)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// fits returns true if ip can be used on network.
+func fits(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4":
+		return ip.To4() != nil
+	case "tcp6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// local returns an error if host is not an IP address of this machine that fits network. Names are allowed as is.
+func local(network, host string) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	if !fits(network, ip) {
+		return fmt.Errorf("address %q can't be used with %s", host, network)
+	}
+	if ip.IsUnspecified() {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("address %q is not configured on this machine", host)
+}
+
+// handoverTimeout is how long in-flight requests get to finish when we hand our listeners over.
+const handoverTimeout = 30 * time.Second
+
+// shutdown gracefully shuts down the servers, requests that haven't finished after timeout are cut off.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+// listenUnix listens on the unix socket path, which is only accessible by us. A stale socket is removed first.
+// The socket is created with a umask of 0077, so it's never accessible by others, not even until the chmod.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	restore := umask(0077)
+	l, err := net.Listen("unix", path)
+	restore()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
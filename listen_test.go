@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestListenInvalid(t *testing.T) {
+	if _, err := listen("tcp", ":0", "does-not-exist0"); err == nil {
+		t.Fatal("Expected error for non existent interface, got nil")
+	}
+	if _, err := listen("tcp", "192.0.2.1:0", ""); err == nil {
+		t.Fatal("Expected error for non local address, got nil")
+	}
+	if _, err := listen("tcp4", "[::1]:0", ""); err == nil {
+		t.Fatal("Expected error for IPv6 address on tcp4, got nil")
+	}
+}
+
+func TestListen(t *testing.T) {
+	listeners, err := listen("tcp", "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatalf("Expected to listen on 127.0.0.1, got: %s", err)
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions on windows")
+	}
+	path := filepath.Join(t.TempDir(), "gitopper.sock")
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected socket to have mode 0600, got %o", perm)
+	}
+}
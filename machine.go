@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/gitopper/ospkg"
+	"go.science.ru.nl/log"
+)
+
+// Machine holds the state of the machine we run on, as opposed to the state of the services.
+type Machine struct {
+	StateDir string            // Directory where the state of each service is exported, empty disables this.
+	Store    StateStore        // Where the state of the services is kept.
+	LowRes   bool              // Low-resource mode: shallow clones and ls-remote polling.
+	Pkg      ospkg.Manager     // The package manager, nil if there is none.
+	Facts    map[string]string // Site specific facts, also used as labels.
+	Hosts    []string          // Names of this machine: the hostname and the ones given with -h.
+
+	standby     bool
+	promoted    chan struct{} // Closed when we are promoted from standby.
+	maintenance bool
+	ttl         *time.Timer // Ends the maintenance, if it has a TTL.
+	override    time.Time   // Until when change-freeze calendars are overridden.
+	sync.RWMutex
+}
+
+func newMachine(standby bool) *Machine {
+	return &Machine{Store: newMemStore(), standby: standby, promoted: make(chan struct{})}
+}
+
+// Is returns true if host is one of the names of this machine.
+func (m *Machine) Is(host string) bool {
+	if m == nil {
+		return false
+	}
+	return contains(m.Hosts, host)
+}
+
+// Standby returns true if this machine is in standby, i.e. services are checked out and pulled, but not mounted
+// nor restarted.
+func (m *Machine) Standby() bool {
+	if m == nil {
+		return false
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return m.standby
+}
+
+// Promote takes the machine out of standby. It returns false if the machine wasn't in standby.
+func (m *Machine) Promote() bool {
+	m.Lock()
+	defer m.Unlock()
+	if !m.standby {
+		return false
+	}
+	m.standby = false
+	close(m.promoted)
+	return true
+}
+
+// Promoted returns a channel that is closed when the machine is promoted.
+func (m *Machine) Promoted() <-chan struct{} { return m.promoted }
+
+// Maintenance returns true if this machine is in maintenance: services don't pull and notifications are suppressed.
+func (m *Machine) Maintenance() bool {
+	if m == nil {
+		return false
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return m.maintenance
+}
+
+// SetMaintenance puts the machine in or takes it out of maintenance. If ttl is larger than zero, the maintenance
+// ends by itself after ttl.
+func (m *Machine) SetMaintenance(on bool, ttl time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if m.ttl != nil {
+		m.ttl.Stop()
+		m.ttl = nil
+	}
+	m.maintenance = on
+	metricMachineMaintenance.Set(0)
+	if !on {
+		return
+	}
+	metricMachineMaintenance.Set(1)
+	if ttl > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(ttl, func() {
+			m.Lock()
+			defer m.Unlock()
+			if m.ttl != t { // maintenance was set again since
+				return
+			}
+			log.Infof("Maintenance ended after %s", ttl)
+			m.maintenance, m.ttl = false, nil
+			metricMachineMaintenance.Set(0)
+		})
+		m.ttl = t
+	}
+}
+
+// Override returns true if the change-freeze calendars are overridden, i.e. for an emergency fix.
+func (m *Machine) Override() bool {
+	if m == nil {
+		return false
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return time.Now().Before(m.override)
+}
+
+// SetOverride overrides the change-freeze calendars for d, a d of zero ends the override.
+func (m *Machine) SetOverride(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.override = time.Now().Add(d)
+}
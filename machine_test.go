@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	m := newMachine(false)
+	m.SetMaintenance(true, 10*time.Millisecond)
+	if !m.Maintenance() {
+		t.Fatal("expected machine to be in maintenance")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if m.Maintenance() {
+		t.Fatal("expected maintenance to have ended after its ttl")
+	}
+
+	m.SetMaintenance(true, 10*time.Millisecond)
+	m.SetMaintenance(true, 0) // no ttl, the previous one no longer applies
+	time.Sleep(50 * time.Millisecond)
+	if !m.Maintenance() {
+		t.Fatal("expected machine to still be in maintenance")
+	}
+	m.SetMaintenance(false, 0)
+	if m.Maintenance() {
+		t.Fatal("expected machine not to be in maintenance")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,17 +12,64 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/miekg/gitopper/ospkg"
+	"github.com/miekg/gitopper/osutil"
+	"github.com/miekg/gitopper/reconcile"
+	"github.com/miekg/gitopper/sandbox"
 	"go.science.ru.nl/log"
 )
 
 var (
-	flagHosts  sliceFlag
-	flagConfig = flag.String("c", "", "config file to read")
-	flagAddr   = flag.String("a", ":8000", "address to listen on")
-	flagDebug  = flag.Bool("d", false, "enable debug logging")
+	flagHosts     sliceFlag
+	flagConfig    = flag.String("c", "", "config file to read")
+	flagFormat    = flag.String("format", "", "format of the config file: toml, yaml or json, defaults to the file's extension")
+	flagAddr      = flag.String("a", ":8000", "address to listen on, empty disables")
+	flagSocket    = flag.String("s", "", "unix socket to listen on, for local-only control")
+	flagNetwork   = flag.String("net", "tcp", "network to listen on: tcp (dual-stack), tcp4 or tcp6")
+	flagInterface = flag.String("i", "", "interface to listen on, the port from -a is used on all its addresses")
+	flagAuth      = flag.String("auth", "", "file with credentials (<user>:<password> or a bearer token per line) required for HTTP access")
+	flagCert      = flag.String("cert", "", "TLS certificate file, enables TLS")
+	flagKey       = flag.String("key", "", "TLS key file")
+	flagDebug     = flag.Bool("d", false, "enable debug logging")
+	flagHostname  = flag.String("n", "kernel", "how to determine our hostname: kernel, short, fqdn, file:<path> or metadata")
+	flagMetadata  = flag.Bool("m", false, "fetch labels from the cloud metadata service")
+	flagFacts     = flag.String("facts", "/etc/gitopper/facts.json", "JSON file, or exec:<command>, with facts to use as labels")
+	flagStandby   = flag.Bool("standby", false, "start in standby: checkout and pull, but don't mount or restart until promoted")
+	flagStateDir  = flag.String("statedir", "/run/gitopper", "directory to export the state of each service to, empty disables")
+	flagStore     = flag.String("store", "", "directory to keep the state of the services in, so it survives restarts")
+	flagResolve   = flag.Bool("resolve", false, "print the services the hosts would pick up and exit")
+	flagPlan      = flag.Bool("plan", false, "print what would be done for the services the hosts pick up, without doing it, and exit")
+	flagLowRes    = flag.Bool("lowres", false, "low-resource mode: poll every 5m with ls-remote, shallow clones and a single worker")
+	flagWorkers   = flag.Int("workers", 4, "maximum number of services reconciled concurrently")
+	flagPkgUpdate = flag.Duration("pkgupdate", 0, "refresh the package manager's indexes this often, 0 disables")
+	flagReport    = flag.Duration("report", 24*time.Hour, "report the services that are frozen, pinned or broken this often, 0 disables")
+	flagUnits     = flag.Duration("units", 15*time.Second, "check the units of the services for failures this often, 0 disables")
+	flagSelftest  = flag.Bool("selftest", false, "check if this host can run gitopper and exit")
+	flagSandbox   = flag.Bool("sandbox", false, "run git, policy, validate and build commands with a read-only filesystem, and the latter without network")
+	flagBoot      = flag.Duration("b", 2*time.Minute, "boot deadline after which we report readiness, even if not all services are setup")
 )
 
+// signals receives the signals we act on, a HUP can also be send internally to restart.
+var signals = make(chan os.Signal, 1)
+
 func main() {
+	sandbox.Main()
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(checkCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		if err := schema(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		if err := bootstrap(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to bootstrap: %s", err)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.TODO())
 	defer cancel()
 	flag.Var(&flagHosts, "h", "hosts to impersonate, can be given multiple times, $HOSTNAME is included by default")
@@ -31,97 +79,285 @@ func main() {
 	if *flagDebug {
 		log.D.Set()
 	}
+	sandbox.Enabled = *flagSandbox
+	if *flagSandbox {
+		if err := sandbox.Supported(); err != nil {
+			log.Fatalf("Can't sandbox: %s", err)
+		}
+	}
+
+	workers := *flagWorkers
+	if workers < 1 {
+		log.Fatalf("Need at least one worker, got %d", workers)
+	}
+	if *flagLowRes {
+		duration = 5 * time.Minute
+		workers = 1
+	}
+
+	if *flagSelftest {
+		c := Config{}
+		if *flagConfig != "" {
+			var err error
+			if c, err = readConfig(*flagConfig); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if !selftest(os.Stdout, c, *flagNetwork, *flagAddr) {
+			os.Exit(1)
+		}
+		return
+	}
 
 	if *flagConfig == "" {
 		log.Fatalf("-c flag is mandatory")
 	}
 
-	doc, err := os.ReadFile(*flagConfig)
+	c, err := readConfig(*flagConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
-	c, err := parseConfig(doc)
+	boot := c.Bootstrap
+	if boot != nil {
+		if c, err = boot.config(c); err != nil {
+			log.Fatal(err)
+		}
+		if boot.Machine != "" {
+			flagHosts.Set(boot.Machine)
+		}
+	}
+
+	hostname, err := osutil.Hostname(*flagHostname)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Failed to determine hostname: %s", err)
 	}
 
-	if err := c.Valid(); err != nil {
-		log.Fatalf("The configuration is not valid: %s", err)
+	var labels map[string]string
+	if *flagMetadata {
+		labels, err = osutil.Metadata()
+		if err != nil {
+			log.Fatalf("Failed to fetch cloud metadata: %s", err)
+		}
+		log.Infof("Labels from cloud metadata: %v", labels)
+	}
+	facts, err := osutil.Facts(*flagFacts)
+	if err != nil {
+		log.Fatalf("Failed to read facts from %q: %s", *flagFacts, err)
+	}
+	if len(facts) > 0 {
+		log.Infof("Labels from facts: %v", facts)
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		for k, v := range facts {
+			labels[k] = v
+		}
 	}
 
-	router := newRouter(c)
-	go func() {
-		// TODO: Interrupt HTTP serving through context cancellation.
-		if err := http.ListenAndServe(*flagAddr, router); err != nil {
+	if *flagResolve {
+		hosts := flagHosts
+		if len(hosts) == 0 {
+			hosts = []string{hostname}
+		}
+		if err := resolve(os.Stdout, c, hosts, labels); err != nil {
 			log.Fatal(err)
 		}
-	}()
-	log.Infof("Launched server on port %s", *flagAddr)
-
-	var wg sync.WaitGroup
-	for _, s := range c.Services {
-		if !s.forMe(flagHosts) {
-			continue
+		return
+	}
+	if *flagPlan {
+		hosts := append(flagHosts, hostname)
+		pm, _ := ospkg.New()
+		if err := plan(os.Stdout, c, hosts, labels, pm); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
+	flagHosts.Set(hostname)
 
-		s := s.merge(c.Global, duration)
-		log.Infof("Machine %q %q", s.Machine, s.Upstream)
-		gc := s.newGitCmd()
-
-		// Initial checkout - if needed.
-		err := gc.Checkout()
-		if err != nil {
-			log.Warningf("Machine %q, error pulling repo %q: %s", s.Machine, s.Upstream, err)
-			s.SetState(StateBroken, fmt.Sprintf("error pulling %q: %s", s.Upstream, err))
-			continue
+	machine := newMachine(*flagStandby)
+	machine.StateDir = *flagStateDir
+	machine.LowRes = *flagLowRes
+	machine.Facts = facts
+	machine.Hosts = flagHosts
+	if pm, err := ospkg.New(); err == nil {
+		machine.Pkg = pm
+	}
+	if *flagStore != "" {
+		if machine.Store, err = newFileStore(*flagStore); err != nil {
+			log.Fatalf("Failed to setup state store: %s", err)
 		}
-
-		log.Infof("Machine %q, repository in %q with %q", s.Machine, gc.Repo(), gc.Hash())
-
-		// all succesfully done, do the bind mounts and start our puller
-		mounts, err := s.bindmount()
+	}
+	live := &liveConfig{c: c}
+	router := newRouter(live, machine, hostname)
+	var handler http.Handler = compress(router)
+	if *flagAuth != "" {
+		a, err := readAuth(*flagAuth)
 		if err != nil {
-			log.Warningf("Machine %q, error setting up bind mounts for %q: %s", s.Machine, s.Upstream, err)
-			s.SetState(StateBroken, fmt.Sprintf("error setting up bind mounts repo %q: %s", s.Upstream, err))
-			continue
-		}
-		// Restart any services as they see new files in their bindmounts. Do this here, because we can't be
-		// sure there is an update to a newer commit that would also kick off a restart.
-		if mounts > 0 {
-			if err := s.systemctl(); err != nil {
-				log.Warningf("Machine %q, error running systemctl: %s", s.Machine, err)
-				s.SetState(StateBroken, fmt.Sprintf("error running systemctl %q: %s", s.Upstream, err))
-				// no continue; maybe git pull will make this work later
+			log.Fatalf("Failed to read credentials: %s", err)
+		}
+		handler = a.Middleware(handler)
+	}
+	listeners, err := inherited()
+	if err != nil {
+		log.Fatalf("Failed to inherit listeners: %s", err)
+	}
+	handedOver := listeners != nil
+	if !handedOver && *flagAddr != "" {
+		if listeners, err = listen(*flagNetwork, *flagAddr, *flagInterface); err != nil {
+			log.Fatalf("Failed to listen: %s", err)
+		}
+	}
+	servers := []*http.Server{}
+	for _, l := range listeners {
+		l := l
+		srv := &http.Server{Handler: handler}
+		servers = append(servers, srv)
+		go func() {
+			var err error
+			if *flagCert != "" {
+				err = srv.ServeTLS(l, *flagCert, *flagKey)
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
 			}
+		}()
+		log.Infof("Launched server on %s", l.Addr())
+	}
+	// The unix socket is protected by its file permissions, so it doesn't need credentials nor TLS.
+	if *flagSocket != "" {
+		l, err := listenUnix(*flagSocket)
+		if err != nil {
+			log.Fatalf("Failed to listen: %s", err)
+		}
+		// The new gitopper creates its own socket, after a handover closing ours must not remove it.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
 		}
+		srv := &http.Server{Handler: router}
+		servers = append(servers, srv)
+		go func() {
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		log.Infof("Launched server on %s", *flagSocket)
+	}
+	if handedOver {
+		// The previous gitopper drains its requests and stops reconciling, before we start.
+		log.Infof("Waiting for the previous gitopper to exit")
+		waitParent(handoverTimeout + 10*time.Second)
+	}
+
+	// Critical services (DNS, NTP, ...) should be checked out, mounted and restarted before the rest.
+	c.byPriority()
 
+	var wg sync.WaitGroup
+	if machine.Pkg != nil && *flagPkgUpdate > 0 {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			s.trackUpstream(ctx)
+			updatePackages(ctx, machine.Pkg, *flagPkgUpdate)
 		}()
 	}
-
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if boot != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			boot.trackConfig(ctx, duration)
+		}()
+	}
+	booted := make(chan struct{})
+	d := &daemon{live: live, boot: boot, machine: machine, sched: reconcile.New(), duration: duration, hosts: flagHosts, labels: labels}
+	if *flagReport > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.report(ctx, hostname, *flagReport)
+		}()
+	}
+	if *flagUnits > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.watchUnits(ctx, *flagUnits)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runScheduler(ctx, d.sched, machine, workers)
+	}()
+	// The scheduler does the setups in order of priority, booted is closed when all of them have been attempted.
 	go func() {
-		select {
-		case s := <-done:
-			cancel()
-			// on HUP exit with exit status 2, so systemd can restart us (Restart=OnFailure)
-			if s == syscall.SIGHUP {
-				defer os.Exit(2)
+		var setups sync.WaitGroup
+		for _, s := range c.Services {
+			if s.forMe(flagHosts, labels) {
+				setups.Add(1)
+				d.start(s, c.Global, setups.Done)
 			}
-		case <-ctx.Done():
 		}
+		setups.Wait()
+		close(booted)
 	}()
-	wg.Wait()
-}
 
-func init() {
-	h, err := os.Hostname()
-	if err != nil {
-		h = os.Getenv("HOSTNAME")
+	select {
+	case <-booted:
+		log.Infof("All services have been setup")
+	case <-time.After(*flagBoot):
+		log.Warningf("Boot deadline of %s exceeded, continuing in degraded mode", *flagBoot)
+		for _, s := range c.Services {
+			if !s.forMe(flagHosts, labels) {
+				continue
+			}
+			if s.Hash() == "" {
+				if state, _ := s.State(); state == StateOK {
+					s.SetState(StateBroken, fmt.Sprintf("boot deadline of %s exceeded, still trying", *flagBoot))
+				}
+			}
+		}
+	case <-ctx.Done():
+	}
+	if err := osutil.NotifyReady(); err != nil {
+		log.Warningf("Failed to notify systemd we're ready: %s", err)
 	}
-	flagHosts.Set(h)
+
+	signal.Notify(signals, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, handoverSignals...)...)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if len(handoverSignals) > 0 && sig == handoverSignals[0] {
+					if err := handover(listeners); err != nil {
+						log.Warningf("Failed to hand over listeners: %s", err)
+						continue
+					}
+					shutdown(servers, handoverTimeout)
+					cancel()
+					return
+				}
+				if sig == syscall.SIGHUP {
+					err := d.reload()
+					if err == nil {
+						continue
+					}
+					if err != errRestart {
+						log.Warningf("Failed to reload config %q, keeping the running one: %s", *flagConfig, err)
+						continue
+					}
+					// exit with exit status 2, so systemd can restart us (Restart=OnFailure)
+					log.Infof("Bootstrap config changed, restarting")
+					cancel()
+					defer os.Exit(2)
+					return
+				}
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	wg.Wait()
 }
@@ -1,15 +1,100 @@
 package main
 
 import (
+	"expvar"
+	"runtime"
+	"strconv"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-// do we have a latecy that we can track?
+// The Go runtime and process metrics are exported under the gitopper namespace instead of the default go_ and
+// process_ ones, so the daemon's own file descriptors, goroutines and memory are told apart from those of other
+// Go programs scraped on the same host. The goroutine count is also in /debug/vars.
+func init() {
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	prometheus.WrapRegistererWithPrefix("gitopper_", prometheus.DefaultRegisterer).MustRegister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{Namespace: "gitopper"}))
+
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+}
+
+var (
+	metricServiceHash = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gitopper",
+		Subsystem: "service",
+		Name:      "info",
+		Help:      "Current hash and state for this service",
+	}, []string{"service", "hash", "state"})
+
+	metricServiceBreaker = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gitopper",
+		Subsystem: "service",
+		Name:      "breaker_trips_total",
+		Help:      "Total number of times the circuit breaker froze this service.",
+	}, []string{"service"})
+
+	metricServicePull = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gitopper",
+		Subsystem: "service",
+		Name:      "pull_duration_seconds",
+		Help:      "Histogram of the time (in seconds) each pull took.",
+	}, []string{"service"})
+
+	metricServicePhase = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gitopper",
+		Subsystem: "service",
+		Name:      "phase_duration_seconds",
+		Help:      "Histogram of the time (in seconds) spent in each phase of a reconcile.",
+	}, []string{"service", "phase"})
+
+	metricServiceUpstream = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gitopper",
+		Subsystem: "service",
+		Name:      "upstream_info",
+		Help:      "Upstream (or mirror) this service pulls from.",
+	}, []string{"service", "upstream"})
+
+	metricServiceUnitFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gitopper",
+		Subsystem: "service",
+		Name:      "unit_failures_total",
+		Help:      "Total number of times the unit of this service was seen failed while its checkout was current.",
+	}, []string{"service"})
+
+	metricServiceApply = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gitopper",
+		Subsystem: "service",
+		Name:      "apply_total",
+		Help:      "Total number of applies of a new hash, by result (ok or error).",
+	}, []string{"service", "result"})
+
+	metricConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gitopper",
+		Subsystem: "config",
+		Name:      "reloads_total",
+		Help:      "Total number of config reloads, by result (success or failure).",
+	}, []string{"result"})
+
+	metricMachineMaintenance = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gitopper",
+		Subsystem: "machine",
+		Name:      "maintenance",
+		Help:      "1 if this machine is in maintenance, 0 otherwise.",
+	})
+
+	metricServiceSkew = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gitopper",
+		Subsystem: "service",
+		Name:      "clock_skew_seconds",
+		Help:      "Estimated clock skew of this machine according to the upstream of this service.",
+	}, []string{"service"})
+)
 
-var metricServiceHash = promauto.NewGaugeVec(prometheus.GaugeOpts{
-	Namespace: "gitopper",
-	Subsystem: "service",
-	Name:      "info",
-	Help:      "Current hash and state for this service",
-}, []string{"service", "hash", "state"})
+// exemplar returns the exemplar labels for the current reconcile of s and the commit hash.
+func (s *Service) exemplar(hash string) prometheus.Labels {
+	return prometheus.Labels{"hash": hash, "reconcile_id": strconv.FormatUint(s.reconcile, 10)}
+}
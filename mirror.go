@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"go.science.ru.nl/log"
+)
+
+// mirrorFailures is the number of consecutive failed pulls (or checkouts) after which we fail over to the next
+// mirror.
+const mirrorFailures = 3
+
+// remote returns the upstream that is in use: Upstream, or one of the Mirrors after a fail over.
+func (s *Service) remote() string {
+	s.RLock()
+	defer s.RUnlock()
+	for _, m := range s.Mirrors {
+		if m == s.st.Upstream {
+			return m
+		}
+	}
+	return s.Upstream
+}
+
+// failover counts a failed pull, once it has failed mirrorFailures times in a row gc is switched to the next
+// mirror, after the last mirror Upstream is tried again.
+func (s *Service) failover(gc *gitcmd.Git) {
+	if len(s.Mirrors) == 0 {
+		return
+	}
+	s.pullFailures++
+	if s.pullFailures < mirrorFailures {
+		return
+	}
+	s.pullFailures = 0
+
+	from := s.remote()
+	upstreams := append([]string{s.Upstream}, s.Mirrors...)
+	to := upstreams[0]
+	for i, u := range upstreams {
+		if u == from {
+			to = upstreams[(i+1)%len(upstreams)]
+		}
+	}
+	if err := gc.Switch(to); err != nil {
+		log.Warningf("Machine %q, failed to switch service %q to %q: %s", s.Machine, s.Service, to, err)
+		return
+	}
+	s.Lock()
+	s.st.Upstream = to
+	s.save()
+	s.Unlock()
+	metricServiceUpstream.DeleteLabelValues(s.Service, from)
+	metricServiceUpstream.WithLabelValues(s.Service, to).Set(1)
+
+	log.Warningf("Machine %q, service %q failed over from %q to %q", s.Machine, s.Service, from, to)
+	s.notify(fmt.Sprintf("Service %q failed over from %q to %q after %d failed pulls", s.Service, from, to, mirrorFailures))
+}
+
+// useRemote points gc to the upstream in use, if it isn't already. The checkout may still point to another
+// one, i.e. after the state was lost, so with force the checkout is always updated.
+func (s *Service) useRemote(gc *gitcmd.Git, force bool) {
+	if len(s.Mirrors) == 0 {
+		return
+	}
+	remote := s.remote()
+	metricServiceUpstream.WithLabelValues(s.Service, remote).Set(1)
+	if !force && gc.Upstream() == remote {
+		return
+	}
+	if err := gc.Switch(remote); err != nil {
+		log.Warningf("Machine %q, failed to switch service %q to %q: %s", s.Machine, s.Service, remote, err)
+	}
+}
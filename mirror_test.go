@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/gitopper/gitcmd"
+)
+
+func TestFailover(t *testing.T) {
+	s := &Service{Upstream: "https://a", Mirrors: []string{"https://b", "https://c"}, Service: "test", Mount: t.TempDir()}
+	gc := gitcmd.New(s.remote(), "main", s.Mount, "", nil)
+
+	for _, exp := range []string{"https://b", "https://c", "https://a"} {
+		for i := 0; i < mirrorFailures; i++ {
+			if got := s.remote(); got == exp {
+				t.Fatalf("Failed over to %q after %d failures, expected %d", got, i, mirrorFailures)
+			}
+			s.failover(gc)
+		}
+		if got := s.remote(); got != exp {
+			t.Errorf("Expected to fail over to %q, got %q", exp, got)
+		}
+		if got := gc.Upstream(); got != exp {
+			t.Errorf("Expected git to use %q, got %q", exp, got)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+
+// Package mount sets up the read-only bind mounts that expose (parts of) a checkout on the local filesystem.
+package mount
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/miekg/gitopper/osutil"
+	"go.science.ru.nl/log"
+	"go.science.ru.nl/mountinfo"
+)
+
+// Bind bind mounts dir read-only on local. If local doesn't exist it is created and its base is chowned to
+// user. If local is already a mount point nothing is done and false is returned.
+func Bind(dir, local, user string) (bool, error) {
+	if _, err := os.Stat(local); err != nil {
+		if err := os.MkdirAll(local, 0775); err != nil {
+			log.Errorf("Directory %q can not be created", local)
+			return false, fmt.Errorf("failed to create directory %q: %s", local, err)
+		}
+		// set base to correct owner
+		uid, gid := osutil.User(user)
+		if err := os.Chown(path.Base(local), int(uid), int(gid)); err != nil {
+			log.Errorf("Directory %q can not be chown to %q: %s", local, user, err)
+			return false, fmt.Errorf("failed to chown directory %q to %q: %s", local, user, err)
+		}
+	}
+
+	if Mounted(local) {
+		log.Infof("Directory %q is already mounted", local)
+		return false, nil
+	}
+
+	ctx := context.TODO()
+	cmd := exec.CommandContext(ctx, "mount", "-r", "--bind", dir, local)
+	log.Infof("running %v", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			if e := exitError.ExitCode(); e != 0 {
+				return false, fmt.Errorf("failed to mount %q, exit code %d", dir, e)
+			}
+		}
+		return false, fmt.Errorf("failed to mount %q: %s", dir, err)
+	}
+	return true, nil
+}
+
+// Mounted returns true if local is a mount point.
+func Mounted(local string) bool {
+	ok, err := mountinfo.Mounted(local)
+	return err == nil && ok
+}
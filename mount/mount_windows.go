@@ -0,0 +1,44 @@
+package mount
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"go.science.ru.nl/log"
+)
+
+// Bind links local to dir with a directory junction, Windows has no bind mounts. If local is already a
+// junction nothing is done and false is returned. Note a junction is not read-only and user is ignored.
+func Bind(dir, local, user string) (bool, error) {
+	if Mounted(local) {
+		log.Infof("Directory %q is already a junction", local)
+		return false, nil
+	}
+	if _, err := os.Lstat(local); err == nil {
+		// An empty directory (i.e. created by hand or by a package) is replaced by the junction.
+		if err := os.Remove(local); err != nil {
+			return false, fmt.Errorf("failed to replace %q with a junction: %s", local, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0775); err != nil {
+		log.Errorf("Directory %q can not be created", filepath.Dir(local))
+		return false, fmt.Errorf("failed to create directory %q: %s", filepath.Dir(local), err)
+	}
+
+	ctx := context.TODO()
+	cmd := exec.CommandContext(ctx, "cmd", "/c", "mklink", "/J", filepath.FromSlash(local), filepath.FromSlash(dir))
+	log.Infof("running %v", cmd.Args)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return false, fmt.Errorf("failed to create junction %q: %s: %s", local, err, out)
+	}
+	return true, nil
+}
+
+// Mounted returns true if local is a junction.
+func Mounted(local string) bool {
+	_, err := os.Readlink(local)
+	return err == nil
+}
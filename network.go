@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/miekg/gitopper/gitcmd"
+)
+
+// Network restricts the servers git may contact, for environments that must show the config only comes from
+// approved servers. The host of an upstream is checked, and resolved when Nets is set, before git is run.
+type Network struct {
+	Hosts []string // Names (globs or /regexp/) of the servers git may contact, if empty all are allowed.
+	Nets  []string // IP ranges (CIDR) the servers must resolve to, if empty all are allowed.
+	Proxy string   // HTTP(S) or SOCKS proxy git uses to contact the servers.
+}
+
+// proxyNone as the proxy of a service makes git contact upstream directly, ignoring the network proxy.
+const proxyNone = "none"
+
+// validProxy checks that proxy is an HTTP(S) or SOCKS proxy URL.
+func validProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid proxy %q", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks4", "socks4a", "socks5", "socks5h":
+		return nil
+	}
+	return fmt.Errorf("proxy %q has unknown scheme %q", proxy, u.Scheme)
+}
+
+// valid checks the patterns, IP ranges and proxy in n.
+func (n *Network) valid() error {
+	if n == nil {
+		return nil
+	}
+	for _, h := range n.Hosts {
+		if _, err := matchMachine(h, ""); err != nil {
+			return fmt.Errorf("network, has invalid host pattern %q: %s", h, err)
+		}
+	}
+	for _, c := range n.Nets {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			return fmt.Errorf("network, has invalid net %q: %s", c, err)
+		}
+	}
+	if n.Proxy != "" {
+		if err := validProxy(n.Proxy); err != nil {
+			return fmt.Errorf("network, %s", err)
+		}
+	}
+	return nil
+}
+
+// allow returns an error if git may not contact host. All the addresses host resolves to must be in Nets.
+func (n *Network) allow(host string) error {
+	if len(n.Hosts) > 0 && !matchAny(n.Hosts, host) {
+		return fmt.Errorf("network policy: host %q is not allowed", host)
+	}
+	if len(n.Nets) == 0 {
+		return nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var err error
+		if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err != nil {
+			return fmt.Errorf("network policy: failed to resolve %q: %s", host, err)
+		}
+	}
+	for _, ip := range ips {
+		if !n.contains(ip) {
+			return fmt.Errorf("network policy: host %q resolves to %s, which is not allowed", host, ip)
+		}
+	}
+	return nil
+}
+
+func (n *Network) contains(ip net.IP) bool {
+	for _, c := range n.Nets {
+		if _, ipnet, err := net.ParseCIDR(c); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply makes gc honor n.
+func (n *Network) apply(gc *gitcmd.Git) {
+	if n == nil {
+		return
+	}
+	gc.Guard(n.allow)
+	if n.Proxy != "" {
+		gc.Proxy(n.Proxy)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestNetworkAllow(t *testing.T) {
+	n := &Network{Hosts: []string{"*.atoom.net", "192.0.2.10"}, Nets: []string{"192.0.2.0/24", "2001:db8::/32"}}
+	if err := n.valid(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.allow("192.0.2.10"); err != nil {
+		t.Errorf("expected 192.0.2.10 to be allowed, got: %s", err)
+	}
+	if err := n.allow("github.com"); err == nil {
+		t.Errorf("expected github.com not to be allowed")
+	}
+
+	n = &Network{Nets: []string{"192.0.2.0/24"}}
+	if err := n.allow("198.51.100.1"); err == nil {
+		t.Errorf("expected 198.51.100.1 not to be allowed")
+	}
+
+	for _, n := range []*Network{{Nets: []string{"192.0.2.0"}}, {Hosts: []string{"/[/"}}, {Proxy: "proxy"}} {
+		if err := n.valid(); err == nil {
+			t.Errorf("expected %+v to be invalid", n)
+		}
+	}
+}
+
+func TestValidProxy(t *testing.T) {
+	tests := map[string]bool{
+		"http://proxy.atoom.net:3128":      true,
+		"https://proxy.atoom.net":          true,
+		"socks5h://proxy.atoom.net:1080":   true,
+		"socks4://proxy.atoom.net:1080":    true,
+		"proxy.atoom.net:3128":             false,
+		"ftp://proxy.atoom.net":            false,
+		"http://":                          false,
+		"http://user:pw@proxy.atoom.net:1": true,
+	}
+	for p, exp := range tests {
+		if err := validProxy(p); (err == nil) != exp {
+			t.Errorf("%q: expected valid %t, got %v", p, exp, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/miekg/gitopper/proto"
+	"go.science.ru.nl/log"
+)
+
+// notify POSTs a notification with msg for this service to s.Notify. If s.Notify is empty or the machine is in
+// maintenance this is a noop.
+func (s *Service) notify(msg string) {
+	if s.Notify == "" || s.machine.Maintenance() {
+		return
+	}
+	state, info := s.State()
+	n := proto.Notification{
+		Machine:   s.Machine,
+		Service:   s.Service,
+		Hash:      s.Hash(),
+		State:     state.String(),
+		StateInfo: info,
+		Message:   msg,
+	}
+	if err := post(s.Notify, n); err != nil {
+		log.Warningf("Machine %q, failed to send notification to %q: %s", s.Machine, s.Notify, err)
+	}
+}
+
+// post POSTs v as JSON to url.
+func post(url string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c := http.Client{Timeout: 5 * time.Second}
+	resp, err := c.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
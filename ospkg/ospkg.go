@@ -0,0 +1,163 @@
+// Package ospkg talks to the package manager of the OS. Only the operations that don't change what is installed
+// are implemented: refreshing the package indexes, simulating an install and holding packages.
+package ospkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"go.science.ru.nl/log"
+)
+
+// Manager is a package manager.
+type Manager interface {
+	// Name returns the name of the package manager, i.e. "apt".
+	Name() string
+	// Update refreshes the package indexes.
+	Update() error
+	// Simulate returns what installing (or upgrading) pkg would do, without doing it.
+	Simulate(pkg string) (string, error)
+	// Hold prevents pkg from being upgraded, i.e. by unattended upgrades.
+	Hold(pkg string) error
+	// Unhold releases the hold on pkg.
+	Unhold(pkg string) error
+}
+
+// Pinner is implemented by the package managers that can pin a package to a channel.
+type Pinner interface {
+	// Pin makes pkg track channel.
+	Pin(pkg, channel string) error
+}
+
+// Versioner is implemented by the package managers that can tell which version of a package is installed.
+type Versioner interface {
+	// Version returns the installed version of pkg.
+	Version(pkg string) (string, error)
+}
+
+// ErrNotFound is returned by New when no supported package manager is found.
+var ErrNotFound = errors.New("no supported package manager found")
+
+// Lookup returns the Manager with name: apt, dnf, yum, snap or flatpak.
+func Lookup(name string) (Manager, error) {
+	switch name {
+	case "apt":
+		return apt{}, nil
+	case "dnf", "yum":
+		return dnf{name: name}, nil
+	case "snap":
+		return snap{}, nil
+	case "flatpak":
+		return flatpak{}, nil
+	}
+	return nil, fmt.Errorf("unknown package manager %q", name)
+}
+
+// New returns the Manager for the package manager found on this system.
+func New() (Manager, error) {
+	if _, err := exec.LookPath("apt-get"); err == nil {
+		return apt{}, nil
+	}
+	for _, name := range []string{"dnf", "yum"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return dnf{name: name}, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// WithEnv returns m with env (key=value) added to the environment of the commands it runs.
+func WithEnv(m Manager, env []string) Manager {
+	switch m := m.(type) {
+	case apt:
+		m.env = env
+		return m
+	case dnf:
+		m.env = env
+		return m
+	case snap:
+		m.env = env
+		return m
+	case flatpak:
+		m.env = env
+		return m
+	}
+	return m
+}
+
+func run(env []string, name string, args ...string) ([]byte, error) {
+	ctx := context.TODO()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append([]string{"DEBIAN_FRONTEND=noninteractive", "LC_ALL=C"}, env...)
+	log.Infof("running %v", cmd.Args)
+	return cmd.CombinedOutput()
+}
+
+type apt struct{ env []string }
+
+func (apt) Name() string { return "apt" }
+
+func (a apt) Update() error {
+	_, err := run(a.env, "apt-get", "update", "-q")
+	return err
+}
+
+func (a apt) Simulate(pkg string) (string, error) {
+	out, err := run(a.env, "apt-get", "install", "--simulate", "-q", pkg)
+	return string(out), err
+}
+
+func (a apt) Hold(pkg string) error {
+	_, err := run(a.env, "apt-mark", "hold", pkg)
+	return err
+}
+
+func (a apt) Unhold(pkg string) error {
+	_, err := run(a.env, "apt-mark", "unhold", pkg)
+	return err
+}
+
+func (a apt) Version(pkg string) (string, error) {
+	out, err := run(a.env, "dpkg-query", "--show", "--showformat=${Version}", pkg)
+	return strings.TrimSpace(string(out)), err
+}
+
+type dnf struct {
+	name string
+	env  []string
+}
+
+func (d dnf) Name() string { return d.name }
+
+func (d dnf) Update() error {
+	_, err := run(d.env, d.name, "makecache", "-q")
+	return err
+}
+
+// Simulate answers no to the transaction, which makes dnf exit with 1 after showing what it would do.
+func (d dnf) Simulate(pkg string) (string, error) {
+	out, err := run(d.env, d.name, "install", "--assumeno", pkg)
+	if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+		err = nil
+	}
+	return string(out), err
+}
+
+// Hold needs the versionlock plugin.
+func (d dnf) Hold(pkg string) error {
+	_, err := run(d.env, d.name, "versionlock", "add", pkg)
+	return err
+}
+
+func (d dnf) Unhold(pkg string) error {
+	_, err := run(d.env, d.name, "versionlock", "delete", pkg)
+	return err
+}
+
+func (d dnf) Version(pkg string) (string, error) {
+	out, err := run(d.env, "rpm", "--query", "--queryformat=%{VERSION}-%{RELEASE}", pkg)
+	return strings.TrimSpace(string(out)), err
+}
@@ -0,0 +1,75 @@
+package ospkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// snap manages snaps, these are refreshed by snapd itself.
+type snap struct{ env []string }
+
+func (snap) Name() string { return "snap" }
+
+// Update is a noop, snapd has no local index to refresh.
+func (snap) Update() error { return nil }
+
+// Simulate shows the channels and the tracked channel of pkg, snap has no dry-run.
+func (s snap) Simulate(pkg string) (string, error) {
+	out, err := run(s.env, "snap", "info", pkg)
+	return string(out), err
+}
+
+func (s snap) Hold(pkg string) error {
+	_, err := run(s.env, "snap", "refresh", "--hold", pkg)
+	return err
+}
+
+func (s snap) Unhold(pkg string) error {
+	_, err := run(s.env, "snap", "refresh", "--unhold", pkg)
+	return err
+}
+
+// Pin switches the channel pkg tracks, without refreshing it.
+func (s snap) Pin(pkg, channel string) error {
+	_, err := run(s.env, "snap", "switch", "--channel="+channel, pkg)
+	return err
+}
+
+func (s snap) Version(pkg string) (string, error) {
+	out, err := run(s.env, "snap", "list", pkg)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 2 {
+		return "", fmt.Errorf("no version of %q in snap list output", pkg)
+	}
+	return fields[1], nil
+}
+
+// flatpak manages flatpaks. The branch of a flatpak is part of its ref, so it can't be pinned in place.
+type flatpak struct{ env []string }
+
+func (flatpak) Name() string { return "flatpak" }
+
+func (f flatpak) Update() error {
+	_, err := run(f.env, "flatpak", "update", "--appstream", "--noninteractive")
+	return err
+}
+
+// Simulate shows what is installed for pkg.
+func (f flatpak) Simulate(pkg string) (string, error) {
+	out, err := run(f.env, "flatpak", "info", pkg)
+	return string(out), err
+}
+
+func (f flatpak) Hold(pkg string) error {
+	_, err := run(f.env, "flatpak", "mask", pkg)
+	return err
+}
+
+func (f flatpak) Unhold(pkg string) error {
+	_, err := run(f.env, "flatpak", "mask", "--remove", pkg)
+	return err
+}
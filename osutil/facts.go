@@ -0,0 +1,53 @@
+package osutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Facts returns the site specific facts of this machine as labels. Source is a JSON file holding an object, or
+// "exec:<command>" to run command and use the object it prints. A missing file isn't an error, nil is returned.
+// Strings, numbers and booleans are allowed as values.
+func Facts(source string) (map[string]string, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if strings.HasPrefix(source, "exec:") {
+		args := strings.Fields(strings.TrimPrefix(source, "exec:"))
+		if len(args) == 0 {
+			return nil, fmt.Errorf("empty facts command")
+		}
+		data, err = exec.Command(args[0], args[1:]...).Output()
+	} else {
+		data, err = os.ReadFile(source)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]any{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	facts := map[string]string{}
+	for k, v := range raw {
+		switch v := v.(type) {
+		case string:
+			facts[k] = v
+		case float64, bool:
+			facts[k] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("fact %q is not a string, number or boolean", k)
+		}
+	}
+	return facts, nil
+}
@@ -0,0 +1,12 @@
+package osutil
+
+import "os"
+
+// WriteFileAtomic writes data to a temporary file and renames it to name, so readers never see a partial file.
+func WriteFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
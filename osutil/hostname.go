@@ -0,0 +1,60 @@
+package osutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Hostname returns the hostname of this machine. The strategy determines how this is done:
+//
+//   - "" or "kernel": the kernel's hostname, or $HOSTNAME if that fails.
+//   - "short": the kernel's hostname up to the first dot.
+//   - "fqdn": the canonical name of the kernel's hostname as found in the DNS.
+//   - "file:<path>": the first line of the file <path>.
+//   - "metadata": the hostname from the cloud metadata service (GCE, EC2 or Azure).
+func Hostname(strategy string) (string, error) {
+	switch {
+	case strategy == "" || strategy == "kernel":
+		h, err := os.Hostname()
+		if err != nil {
+			h = os.Getenv("HOSTNAME")
+		}
+		return h, nil
+
+	case strategy == "short":
+		h, err := Hostname("kernel")
+		if i := strings.Index(h, "."); i > 0 {
+			h = h[:i]
+		}
+		return h, err
+
+	case strategy == "fqdn":
+		h, err := Hostname("kernel")
+		if err != nil {
+			return "", err
+		}
+		cname, err := net.LookupCNAME(h)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(cname, "."), nil
+
+	case strings.HasPrefix(strategy, "file:"):
+		data, err := os.ReadFile(strategy[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		h, _, _ := strings.Cut(string(data), "\n")
+		h = strings.TrimSpace(h)
+		if h == "" {
+			return "", fmt.Errorf("no hostname found in %q", strategy[len("file:"):])
+		}
+		return h, nil
+
+	case strategy == "metadata":
+		return metadataHostname()
+	}
+	return "", fmt.Errorf("unknown hostname strategy: %q", strategy)
+}
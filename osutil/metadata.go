@@ -0,0 +1,160 @@
+package osutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Metadata returns the identity and tags of this instance from the cloud metadata service (GCE, EC2 or Azure) as
+// labels. The identity is returned under the "instance-id" and "zone" keys, the tags (GCE: attributes) are returned
+// as is.
+func Metadata() (map[string]string, error) {
+	if labels, err := metadataGCE(); err == nil {
+		return labels, nil
+	}
+	if labels, err := metadataEC2Labels(); err == nil {
+		return labels, nil
+	}
+	if labels, err := metadataAzure(); err == nil {
+		return labels, nil
+	}
+	return nil, fmt.Errorf("no cloud metadata service found")
+}
+
+func metadataGCE() (map[string]string, error) {
+	const url = "http://metadata.google.internal/computeMetadata/v1/instance/"
+	id, err := metadata(url+"id", "Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, err
+	}
+	zone, err := metadata(url+"zone", "Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{}
+	attrs, err := metadata(url+"attributes/?recursive=true", "Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(attrs), &labels); err != nil {
+		return nil, err
+	}
+	labels["instance-id"] = id
+	labels["zone"] = zone[strings.LastIndex(zone, "/")+1:] // projects/<number>/zones/<zone>
+	return labels, nil
+}
+
+func metadataEC2Labels() (map[string]string, error) {
+	id, err := metadataEC2("instance-id")
+	if err != nil {
+		return nil, err
+	}
+	zone, err := metadataEC2("placement/availability-zone")
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{}
+	// Tags are only available when "instance metadata tags" are enabled, so an error here is not fatal.
+	if keys, err := metadataEC2("tags/instance"); err == nil {
+		for _, k := range strings.Fields(keys) {
+			v, err := metadataEC2("tags/instance/" + k)
+			if err != nil {
+				return nil, err
+			}
+			labels[k] = v
+		}
+	}
+	labels["instance-id"] = id
+	labels["zone"] = zone
+	return labels, nil
+}
+
+func metadataAzure() (map[string]string, error) {
+	data, err := metadata("http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01", "Metadata", "true")
+	if err != nil {
+		return nil, err
+	}
+	compute := struct {
+		VMID     string `json:"vmId"`
+		Zone     string `json:"zone"`
+		Location string `json:"location"`
+		TagsList []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"tagsList"`
+	}{}
+	if err := json.Unmarshal([]byte(data), &compute); err != nil {
+		return nil, err
+	}
+	labels := map[string]string{}
+	for _, t := range compute.TagsList {
+		labels[t.Name] = t.Value
+	}
+	labels["instance-id"] = compute.VMID
+	labels["zone"] = compute.Location
+	if compute.Zone != "" {
+		labels["zone"] = compute.Location + "-" + compute.Zone
+	}
+	return labels, nil
+}
+
+// metadataHostname queries the GCE, EC2 and Azure metadata services, in that order, for our hostname.
+func metadataHostname() (string, error) {
+	if h, err := metadata("http://metadata.google.internal/computeMetadata/v1/instance/hostname", "Metadata-Flavor", "Google"); err == nil {
+		return h, nil
+	}
+	if h, err := metadataEC2("local-hostname"); err == nil {
+		return h, nil
+	}
+	if h, err := metadata("http://169.254.169.254/metadata/instance/compute/name?api-version=2021-02-01&format=text", "Metadata", "true"); err == nil {
+		return h, nil
+	}
+	return "", fmt.Errorf("no cloud metadata service found")
+}
+
+// metadataEC2 fetches key from the EC2 metadata service, using a (IMDSv2) session token.
+func metadataEC2(key string) (string, error) {
+	c := http.Client{Timeout: 2 * time.Second}
+	req, err := http.NewRequest("PUT", "http://169.254.169.254/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	token, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return metadata("http://169.254.169.254/latest/meta-data/"+key, "X-aws-ec2-metadata-token", string(token))
+}
+
+// metadata does a GET on url with the header key set to value and returns the trimmed body.
+func metadata(url, key, value string) (string, error) {
+	c := http.Client{Timeout: 2 * time.Second}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(key, value)
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata %q returned %d", url, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
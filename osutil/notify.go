@@ -0,0 +1,25 @@
+package osutil
+
+import (
+	"net"
+	"os"
+)
+
+// NotifyReady tells systemd we are ready, when running as a Type=notify service. If NOTIFY_SOCKET is not
+// set this is a noop.
+func NotifyReady() error { return Notify("READY=1") }
+
+// Notify sends state (i.e. "READY=1") to systemd. If NOTIFY_SOCKET is not set this is a noop.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The phases of a reconcile, the time spent in each is exported and added to the journal.
+const (
+	phaseFetch    = "fetch"    // Contacting upstream: listing tags and refs, fetching.
+	phaseHooks    = "hooks"    // Policy, validation and signature checks.
+	phaseCheckout = "checkout" // Advancing the checkout, without the fetch.
+	phaseMount    = "mount"    // Setting up the bind mounts.
+	phaseRestart  = "restart"  // Running the action.
+	phaseProbe    = "probe"    // Waiting for the health probe.
+)
+
+// timing records the time spent in each phase of a reconcile. Git commands that contact upstream are counted as
+// fetch, whatever the phase they are run in.
+type timing struct {
+	phases map[string]time.Duration
+	phase  string // Current phase.
+	start  time.Time
+}
+
+func newTiming() *timing { return &timing{phases: map[string]time.Duration{}} }
+
+// begin ends the current phase and starts phase.
+func (t *timing) begin(phase string) {
+	t.end()
+	t.phase, t.start = phase, time.Now()
+}
+
+// end ends the current phase.
+func (t *timing) end() {
+	if t.phase != "" {
+		t.phases[t.phase] += time.Since(t.start)
+		t.phase = ""
+	}
+}
+
+// network moves d, the duration of a git command that contacted upstream, from the current phase to fetch.
+func (t *timing) network(d time.Duration) {
+	if t.phase == "" {
+		return
+	}
+	t.phases[t.phase] -= d
+	t.phases[phaseFetch] += d
+}
+
+// Phases returns a copy of the durations of the phases seen so far, the current phase is included up to now.
+func (t *timing) Phases() map[string]time.Duration {
+	if t == nil {
+		return nil
+	}
+	p := make(map[string]time.Duration, len(t.phases)+1)
+	for k, v := range t.phases {
+		p[k] = v
+	}
+	if t.phase != "" {
+		p[t.phase] += time.Since(t.start)
+	}
+	return p
+}
+
+// begin starts phase in the timing of the current reconcile of s, if any.
+func (s *Service) begin(phase string) {
+	if s.timing != nil {
+		s.timing.begin(phase)
+	}
+}
+
+// timed starts timing the phases of a reconcile, the returned function ends it and exports the durations. When
+// already timing, i.e. for a rollback in a reconcile, the phases are added to that.
+func (s *Service) timed() func() {
+	if s.timing != nil {
+		return func() {}
+	}
+	s.timing = newTiming()
+	return func() {
+		s.timing.end()
+		for phase, d := range s.timing.phases {
+			metricServicePhase.WithLabelValues(s.Service, phase).(prometheus.ExemplarObserver).ObserveWithExemplar(
+				d.Seconds(), s.exemplar(s.Hash()),
+			)
+		}
+		s.timing = nil
+	}
+}
+
+// phases returns the durations in p as strings, for the journal listing.
+func phases(p map[string]time.Duration) map[string]string {
+	if len(p) == 0 {
+		return nil
+	}
+	s := make(map[string]string, len(p))
+	for k, v := range p {
+		s[k] = v.Round(time.Millisecond).String()
+	}
+	return s
+}
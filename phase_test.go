@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTiming(t *testing.T) {
+	tm := newTiming()
+	tm.network(time.Second) // not in a phase, ignored
+	tm.begin(phaseHooks)
+	time.Sleep(10 * time.Millisecond)
+	tm.begin(phaseCheckout)
+	time.Sleep(20 * time.Millisecond)
+	tm.network(15 * time.Millisecond)
+	tm.end()
+
+	p := tm.Phases()
+	if len(p) != 3 {
+		t.Fatalf("Expected 3 phases, got %v", p)
+	}
+	if p[phaseFetch] != 15*time.Millisecond {
+		t.Errorf("Expected fetch to be %s, got %s", 15*time.Millisecond, p[phaseFetch])
+	}
+	if p[phaseHooks] < 10*time.Millisecond {
+		t.Errorf("Expected hooks to be at least %s, got %s", 10*time.Millisecond, p[phaseHooks])
+	}
+	if c := p[phaseCheckout]; c < 5*time.Millisecond || c >= 20*time.Millisecond {
+		t.Errorf("Expected checkout without the fetch, got %s", c)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/gitopper/ospkg"
+	"go.science.ru.nl/log"
+)
+
+// pkg returns the package manager of the service: the one named in PackageManager or the one of the machine. It
+// returns nil if there is none, or the service has no package.
+func (s *Service) pkg() ospkg.Manager {
+	if s.Package == "" {
+		return nil
+	}
+	if s.PackageManager != "" {
+		pm, _ := ospkg.Lookup(s.PackageManager) // validated in the config
+		return ospkg.WithEnv(pm, s.envs())
+	}
+	if s.machine == nil || s.machine.Pkg == nil {
+		return nil
+	}
+	return ospkg.WithEnv(s.machine.Pkg, s.envs())
+}
+
+// simulate logs what installing the package of the service would do. Gitopper doesn't install packages (yet), this
+// is a dry-run. If the service has a channel and the package manager supports it, the package is pinned to it.
+func (s *Service) simulate() {
+	pm := s.pkg()
+	if pm == nil {
+		return
+	}
+	if p, ok := pm.(ospkg.Pinner); ok && s.Channel != "" {
+		if err := p.Pin(s.Package, s.Channel); err != nil {
+			log.Warningf("Machine %q, failed to pin package %q to channel %q: %s", s.Machine, s.Package, s.Channel, err)
+		}
+	}
+	out, err := pm.Simulate(s.Package)
+	if err != nil {
+		log.Warningf("Machine %q, failed to simulate install of package %q: %s", s.Machine, s.Package, err)
+		return
+	}
+	log.Infof("Machine %q, installing package %q would do:\n%s", s.Machine, s.Package, out)
+}
+
+// updatePackages refreshes the package indexes every d, until ctx is canceled.
+func updatePackages(ctx context.Context, pm ospkg.Manager, d time.Duration) {
+	for {
+		if err := pm.Update(); err != nil {
+			log.Warningf("Failed to update %s package indexes: %s", pm.Name(), err)
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// holdPackage holds the package of the service when it goes from prev into a frozen state, and releases it when
+// it leaves it.
+func (s *Service) holdPackage(prev, st State) {
+	pm := s.pkg()
+	if pm == nil {
+		return
+	}
+	frozen := func(st State) bool { return st == StateFreeze || st == StateRollback }
+	var err error
+	switch {
+	case !frozen(prev) && frozen(st):
+		log.Infof("Machine %q, holding package %q of service %q", s.Machine, s.Package, s.Service)
+		err = pm.Hold(s.Package)
+	case frozen(prev) && !frozen(st):
+		log.Infof("Machine %q, releasing package %q of service %q", s.Machine, s.Package, s.Service)
+		err = pm.Unhold(s.Package)
+	}
+	if err != nil {
+		log.Warningf("Machine %q, failed to (un)hold package %q: %s", s.Machine, s.Package, err)
+	}
+}
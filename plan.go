@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/miekg/gitopper/mount"
+	"github.com/miekg/gitopper/ospkg"
+)
+
+// plan writes what gitopper would do for the services the hosts (with labels) pick up to w. Nothing on the system
+// is changed: packages are simulated and upstream is only queried with ls-remote.
+func plan(w io.Writer, c Config, hosts []string, labels map[string]string, pm ospkg.Manager) error {
+	for _, s := range c.Services {
+		if !s.forMe(hosts, labels) {
+			continue
+		}
+		s = s.merge(c.Global, 0)
+		fmt.Fprintf(w, "Service %q, machine %q:\n", s.Service, s.Machine)
+		if !s.IsEnabled() {
+			fmt.Fprintf(w, "\tis disabled, would do nothing\n")
+			continue
+		}
+
+		if s.Package != "" {
+			pm := pm
+			if s.PackageManager != "" {
+				pm, _ = ospkg.Lookup(s.PackageManager)
+			}
+			if pm == nil {
+				fmt.Fprintf(w, "\tno package manager for package %q\n", s.Package)
+			} else if out, err := pm.Simulate(s.Package); err != nil {
+				fmt.Fprintf(w, "\tfailed to simulate install of package %q: %s\n", s.Package, err)
+			} else {
+				fmt.Fprintf(w, "\tinstalling package %q would do:\n%s", s.Package, indent(out, "\t\t"))
+			}
+		}
+
+		// act is true when the action would run, i.e. after a checkout, a pull or a new mount.
+		act := false
+		gc := s.newGitCmd()
+		if !gc.IsCheckedOut() {
+			fmt.Fprintf(w, "\twould clone %q (branch %q) in %q\n", s.Upstream, s.Branch, gc.Repo())
+			act = true
+		} else {
+			local := gc.Hash()
+			var err error
+			if s.Tag != "" {
+				var tag string
+				if tag, err = s.track(gc); err == nil && tag == "" {
+					err = fmt.Errorf("no tag matches %q", s.Tag)
+				}
+			}
+			remote := ""
+			if err == nil {
+				remote, err = gc.Remote()
+			}
+			switch {
+			case err != nil:
+				fmt.Fprintf(w, "\tfailed to query upstream %q: %s\n", s.Upstream, err)
+			case remote != local:
+				fmt.Fprintf(w, "\twould pull %q in %q from %s to %s\n", s.Upstream, gc.Repo(), local, remote)
+				act = true
+			default:
+				fmt.Fprintf(w, "\t%q is up to date at %s\n", gc.Repo(), local)
+			}
+		}
+
+		for _, d := range s.Dirs {
+			if mount.Mounted(d.Local) {
+				fmt.Fprintf(w, "\t%q is already mounted\n", d.Local)
+				continue
+			}
+			fmt.Fprintf(w, "\twould bind mount %q on %q\n", path.Join(s.Mount, s.Service, d.Link), d.Local)
+			act = true
+		}
+
+		if s.Action != "" && act {
+			fmt.Fprintf(w, "\twould %s\n", s.describeAction())
+		}
+	}
+	return nil
+}
+
+// describeAction returns what running the action of s does, for humans.
+func (s *Service) describeAction() string {
+	steps := []string{}
+	if s.Requirements != "" {
+		steps = append(steps, fmt.Sprintf("install %q in virtualenv %q", s.Requirements, s.venv()))
+	}
+	if s.Build != "" {
+		steps = append(steps, fmt.Sprintf("build with %q and install %q", s.Build, s.Install))
+	}
+	if s.Manifest != "" {
+		steps = append(steps, fmt.Sprintf("download the binary in %q to %q", s.Manifest, s.Install))
+	}
+	switch fw, ruleset, ok := firewallAction(s.Action); {
+	case ok:
+		steps = append(steps, fmt.Sprintf("apply %s ruleset %q", fw.name, ruleset))
+	case strings.HasPrefix(s.Action, zonePrefix):
+		steps = append(steps, fmt.Sprintf("check and reload zones with %s", strings.TrimPrefix(s.Action, zonePrefix)))
+	case strings.HasPrefix(s.Action, execPrefix):
+		steps = append(steps, fmt.Sprintf("run plugin %q", strings.TrimPrefix(s.Action, execPrefix)))
+	default:
+		steps = append(steps, fmt.Sprintf("run systemctl %s %s", s.Action, s.Service))
+	}
+	return strings.Join(steps, ", then ")
+}
+
+func indent(s, prefix string) string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return ""
+	}
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix) + "\n"
+}
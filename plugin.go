@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/sandbox"
+	"go.science.ru.nl/log"
+)
+
+// execPrefix marks an action that is an external plugin instead of a systemctl verb.
+const execPrefix = "exec:"
+
+// Apply is handed to an action plugin on standard input.
+type Apply struct {
+	Machine  string   `json:"machine"`
+	Service  string   `json:"service"`
+	Hash     string   `json:"hash"`
+	Previous string   `json:"previous"`
+	Repo     string   `json:"repo"`
+	Dirs     []string `json:"dirs"` // The local directories that are bind mounted from the repo.
+}
+
+// plugin runs the action plugin command with an Apply as JSON on standard input. A non-zero exit status is
+// an error, the output of the command is then part of the error.
+func (s *Service) plugin(command string) error {
+	s.RLock()
+	a := Apply{Machine: s.Machine, Service: s.Service, Hash: s.st.Hash, Previous: s.st.PrevHash, Repo: s.Mount}
+	s.RUnlock()
+	for _, d := range s.Dirs {
+		a.Dirs = append(a.Dirs, d.Local)
+	}
+	out, err := runJSON(command, a, nil, s.environ())
+	if err != nil {
+		return fmt.Errorf("plugin %q: %s: %s", command, err, out)
+	}
+	return nil
+}
+
+// runJSON runs command with /bin/sh -c and v marshalled as JSON on standard input. The combined output is
+// returned with leading and trailing white space removed. If o isn't nil the command runs in that sandbox. The
+// command's environment is env.
+func runJSON(command string, v any, o *sandbox.Options, env []string) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	if o != nil {
+		cmd = sandbox.Command(ctx, *o, "/bin/sh", "-c", command)
+	}
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(data)
+	log.Infof("running %v", cmd.Args)
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
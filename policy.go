@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/miekg/gitopper/gitcmd"
+)
+
+// policyDenied prefixes the StateInfo of a service whose candidate commit was denied by its policy.
+const policyDenied = "DENIED "
+
+// Candidate is the commit that is handed to the policy command on standard input.
+type Candidate struct {
+	Machine string   `json:"machine"`
+	Service string   `json:"service"`
+	Hash    string   `json:"hash"`
+	Current string   `json:"current"`
+	Author  string   `json:"author"`
+	Paths   []string `json:"paths"`
+}
+
+// policy runs s.Policy with the candidate commit hash, which must have been fetched, as JSON on standard input. An
+// exit status of zero allows the commit, anything else denies it; the first line of the output is used as the
+// reason. If the upstream has nothing new, the commit is allowed without running the policy.
+func (s *Service) policy(gc *gitcmd.Git, hash string) (allow bool, reason string, err error) {
+	if hash == s.Hash() {
+		return true, "", nil
+	}
+	author, paths, err := gc.Commit(hash)
+	if err != nil {
+		return false, "", err
+	}
+	reason, err = runJSON(s.Policy, Candidate{
+		Machine: s.Machine,
+		Service: s.Service,
+		Hash:    hash,
+		Current: s.Hash(),
+		Author:  author,
+		Paths:   paths,
+	}, s.hook(), s.environ())
+	if i := strings.IndexByte(reason, '\n'); i > 0 {
+		reason = reason[:i]
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		if reason == "" {
+			reason = err.Error()
+		}
+		return false, reason, nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("policy %q: %s", s.Policy, err)
+	}
+	return true, reason, nil
+}
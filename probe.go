@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/systemd"
+	"go.science.ru.nl/log"
+)
+
+// probeTimeout is how long a probe is retried after a restart before the service is considered unhealthy.
+const probeTimeout = time.Minute
+
+// probeOnce runs the health probe of s once: an http(s) URL must reply with a 2xx status, otherwise it's a
+// command run with /bin/sh -c that must exit with status zero.
+func (s *Service) probeOnce() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if strings.HasPrefix(s.Probe, "http://") || strings.HasPrefix(s.Probe, "https://") {
+		req, err := http.NewRequestWithContext(ctx, "GET", s.Probe, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("probe %q: %s", s.Probe, resp.Status)
+		}
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.Probe)
+	cmd.Env = s.environ()
+	log.Debugf("running %v", cmd.Args)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("probe %q: %s: %s", s.Probe, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// probe runs the health probe of s until it passes or timeout has passed, the last error is then returned. If
+// s.Probe is empty this is a noop.
+func (s *Service) probe(timeout time.Duration) error {
+	if s.Probe == "" {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := s.probeOnce()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// restart restarts the unit of s and waits for its health probe to pass.
+func (s *Service) restart() error {
+	if err := systemd.Systemctl("restart", s.Service, s.environ()...); err != nil {
+		return err
+	}
+	if err := s.probe(probeTimeout); err != nil {
+		log.Warningf("Machine %q, service %q is unhealthy after restart: %s", s.Machine, s.Service, err)
+		return err
+	}
+	log.Infof("Machine %q, service %q restarted", s.Machine, s.Service)
+	return nil
+}
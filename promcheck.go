@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	amconfig "github.com/prometheus/alertmanager/config"
+	"github.com/prometheus/prometheus/model/rulefmt"
+)
+
+// validators are the built-in validators, selected with validate = "<name>:<glob>". The glob is relative to the
+// staged tree.
+var validators = map[string]func(file string) error{
+	"promrules":    checkRules,
+	"alertmanager": checkAlertmanager,
+}
+
+// validator returns the built-in validator and glob in validate, or false if validate is a command.
+func validator(validate string) (func(string) error, string, bool) {
+	name, glob, ok := strings.Cut(validate, ":")
+	if !ok {
+		return nil, "", false
+	}
+	fn, ok := validators[name]
+	return fn, glob, ok
+}
+
+// checkFiles runs fn on all files in dir matching glob. The returned string holds the validation errors, if any.
+func checkFiles(fn func(string) error, dir, glob string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, glob))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return fmt.Sprintf("no files match %q", glob), nil
+	}
+	errs := []string{}
+	for _, f := range files {
+		if err := fn(f); err != nil {
+			rel, _ := filepath.Rel(dir, f)
+			errs = append(errs, fmt.Sprintf("%s: %s", rel, err))
+		}
+	}
+	return strings.Join(errs, "\n"), nil
+}
+
+// checkRules checks a Prometheus rules file, like promtool check rules.
+func checkRules(file string) error {
+	if _, errs := rulefmt.ParseFile(file); len(errs) > 0 {
+		s := make([]string, len(errs))
+		for i := range errs {
+			s[i] = errs[i].Error()
+		}
+		return fmt.Errorf("%s", strings.Join(s, "; "))
+	}
+	return nil
+}
+
+// checkAlertmanager checks an Alertmanager config, like amtool check-config.
+func checkAlertmanager(file string) error {
+	_, err := amconfig.LoadFile(file)
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRules(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "good.rules.yml"), []byte(`groups:
+  - name: example
+    rules:
+      - alert: HighErrorRate
+        expr: rate(errors_total[5m]) > 0.5
+        for: 10m
+`), 0644)
+	fn, glob, ok := validator("promrules:*.rules.yml")
+	if !ok {
+		t.Fatal("expected promrules to be a built-in validator")
+	}
+	if reason, err := checkFiles(fn, dir, glob); err != nil || reason != "" {
+		t.Errorf("expected rules to be valid, got %q: %v", reason, err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "bad.rules.yml"), []byte(`groups:
+  - name: example
+    rules:
+      - alert: HighErrorRate
+        expr: rate(errors_total[5m] > 0.5
+`), 0644)
+	reason, err := checkFiles(fn, dir, glob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(reason, "bad.rules.yml: ") {
+		t.Errorf("expected bad.rules.yml to be invalid, got %q", reason)
+	}
+
+	if _, _, ok := validator("nginx -t -c nginx.conf"); ok {
+		t.Errorf("expected command not to be a built-in validator")
+	}
+}
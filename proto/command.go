@@ -0,0 +1,177 @@
+package proto
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Command is a state change in its text form, as used in the control file and by gitopperctl:
+//
+//	[@<machine>] <verb> [--<flag>[=<value>]...] [<target>...]
+//
+// For service verbs the first target is a comma separated list of services (more services may follow as separate
+// targets, except for rollback which takes a single service and the revision to roll back to). Machine verbs take
+// no services, only their own arguments.
+type Command struct {
+	Machine  string            // Machine without the @, empty for any machine.
+	Verb     string            // Verb, e.g. freeze.
+	Flags    map[string]string // Flags without the --, boolean flags have the value "true".
+	Services []string          // Services the command applies to.
+	Args     []string          // Extra arguments, i.e. the revision for rollback, on or off for maintenance.
+}
+
+// verb describes the syntax of a verb.
+type verb struct {
+	machine bool            // Applies to the machine instead of services.
+	args    int             // Number of arguments after the services.
+	flags   map[string]bool // Allowed flags, true if the flag takes a value.
+}
+
+var verbs = map[string]verb{
+	"freeze":      {},
+	"unfreeze":    {},
+	"enable":      {},
+	"reset":       {},
+	"restart":     {},
+	"disable":     {flags: map[string]bool{"stop": false}},
+	"rollback":    {args: 1},
+	"approve":     {args: 1},
+	"promote":     {machine: true},
+	"override":    {machine: true, flags: map[string]bool{"ttl": true}},
+	"maintenance": {machine: true, args: 1, flags: map[string]bool{"ttl": true}},
+}
+
+// ParseCommand parses the (whitespace separated) fields of a command. Flags may be given anywhere after the verb.
+func ParseCommand(fields []string) (Command, error) {
+	c := Command{Flags: map[string]string{}}
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		c.Machine = fields[0][1:]
+		if c.Machine == "" {
+			return c, fmt.Errorf("empty machine")
+		}
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return c, fmt.Errorf("need verb")
+	}
+	c.Verb = fields[0]
+	v, ok := verbs[c.Verb]
+	if !ok {
+		return c, fmt.Errorf("unknown verb: %q", c.Verb)
+	}
+
+	targets := []string{}
+	for _, f := range fields[1:] {
+		if !strings.HasPrefix(f, "--") {
+			targets = append(targets, f)
+			continue
+		}
+		name, value, hasValue := strings.Cut(f[2:], "=")
+		takesValue, ok := v.flags[name]
+		if !ok {
+			return c, fmt.Errorf("unknown flag for %s: %q", c.Verb, name)
+		}
+		switch {
+		case takesValue && !hasValue:
+			return c, fmt.Errorf("flag %q needs a value", name)
+		case !takesValue && !hasValue:
+			value = "true"
+		case !takesValue && value != "true" && value != "false":
+			return c, fmt.Errorf("flag %q is boolean: %q", name, value)
+		}
+		if name == "ttl" {
+			if _, err := time.ParseDuration(value); err != nil {
+				return c, fmt.Errorf("flag %q: %s", name, err)
+			}
+		}
+		c.Flags[name] = value
+	}
+
+	if v.machine {
+		if len(targets) != v.args {
+			return c, fmt.Errorf("%s takes %d argument(s), got %d", c.Verb, v.args, len(targets))
+		}
+		c.Args = targets
+		if c.Verb == "maintenance" && c.Args[0] != "on" && c.Args[0] != "off" {
+			return c, fmt.Errorf("expected on or off, got %q", c.Args[0])
+		}
+		return c, nil
+	}
+
+	if len(targets) < 1+v.args {
+		if len(targets) == 0 {
+			return c, fmt.Errorf("need service")
+		}
+		return c, fmt.Errorf("%s needs a hash, tag or ref", c.Verb)
+	}
+	if v.args > 0 && len(targets) != 1+v.args {
+		return c, fmt.Errorf("%s takes a single service", c.Verb)
+	}
+	c.Args = targets[len(targets)-v.args:]
+	for _, t := range targets[:len(targets)-v.args] {
+		for _, s := range strings.Split(t, ",") {
+			if s == "" {
+				return c, fmt.Errorf("empty service in %q", t)
+			}
+			c.Services = append(c.Services, s)
+		}
+	}
+	if v.args > 0 && len(c.Services) != 1 {
+		return c, fmt.Errorf("%s takes a single service", c.Verb)
+	}
+	return c, nil
+}
+
+// Path returns the path, with query parameters, of the REST call that executes c. It has no leading slash.
+func (c Command) Path() string {
+	var path string
+	switch c.Verb {
+	case "restart":
+		path = "service/restart/" + strings.Join(c.Services, ",")
+	case "rollback", "approve":
+		path = "state/" + c.Verb + "/" + c.Services[0] + "/" + url.PathEscape(c.Args[0])
+	case "promote", "override":
+		path = "machine/" + c.Verb
+	case "maintenance":
+		path = "machine/maintenance/" + c.Args[0]
+	default:
+		path = "state/" + c.Verb + "/" + strings.Join(c.Services, ",")
+	}
+	if len(c.Flags) == 0 {
+		return path
+	}
+	q := url.Values{}
+	for k, v := range c.Flags {
+		q.Set(k, v)
+	}
+	return path + "?" + q.Encode()
+}
+
+// String returns c in its canonical text form.
+func (c Command) String() string {
+	s := []string{}
+	if c.Machine != "" {
+		s = append(s, "@"+c.Machine)
+	}
+	s = append(s, c.Verb)
+	flags := make([]string, 0, len(c.Flags))
+	for k, v := range c.Flags {
+		if v == "true" && !verbs[c.Verb].flags[k] {
+			flags = append(flags, "--"+k)
+			continue
+		}
+		flags = append(flags, "--"+k+"="+v)
+	}
+	sort.Strings(flags)
+	s = append(s, flags...)
+	if len(c.Services) > 0 {
+		s = append(s, strings.Join(c.Services, ","))
+	}
+	return strings.Join(append(s, c.Args...), " ")
+}
+
+// IsMachine reports whether c applies to a machine instead of services.
+func (c Command) IsMachine() bool { return verbs[c.Verb].machine }
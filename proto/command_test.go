@@ -0,0 +1,60 @@
+package proto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		path string
+		err  bool
+	}{
+		{"freeze a", "state/freeze/a", false},
+		{"@m freeze a,b c", "state/freeze/a,b,c", false},
+		{"disable --stop a", "state/disable/a?stop=true", false},
+		{"disable a --stop=false", "state/disable/a?stop=false", false},
+		{"rollback a HEAD~1", "state/rollback/a/HEAD~1", false},
+		{"rollback a refs/tags/v1", "state/rollback/a/refs%2Ftags%2Fv1", false},
+		{"approve a 8df1b3d", "state/approve/a/8df1b3d", false},
+		{"restart a", "service/restart/a", false},
+		{"@m maintenance --ttl=1h on", "machine/maintenance/on?ttl=1h", false},
+		{"@m promote", "machine/promote", false},
+		{"freeze", "", true},
+		{"@ freeze a", "", true},
+		{"thaw a", "", true},
+		{"freeze --stop a", "", true},
+		{"disable --stop=yes a", "", true},
+		{"rollback a", "", true},
+		{"rollback a,b HEAD", "", true},
+		{"rollback a b HEAD", "", true},
+		{"approve a", "", true},
+		{"freeze a,,b", "", true},
+		{"maintenance --ttl on", "", true},
+		{"maintenance --ttl=soon on", "", true},
+		{"maintenance maybe", "", true},
+		{"promote a", "", true},
+	}
+	for _, tc := range tests {
+		c, err := ParseCommand(strings.Fields(tc.in))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", tc.in, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.in, err)
+			continue
+		}
+		if p := c.Path(); p != tc.path {
+			t.Errorf("%q: expected path %q, got %q", tc.in, tc.path, p)
+		}
+		// The canonical form must parse to the same command.
+		c1, err := ParseCommand(strings.Fields(c.String()))
+		if err != nil || c1.String() != c.String() {
+			t.Errorf("%q: canonical form %q doesn't round trip: %v", tc.in, c, err)
+		}
+	}
+}
@@ -7,8 +7,11 @@ type (
 	}
 
 	ListMachine struct {
-		Machine string `json:"machine"` // Machine as set in config file.
-		Actual  string `json:"actual"`  // Actual machine responding (i.e. -h flag might be used)
+		Machine     string            `json:"machine"`         // Machine as set in config file.
+		Actual      string            `json:"actual"`          // Actual machine responding (i.e. -h flag might be used)
+		Skew        string            `json:"skew"`            // Estimated clock skew of the actual machine.
+		Maintenance bool              `json:"maintenance"`     // The actual machine is in maintenance.
+		Facts       map[string]string `json:"facts,omitempty"` // Facts of the actual machine.
 	}
 
 	ListServices struct {
@@ -21,5 +24,72 @@ type (
 		State       string `json:"state"`
 		StateInfo   string `json:"stateinfo"`
 		StateChange string `json:"change"`
+		Upstream    string `json:"upstream,omitempty"` // Upstream, or mirror, in use.
+	}
+
+	ListJournal struct {
+		ListJournal []JournalEntry `json:"journal"`
+	}
+
+	JournalEntry struct {
+		Service  string            `json:"service"`
+		From     string            `json:"from"`
+		To       string            `json:"to"`
+		Summary  string            `json:"summary,omitempty"` // Files changed, insertions, deletions and commit subjects.
+		Start    string            `json:"start"`
+		Duration string            `json:"duration"`
+		Result   string            `json:"result"`
+		Operator bool              `json:"operator"` // Operator initiated, otherwise automatic.
+		Upstream string            `json:"upstream,omitempty"`
+		Signer   string            `json:"signer,omitempty"`
+		Package  string            `json:"package,omitempty"`
+		Version  string            `json:"version,omitempty"`
+		Phases   map[string]string `json:"phases,omitempty"` // Time spent in each phase (fetch, hooks, checkout, mount, restart, probe).
+	}
+
+	StateResults struct {
+		StateResults []StateResult `json:"results"`
+	}
+
+	StateResult struct {
+		Service string `json:"service"`
+		Result  string `json:"result"` // OK or Not Found
+	}
+
+	// RollbackResult is the reply to a rollback.
+	RollbackResult struct {
+		Service  string `json:"service"`
+		Hash     string `json:"hash"`     // The commit rolled back to, the full hash if it was found.
+		Deployed string `json:"deployed"` // The hash deployed after the rollback.
+		Result   string `json:"result"`   // OK, or why the rollback failed.
+	}
+
+	// Complete holds the names used for command-line completion.
+	Complete struct {
+		Machines []string `json:"machines"`
+		Services []string `json:"services"`
+	}
+
+	// Notification is POSTed to the notify URL of a service.
+	Notification struct {
+		Machine   string `json:"machine"`
+		Service   string `json:"service"`
+		Hash      string `json:"hash"`
+		State     string `json:"state"`
+		StateInfo string `json:"stateinfo"`
+		Message   string `json:"message"`
+	}
+
+	// Provenance is POSTed to the attest URL of a service after each apply.
+	Provenance struct {
+		Machine  string `json:"machine"`
+		Service  string `json:"service"`
+		Upstream string `json:"upstream"`
+		Commit   string `json:"commit"`
+		Signer   string `json:"signer"` // Empty if the commit isn't signed.
+		Package  string `json:"package,omitempty"`
+		Version  string `json:"version,omitempty"`
+		Applied  string `json:"applied"` // RFC 3339.
+		Result   string `json:"result"`
 	}
 )
@@ -0,0 +1,238 @@
+// Package reconcile drives reconciles: a Scheduler keeps a queue ordered on when each Task is due and hands the
+// tasks that are due to a bounded pool of workers. Tasks that are due at the same time are handed out in the order
+// they were added. A Task is never reconciled concurrently with itself.
+package reconcile
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"go.science.ru.nl/log"
+)
+
+// Task is something that is reconciled by the Scheduler.
+type Task interface {
+	// Reconcile reconciles the task once, it is never called concurrently for the same task.
+	Reconcile()
+	// Next returns when the task should be reconciled next, now is when the last reconcile finished.
+	Next(now time.Time) time.Time
+}
+
+// Scheduler reconciles tasks when they are due.
+type Scheduler struct {
+	entries    map[Task]*entry
+	queue      queue
+	wake       chan Task
+	kick       chan struct{} // Tells Run the queue has changed.
+	seq        uint64        // Sequence number of the next added task.
+	sync.Mutex               // Protects entries, queue and seq.
+}
+
+// entry is a task as tracked by the scheduler.
+type entry struct {
+	t       Task
+	next    time.Time     // When to reconcile next.
+	running bool          // True if a worker has the task.
+	again   bool          // Reconcile again as soon as the worker is done.
+	removed bool          // Removed while running, don't queue it again.
+	done    chan struct{} // If not nil, closed when the worker is done, Remove waits on it.
+	seq     uint64        // Order in which the task was added.
+	index   int           // Index in the queue.
+}
+
+// New returns a new, empty, scheduler.
+func New() *Scheduler {
+	return &Scheduler{entries: map[Task]*entry{}, wake: make(chan Task, 64), kick: make(chan struct{}, 1)}
+}
+
+// Add adds t to the scheduler, it is first reconciled at next.
+func (sc *Scheduler) Add(t Task, next time.Time) {
+	e := &entry{t: t, next: next}
+	sc.Lock()
+	e.seq = sc.seq
+	sc.seq++
+	sc.entries[t] = e
+	heap.Push(&sc.queue, e)
+	sc.Unlock()
+	sc.changed()
+}
+
+// Remove removes t from the scheduler. If t is being reconciled Remove waits until that is finished, so anything
+// started in its place doesn't race with it.
+func (sc *Scheduler) Remove(t Task) {
+	sc.Lock()
+	e, ok := sc.entries[t]
+	if !ok {
+		sc.Unlock()
+		return
+	}
+	delete(sc.entries, t)
+	if !e.running {
+		heap.Remove(&sc.queue, e.index)
+		sc.Unlock()
+		return
+	}
+	e.removed = true
+	if e.done == nil {
+		e.done = make(chan struct{})
+	}
+	done := e.done
+	sc.Unlock()
+	<-done
+}
+
+// Wakeup makes the scheduler reconcile t as soon as possible.
+func (sc *Scheduler) Wakeup(t Task) {
+	select {
+	case sc.wake <- t:
+	default: // plenty pending
+	}
+}
+
+// WakeupAll makes the scheduler reconcile all tasks as soon as possible.
+func (sc *Scheduler) WakeupAll() {
+	sc.Lock()
+	for _, e := range sc.entries {
+		sc.now(e)
+	}
+	sc.Unlock()
+	sc.changed()
+}
+
+func (sc *Scheduler) changed() {
+	select {
+	case sc.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs the scheduler with the given number of workers, until ctx is canceled.
+func (sc *Scheduler) Run(ctx context.Context, workers int) {
+	log.Infof("Launched scheduler with %d workers", workers)
+
+	// We never have more than workers tasks in flight, so sending on jobs never blocks.
+	jobs := make(chan *entry, workers)
+	done := make(chan *entry)
+	inflight := 0
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				if ctx.Err() == nil {
+					e.t.Reconcile()
+				}
+				done <- e
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		go func() {
+			for e := range done {
+				sc.finish(e)
+			}
+		}()
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		var due <-chan time.Time
+		sc.Lock()
+		if sc.queue.Len() > 0 && inflight < workers {
+			due = time.After(time.Until(sc.queue[0].next))
+		}
+		sc.Unlock()
+
+		select {
+		case <-due:
+			now := time.Now()
+			sc.Lock()
+			for sc.queue.Len() > 0 && !sc.queue[0].next.After(now) && inflight < workers {
+				e := heap.Pop(&sc.queue).(*entry)
+				e.running = true
+				inflight++
+				jobs <- e
+			}
+			sc.Unlock()
+		case e := <-done:
+			inflight--
+			sc.finish(e)
+		case t := <-sc.wake:
+			sc.Lock()
+			sc.now(sc.entries[t])
+			sc.Unlock()
+		case <-sc.kick:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// finish queues e again now that its worker is done, unless it was removed.
+func (sc *Scheduler) finish(e *entry) {
+	sc.Lock()
+	defer sc.Unlock()
+	e.running = false
+	if e.done != nil {
+		close(e.done)
+		e.done = nil
+	}
+	if e.removed {
+		return
+	}
+	e.next = e.t.Next(time.Now())
+	if e.again {
+		e.again = false
+		e.next = time.Now()
+	}
+	heap.Push(&sc.queue, e)
+}
+
+// now makes e due now, if e is running it is run again when done. The lock must be held.
+func (sc *Scheduler) now(e *entry) {
+	if e == nil {
+		return
+	}
+	if e.running {
+		e.again = true
+		return
+	}
+	e.next = time.Now()
+	heap.Fix(&sc.queue, e.index)
+}
+
+// queue is a heap of entries, ordered on when they are due, and then on when they were added.
+type queue []*entry
+
+func (q queue) Len() int { return len(q) }
+func (q queue) Less(i, j int) bool {
+	if q[i].next.Equal(q[j].next) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].next.Before(q[j].next)
+}
+func (q queue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *queue) Push(x any) {
+	e := x.(*entry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *queue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	e.index = -1
+	return e
+}
@@ -0,0 +1,114 @@
+package reconcile
+
+import (
+	"container/heap"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// task counts its reconciles, and blocks in them until release is closed, if set.
+type task struct {
+	n       atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (t *task) Reconcile() {
+	t.n.Add(1)
+	if t.release != nil {
+		close(t.started)
+		<-t.release
+	}
+}
+
+func (t *task) Next(now time.Time) time.Time { return now.Add(time.Hour) }
+
+func TestQueue(t *testing.T) {
+	now := time.Now()
+	var q queue
+	for _, d := range []time.Duration{3, 1, 2} {
+		heap.Push(&q, &entry{t: &task{}, next: now.Add(d * time.Second)})
+	}
+
+	// Make the last one due now.
+	q[2].next = now
+	heap.Fix(&q, 2)
+
+	prev := time.Time{}
+	for q.Len() > 0 {
+		e := heap.Pop(&q).(*entry)
+		if e.next.Before(prev) {
+			t.Errorf("expected entries in order, got %s before %s", prev, e.next)
+		}
+		if e.index != -1 {
+			t.Errorf("expected index -1 after pop, got %d", e.index)
+		}
+		prev = e.next
+	}
+}
+
+func TestQueueAdded(t *testing.T) {
+	now := time.Now()
+	var q queue
+	for i := 0; i < 10; i++ {
+		heap.Push(&q, &entry{t: &task{}, next: now, seq: uint64(i)})
+	}
+	for i := 0; q.Len() > 0; i++ {
+		if e := heap.Pop(&q).(*entry); e.seq != uint64(i) {
+			t.Errorf("expected entry %d, got %d", i, e.seq)
+		}
+	}
+}
+
+func TestWakeup(t *testing.T) {
+	sc := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sc.Run(ctx, 2)
+
+	tk := &task{}
+	sc.Add(tk, time.Now().Add(time.Hour))
+	sc.Wakeup(tk)
+	for i := 0; i < 100 && tk.n.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := tk.n.Load(); n != 1 {
+		t.Errorf("expected 1 reconcile after wakeup, got %d", n)
+	}
+}
+
+func TestRemoveWaits(t *testing.T) {
+	sc := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sc.Run(ctx, 1)
+
+	tk := &task{started: make(chan struct{}), release: make(chan struct{})}
+	sc.Add(tk, time.Now())
+	<-tk.started
+
+	removed := make(chan struct{})
+	go func() {
+		sc.Remove(tk)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+		t.Fatal("expected remove to wait for the running task")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(tk.release)
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("expected remove to return after the task is done")
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	if _, ok := sc.entries[tk]; ok || sc.queue.Len() != 0 {
+		t.Error("expected task to be removed")
+	}
+}
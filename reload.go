@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/gitopper/reconcile"
+	toml "github.com/pelletier/go-toml/v2"
+	"go.science.ru.nl/log"
+)
+
+// liveConfig holds the config that is being served, it is swapped when the config is reloaded.
+type liveConfig struct {
+	c Config
+	sync.RWMutex
+}
+
+func (l *liveConfig) Get() Config {
+	l.RLock()
+	defer l.RUnlock()
+	return l.c
+}
+
+func (l *liveConfig) Set(c Config) {
+	l.Lock()
+	defer l.Unlock()
+	l.c = c
+}
+
+// daemon is what is needed to start and stop services while running.
+type daemon struct {
+	live     *liveConfig
+	boot     *Bootstrap
+	machine  *Machine
+	sched    *reconcile.Scheduler
+	duration time.Duration
+	hosts    []string
+	labels   map[string]string
+}
+
+// errRestart is returned by reload when the config can't be reloaded in place.
+var errRestart = errors.New("bootstrap changed")
+
+// start merges global into s, loads its state and adds it to the scheduler, which sets it up. Disabled services
+// are not added. If setupDone isn't nil it is called once the first setup of s has been attempted.
+func (d *daemon) start(s, global *Service, setupDone func()) {
+	s.merge(global, d.duration)
+	s.machine = d.machine
+	s.load()
+	log.Infof("Machine %q %q", s.Machine, s.Upstream)
+
+	if !s.IsEnabled() {
+		log.Infof("Machine %q, service %q is disabled", s.Machine, s.Service)
+		s.SetState(StateDisabled, "disabled in config")
+		if setupDone != nil {
+			setupDone()
+		}
+		return
+	}
+
+	s.simulate()
+	// The setup runs in a worker, so an upstream that hangs doesn't hold up the other services.
+	d.schedule(s, setupDone)
+}
+
+// reload reads the config again and diffs it against the running one: services that are removed (or changed) are
+// removed from the scheduler, services that are added (or changed) are started. Unchanged services keep running
+// undisturbed, as do the listeners. If the bootstrap config changed errRestart is returned.
+func (d *daemon) reload() (err error) {
+	defer func() {
+		result := "success"
+		if err != nil && err != errRestart {
+			result = "failure"
+		}
+		metricConfigReloads.WithLabelValues(result).Inc()
+	}()
+
+	c, err := readConfig(*flagConfig)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(c.Bootstrap, d.boot) {
+		return errRestart
+	}
+	if d.boot != nil {
+		if c, err = d.boot.config(c); err != nil {
+			return err
+		}
+	}
+	c.byPriority()
+
+	running := map[string]*Service{}
+	old := d.live.Get()
+	for _, s := range old.Services {
+		if s.forMe(d.hosts, d.labels) {
+			running[s.Service] = s
+		}
+	}
+
+	start := []*Service{}
+	for i, s := range c.Services {
+		if !s.forMe(d.hosts, d.labels) {
+			continue
+		}
+		s.merge(c.Global, d.duration)
+		if r, ok := running[s.Service]; ok && same(r, s) {
+			c.Services[i] = r
+			delete(running, s.Service)
+			continue
+		}
+		start = append(start, s)
+	}
+
+	// Log what changed, a changed service is both in running and start.
+	added, removed, modified := []string{}, []string{}, []string{}
+	changed := map[string]bool{}
+	for _, s := range start {
+		if _, ok := running[s.Service]; ok {
+			modified = append(modified, s.Service)
+			changed[s.Service] = true
+			continue
+		}
+		added = append(added, s.Service)
+	}
+	for name := range running {
+		if !changed[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+
+	for _, s := range running {
+		log.Infof("Machine %q, service %q removed or changed, stopping", s.Machine, s.Service)
+		d.unschedule(s)
+	}
+	for _, s := range start {
+		log.Infof("Machine %q, service %q added or changed, starting", s.Machine, s.Service)
+		d.start(s, c.Global, nil)
+	}
+	d.live.Set(c)
+	log.Infof("Config %q reloaded, services added: %v, removed: %v, modified: %v", *flagConfig, added, removed, modified)
+	return nil
+}
+
+// same returns true if the configuration of a and b, which both must have been merged, is the same.
+func same(a, b *Service) bool {
+	da, err1 := toml.Marshal(a)
+	db, err2 := toml.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(da, db) && reflect.DeepEqual(a.network, b.network)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSame(t *testing.T) {
+	global := &Service{Upstream: "https://github.com/miekg/blah-origin", Mount: "/tmp"}
+	a := (&Service{Machine: "grafana.atoom.net", Service: "grafana-server"}).merge(global, time.Minute)
+	b := (&Service{Machine: "grafana.atoom.net", Service: "grafana-server"}).merge(global, time.Minute)
+	if !same(a, b) {
+		t.Errorf("expected services to be the same")
+	}
+	b.Branch = "canary"
+	if same(a, b) {
+		t.Errorf("expected services to differ")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/proto"
+	"go.science.ru.nl/log"
+)
+
+// exception returns true if st is a state that should be temporary: frozen, pinned to an older commit, broken or
+// degraded.
+func exception(st State) bool {
+	return st == StateFreeze || st == StateRollback || st == StateBroken || st == StateDegraded
+}
+
+// exceptions returns a summary of the services that are in an exception state and for how long they've been in it at
+// now, longest first. It is empty if there are none.
+func exceptions(services []*Service, now time.Time) string {
+	type line struct {
+		since time.Time
+		text  string
+	}
+	lines := []line{}
+	for _, s := range services {
+		state, info := s.State()
+		if !exception(state) {
+			continue
+		}
+		since := s.Change()
+		text := fmt.Sprintf("%s is %s for %s", s.Service, state, now.Sub(since).Round(time.Minute))
+		if info != "" {
+			text += ": " + info
+		}
+		lines = append(lines, line{since, text})
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].since.Before(lines[j].since) })
+	b := &strings.Builder{}
+	for _, l := range lines {
+		b.WriteString(l.text + "\n")
+	}
+	return b.String()
+}
+
+// report logs a report of the services of this machine that are frozen, pinned or broken every d, until ctx is
+// canceled. If the global config has notify set the report is also POSTed there.
+func (d *daemon) report(ctx context.Context, hostname string, every time.Duration) {
+	for {
+		select {
+		case <-time.After(every):
+		case <-ctx.Done():
+			return
+		}
+		c := d.live.Get()
+		mine := []*Service{}
+		for _, s := range c.Services {
+			if s.forMe(d.hosts, d.labels) {
+				mine = append(mine, s)
+			}
+		}
+		r := exceptions(mine, time.Now().UTC())
+		if r == "" {
+			continue
+		}
+		log.Warningf("Machine %q, services that are frozen, pinned or broken:\n%s", hostname, r)
+		if c.Global == nil || c.Global.Notify == "" || d.machine.Maintenance() {
+			continue
+		}
+		n := proto.Notification{Machine: hostname, Message: r}
+		if err := post(c.Global.Notify, n); err != nil {
+			log.Warningf("Machine %q, failed to send report to %q: %s", hostname, c.Global.Notify, err)
+		}
+	}
+}
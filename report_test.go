@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExceptions(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	services := []*Service{
+		{Service: "grafana", st: ServiceState{State: StateOK, Stamp: now.Add(-72 * time.Hour)}},
+		{Service: "prometheus", st: ServiceState{State: StateFreeze, Stamp: now.Add(-2 * time.Hour)}},
+		{Service: "bind", st: ServiceState{State: StateBroken, StateInfo: "error pulling", Stamp: now.Add(-50 * time.Hour)}},
+		{Service: "ntp", st: ServiceState{State: StateDisabled, Stamp: now.Add(-time.Hour)}},
+	}
+	exp := "bind is BROKEN for 50h0m0s: error pulling\nprometheus is FREEZE for 2h0m0s\n"
+	if got := exceptions(services, now); got != exp {
+		t.Errorf("expected %q, got %q", exp, got)
+	}
+	if got := exceptions(services[:1], now); got != "" {
+		t.Errorf("expected empty report, got %q", got)
+	}
+}
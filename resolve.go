@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// resolve writes the services, with the global settings merged in, that the hosts (with labels) would pick up to w
+// in TOML.
+func resolve(w io.Writer, c Config, hosts []string, labels map[string]string) error {
+	services := []*Service{}
+	for _, s := range c.Services {
+		if !s.forMe(hosts, labels) {
+			continue
+		}
+		services = append(services, s.merge(c.Global, 0))
+	}
+	data, err := toml.Marshal(struct{ Services []*Service }{services})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"go.science.ru.nl/log"
+)
+
+// lowResources prefixes the StateInfo of a service whose applies are deferred because the host is short on disk
+// space or overloaded.
+const lowResources = "LOW RESOURCES "
+
+// resources checks the host before an apply: there must be at least MinFree bytes free on the filesystem of the
+// mount and the 1-minute load average per CPU must not exceed MaxLoad. It returns why the apply should be
+// deferred, or the empty string. If a resource can't be measured it isn't checked.
+func (s *Service) resources() string {
+	if s.MinFree > 0 {
+		free, err := hostFree(s.Mount)
+		switch {
+		case err != nil:
+			log.Warningf("Machine %q, failed to get free space of %q: %s", s.Machine, s.Mount, err)
+		case free < uint64(s.MinFree):
+			log.Debugf("Machine %q, %d bytes free on %q", s.Machine, free, s.Mount)
+			return fmt.Sprintf("less than %s free on %q", s.MinFree, s.Mount)
+		}
+	}
+	if s.MaxLoad > 0 {
+		load, err := hostLoad()
+		switch {
+		case err != nil:
+			log.Warningf("Machine %q, failed to get load average: %s", s.Machine, err)
+		case load > s.MaxLoad:
+			log.Debugf("Machine %q, load average is %.2f per CPU", s.Machine, load)
+			return fmt.Sprintf("load average above %g per CPU", s.MaxLoad)
+		}
+	}
+	return ""
+}
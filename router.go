@@ -1,90 +1,140 @@
 package main
 
 import (
-	"encoding/hex"
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/miekg/gitopper/proto"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.science.ru.nl/log"
 )
 
-func newRouter(c Config) *mux.Router {
+func newRouter(live *liveConfig, m *Machine, hostname string) *mux.Router {
 	router := mux.NewRouter()
-	router.Path("/metrics").Handler(promhttp.Handler())
+	// OpenMetrics is needed for the exemplars.
+	router.Path("/metrics").Handler(promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	))
+
+	router.Path("/debug/vars").Methods("GET").Handler(expvar.Handler())
 
 	// listing
 	router.Path("/list/machines").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ListMachines(c, w, r)
+		ListMachines(live.Get(), m, hostname, w, r)
 	})
 	// don't really need a seperate one for this, can be /service without a service
 	router.Path("/list/services").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ListServices(c, w, r)
+		ListServices(live.Get(), w, r)
 	})
 	router.Path("/list/service/{service}").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ListService(c, w, r)
+		ListService(live.Get(), w, r)
+	})
+	router.Path("/list/journal").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ListJournal(m, w, r)
+	})
+
+	// completion
+	router.Path("/complete").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Complete(live.Get(), w, r)
 	})
 
 	// state changes
 	router.Path("/state/freeze/{service}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		FreezeService(c, StateFreeze, w, r)
+		FreezeService(live.Get(), StateFreeze, w, r)
 	})
 	router.Path("/state/unfreeze/{service}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		FreezeService(c, StateOK, w, r)
+		FreezeService(live.Get(), StateOK, w, r)
+	})
+	router.Path("/state/disable/{service}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		DisableService(live.Get(), w, r)
+	})
+	router.Path("/state/enable/{service}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		EnableService(live.Get(), w, r)
+	})
+	router.Path("/state/reset/{service}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ResetService(live.Get(), w, r)
+	})
+	router.Path("/state/approve/{service}/{rev:.+}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ApproveService(live.Get(), w, r)
+	})
+	router.Path("/state/rollback/{service}/{rev:.+}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RollbackService(live.Get(), w, r)
+	})
+
+	// restarts
+	router.Path("/service/restart/{service}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RestartService(live.Get(), w, r)
+	})
+
+	// webhooks
+	wh := newWebhook()
+	router.Path("/webhook").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Webhook(live.Get(), wh, w, r)
+	})
+
+	// machine changes
+	router.Path("/machine/promote").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		PromoteMachine(m, w, r)
+	})
+	router.Path("/machine/override").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		OverrideMachine(m, w, r)
 	})
-	router.Path("/state/rollback/{service}/{hash}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		RollbackService(c, w, r)
+	router.Path("/machine/maintenance/{mode:on|off}").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		MaintenanceMachine(m, w, r)
 	})
 	return router
 }
 
-func ListMachines(c Config, w http.ResponseWriter, r *http.Request) {
-	lm := proto.ListMachines{
-		ListMachines: make([]proto.ListMachine, len(c.Services)),
-	}
-	hostname, _ := os.Hostname()
-	for i, service := range c.Services {
-		lm.ListMachines[i] = proto.ListMachine{
-			Machine: service.Machine,
-			Actual:  hostname,
+func ListMachines(c Config, m *Machine, hostname string, w http.ResponseWriter, r *http.Request) {
+	l, err := newList(w, "machines")
+	for _, service := range c.Services {
+		if err != nil {
+			break
 		}
+		err = l.Emit(proto.ListMachine{
+			Machine:     service.Machine,
+			Actual:      hostname,
+			Skew:        service.Skew().String(),
+			Maintenance: m.Maintenance(),
+			Facts:       m.Facts,
+		})
+	}
+	if err == nil {
+		err = l.Close()
 	}
-	data, err := json.Marshal(lm)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		log.Warningf("Failed to send machines: %s", err)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
 }
 
 func ListServices(c Config, w http.ResponseWriter, r *http.Request) {
-	ls := proto.ListServices{
-		ListServices: make([]proto.ListService, len(c.Services)),
-	}
-	for i, service := range c.Services {
+	l, err := newList(w, "services")
+	for _, service := range c.Services {
+		if err != nil {
+			break
+		}
 		state, info := service.State()
-		ls.ListServices[i] = proto.ListService{
+		err = l.Emit(proto.ListService{
 			Service:     service.Service,
 			Hash:        service.Hash(),
 			State:       state.String(),
 			StateInfo:   info,
 			StateChange: service.Change().Format(time.RFC1123),
-		}
+		})
+	}
+	if err == nil {
+		err = l.Close()
 	}
-	data, err := json.Marshal(ls)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		log.Warningf("Failed to send services: %s", err)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
 }
 
 func ListService(c Config, w http.ResponseWriter, r *http.Request) {
@@ -98,6 +148,7 @@ func ListService(c Config, w http.ResponseWriter, r *http.Request) {
 				State:       state.String(),
 				StateInfo:   info,
 				StateChange: service.Change().String(),
+				Upstream:    service.remote(),
 			}
 			data, err := json.Marshal(ls)
 			if err != nil {
@@ -113,33 +164,296 @@ func ListService(c Config, w http.ResponseWriter, r *http.Request) {
 	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 }
 
-func FreezeService(c Config, state State, w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+func ListJournal(m *Machine, w http.ResponseWriter, r *http.Request) {
+	l, err := newList(w, "journal")
+	if err == nil {
+		err = m.Store.Journal(func(e JournalEntry) error {
+			return l.Emit(proto.JournalEntry{
+				Service:  e.Service,
+				From:     e.From,
+				To:       e.To,
+				Summary:  e.Summary,
+				Start:    e.Start.Format(time.RFC3339),
+				Duration: e.Duration.String(),
+				Result:   e.Result,
+				Operator: e.Operator,
+				Upstream: e.Upstream,
+				Signer:   e.Signer,
+				Package:  e.Package,
+				Version:  e.Version,
+				Phases:   phases(e.Phases),
+			})
+		})
+	}
+	if err == nil {
+		err = l.Close()
+	}
+	if err != nil {
+		// Too late to tell the client, it is left with invalid JSON.
+		log.Warningf("Failed to send journal: %s", err)
+	}
+}
+
+// Complete returns the (sorted, unique) machine and service names from the config, for command-line completion.
+func Complete(c Config, w http.ResponseWriter, r *http.Request) {
+	machines, services := map[string]struct{}{}, map[string]struct{}{}
 	for _, service := range c.Services {
-		if service.Service == vars["service"] {
+		if service.Machine != "" {
+			machines[service.Machine] = struct{}{}
+		}
+		services[service.Service] = struct{}{}
+	}
+	cp := proto.Complete{Machines: keys(machines), Services: keys(services)}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func keys(m map[string]struct{}) []string {
+	k := make([]string, 0, len(m))
+	for s := range m {
+		k = append(k, s)
+	}
+	sort.Strings(k)
+	return k
+}
+
+func FreezeService(c Config, state State, w http.ResponseWriter, r *http.Request) {
+	bulkService(c, w, r, func(service *Service) error {
+		service.serial(func() {
 			service.SetState(state, "")
 			log.Infof("Machine %q, service %q set to %s", service.Machine, service.Service, state)
-			http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
-			return
+		})
+		return nil
+	})
+}
+
+// ResetService resets the circuit breaker of a service and lets it pull again.
+func ResetService(c Config, w http.ResponseWriter, r *http.Request) {
+	bulkService(c, w, r, func(service *Service) error {
+		service.serial(func() {
+			service.ResetFailures()
+			service.SetState(StateOK, "")
+			log.Infof("Machine %q, service %q breaker reset", service.Machine, service.Service)
+		})
+		return nil
+	})
+}
+
+// DisableService disables a service, it is no longer tracked. With ?stop=true the unit is stopped as well.
+func DisableService(c Config, w http.ResponseWriter, r *http.Request) {
+	stop := r.URL.Query().Get("stop") == "true"
+	bulkService(c, w, r, func(service *Service) error {
+		if !stop {
+			service.serial(func() {
+				service.SetState(StateDisabled, "")
+				log.Infof("Machine %q, service %q set to %s", service.Machine, service.Service, StateDisabled)
+			})
+			return nil
+		}
+		// We reply with the result of the stop, so wait for the reconcile instead of queueing.
+		service.lockOp()
+		defer service.unlockOp()
+		service.SetState(StateDisabled, "")
+		log.Infof("Machine %q, service %q set to %s", service.Machine, service.Service, StateDisabled)
+		return service.stop()
+	})
+}
+
+// EnableService enables a disabled service, so it is tracked again. A service that isn't disabled is left alone,
+// enabling a frozen or rolled back service doesn't unfreeze it.
+func EnableService(c Config, w http.ResponseWriter, r *http.Request) {
+	bulkService(c, w, r, func(service *Service) error {
+		if state, _ := service.State(); state != StateDisabled {
+			return fmt.Errorf("service is %s, not %s", state, StateDisabled)
+		}
+		service.serial(func() {
+			// A reconcile may have changed the state after the check above.
+			if service.enable() == nil {
+				log.Infof("Machine %q, service %q enabled", service.Machine, service.Service)
+			}
+		})
+		return nil
+	})
+}
+
+// ApproveService approves a commit of a service, given as an (abbreviated) hash, a tag or a ref: when it's the
+// candidate commit, its policy and validation are skipped. This allows a commit that was denied or is invalid.
+func ApproveService(c Config, w http.ResponseWriter, r *http.Request) {
+	rev := mux.Vars(r)["rev"]
+	bulkService(c, w, r, func(service *Service) error {
+		service.lockOp()
+		defer service.unlockOp()
+		full, err := service.newGitCmd().Resolve(rev)
+		if err != nil {
+			return err
 		}
+		service.Approve(full)
+		log.Infof("Machine %q, service %q, %s approved", service.Machine, service.Service, full)
+		service.Wake()
+		return nil
+	})
+}
+
+// RestartService restarts the unit of a service and replies after its health probe passes.
+func RestartService(c Config, w http.ResponseWriter, r *http.Request) {
+	bulkService(c, w, r, func(service *Service) error {
+		service.lockOp()
+		defer service.unlockOp()
+		return service.restart()
+	})
+}
+
+// bulkService calls f for each of the comma separated services in the request and replies with the result for each
+// service. If one of the services isn't found, the status code is 404, if f returns an error it is 409.
+func bulkService(c Config, w http.ResponseWriter, r *http.Request, f func(*Service) error) {
+	vars := mux.Vars(r)
+	names := strings.Split(vars["service"], ",")
+	sr := proto.StateResults{
+		StateResults: make([]proto.StateResult, len(names)),
 	}
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	status := http.StatusOK
+	for i, name := range names {
+		sr.StateResults[i] = proto.StateResult{Service: name, Result: http.StatusText(http.StatusOK)}
+		var service *Service
+		for _, s := range c.Services {
+			if s.Service == name {
+				service = s
+				break
+			}
+		}
+		switch {
+		case service == nil:
+			sr.StateResults[i].Result = http.StatusText(http.StatusNotFound)
+			status = http.StatusNotFound
+		case !service.IsEnabled():
+			sr.StateResults[i].Result = http.StatusText(http.StatusConflict) + ", disabled in config"
+			status = http.StatusConflict
+		default:
+			if err := f(service); err != nil {
+				sr.StateResults[i].Result = http.StatusText(http.StatusConflict) + ", " + err.Error()
+				status = http.StatusConflict
+			}
+		}
+	}
+	data, err := json.Marshal(sr)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
 }
 
+// RollbackService rolls a service back to a commit and replies with the hash deployed afterwards. The commit may be
+// given as an (abbreviated) hash, a tag or a ref like HEAD~1, it is resolved against the checkout and fetched if
+// needed, unknown commits are refused. Rolling back to the deployed commit only freezes the service.
 func RollbackService(c Config, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	if _, err := hex.DecodeString(vars["hash"]); err != nil {
-		http.Error(w, http.StatusText(http.StatusNotAcceptable)+", not a valid git hash: "+vars["hash"], http.StatusNotFound)
+	rev := vars["rev"]
+	if len(rev) > 256 {
+		http.Error(w, http.StatusText(http.StatusNotAcceptable)+", not a valid git revision: "+rev, http.StatusNotFound)
+		return
+	}
+	var service *Service
+	for _, s := range c.Services {
+		if s.Service == vars["service"] {
+			service = s
+			break
+		}
+	}
+	if service == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
-	for _, service := range c.Services {
-		if service.Service == vars["service"] {
-			service.SetState(StateRollback, vars["hash"])
-			log.Infof("Machine %q, service %q set to %s", service.Machine, service.Service, StateRollback)
-			http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
+	rr := proto.RollbackResult{Service: service.Service, Hash: rev, Result: http.StatusText(http.StatusOK)}
+	status := http.StatusOK
+	func() {
+		service.lockOp()
+		defer service.unlockOp()
+
+		gc := service.newGitCmd()
+		full, err := gc.Resolve(rev)
+		if err != nil {
+			rr.Result = http.StatusText(http.StatusNotFound) + ", " + err.Error()
+			status = http.StatusNotFound
 			return
 		}
+		rr.Hash = full
+		switch {
+		case service.machine.Maintenance():
+			service.SetState(StateRollback, full)
+			rr.Result = http.StatusText(http.StatusAccepted) + ", machine in maintenance, rollback is done after it"
+			status = http.StatusAccepted
+		case service.Hash() == full:
+			service.SetState(StateFreeze, "ROLLBACK: "+full)
+		default:
+			service.SetState(StateRollback, full)
+			if err := service.rollback(gc, full); err != nil {
+				rr.Result = http.StatusText(http.StatusConflict) + ", " + err.Error()
+				status = http.StatusConflict
+			}
+		}
+		log.Infof("Machine %q, service %q rollback to %s: %s", service.Machine, service.Service, full, rr.Result)
+	}()
+	rr.Deployed = service.Hash()
+
+	data, err := json.Marshal(rr)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// PromoteMachine takes the machine out of standby, all services will be mounted and restarted.
+func PromoteMachine(m *Machine, w http.ResponseWriter, r *http.Request) {
+	if !m.Promote() {
+		http.Error(w, http.StatusText(http.StatusConflict)+", not in standby", http.StatusConflict)
+		return
+	}
+	log.Infof("Machine promoted from standby")
+	http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
+}
+
+// MaintenanceMachine puts the machine in or takes it out of maintenance. With ?ttl=<duration> the maintenance ends
+// by itself.
+func MaintenanceMachine(m *Machine, w http.ResponseWriter, r *http.Request) {
+	on := mux.Vars(r)["mode"] == "on"
+	var ttl time.Duration
+	if t := r.URL.Query().Get("ttl"); t != "" && on {
+		var err error
+		if ttl, err = time.ParseDuration(t); err != nil || ttl <= 0 {
+			http.Error(w, http.StatusText(http.StatusNotAcceptable)+", not a valid ttl: "+t, http.StatusNotAcceptable)
+			return
+		}
+	}
+	m.SetMaintenance(on, ttl)
+	log.Infof("Machine maintenance set to %t (ttl %s)", on, ttl)
+	http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
+}
+
+// OverrideMachine overrides the change-freeze calendars of the services for ?ttl=<duration>, which defaults to an
+// hour. A ttl of 0s ends the override.
+func OverrideMachine(m *Machine, w http.ResponseWriter, r *http.Request) {
+	ttl := time.Hour
+	if t := r.URL.Query().Get("ttl"); t != "" {
+		var err error
+		if ttl, err = time.ParseDuration(t); err != nil || ttl < 0 {
+			http.Error(w, http.StatusText(http.StatusNotAcceptable)+", not a valid ttl: "+t, http.StatusNotAcceptable)
+			return
+		}
+	}
+	m.SetOverride(ttl)
+	log.Warningf("Machine change freeze overridden for %s", ttl)
+	http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
 }
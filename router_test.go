@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEnableService(t *testing.T) {
+	disabled, frozen := &Service{Service: "disabled"}, &Service{Service: "frozen"}
+	disabled.SetState(StateDisabled, "")
+	frozen.SetState(StateFreeze, "")
+	live := &liveConfig{c: Config{Services: []*Service{disabled, frozen}}}
+	router := newRouter(live, newMachine(false), "localhost")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/state/enable/disabled,frozen", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected %d for a service that isn't disabled, got %d", http.StatusConflict, w.Code)
+	}
+	if state, _ := disabled.State(); state != StateOK {
+		t.Errorf("expected disabled service to be %s, got %s", StateOK, state)
+	}
+	if state, _ := frozen.State(); state != StateFreeze {
+		t.Errorf("expected frozen service to stay %s, got %s", StateFreeze, state)
+	}
+}
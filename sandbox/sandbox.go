@@ -0,0 +1,113 @@
+// Package sandbox runs subprocesses with a restricted view of the system: the filesystem is read-only except for
+// the directories that must be written to, and unless network access is needed the process gets its own, empty,
+// network namespace. On Linux the filesystem is restricted with Landlock and system calls that change the system
+// or get out of the sandbox (mount, module loading, ptrace, namespaces, ...) are denied with seccomp, elsewhere
+// there is no sandbox; see Supported.
+//
+// Landlock and seccomp restrict the calling thread, which can't be done between fork and exec in Go. So the command
+// is run via our own binary: it restricts itself and then execs the command. Main must be called first thing in
+// main for this to work.
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// Enabled enables the sandbox, if false Command returns an unrestricted command.
+var Enabled = false
+
+// reexec is the first argument of the re-executed binary.
+const reexec = "-gitopper-sandbox"
+
+// Options says what a sandboxed command may do.
+type Options struct {
+	Writable []string // Paths that may be written to, non-existent ones allow writing in their existing parent.
+	Network  bool     // If true the command may use the network.
+}
+
+// Command returns a command that runs name with args in the sandbox described by o.
+func Command(ctx context.Context, o Options, name string, args ...string) *exec.Cmd {
+	if !Enabled {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	a := []string{reexec}
+	for _, w := range o.Writable {
+		a = append(a, "-w", w)
+	}
+	if o.Network {
+		a = append(a, "-net")
+	}
+	// Look name up with our PATH, as the environment of cmd may not have one.
+	if p, err := exec.LookPath(name); err == nil {
+		name = p
+	}
+	a = append(a, "--", name)
+	cmd := exec.CommandContext(ctx, self, append(a, args...)...)
+	if !o.Network {
+		isolate(cmd)
+	}
+	return cmd
+}
+
+// Main restricts the process and execs the command if we are re-executed by Command, otherwise it returns
+// immediately.
+func Main() {
+	if len(os.Args) < 2 || os.Args[1] != reexec {
+		return
+	}
+	o := Options{}
+	args := os.Args[2:]
+	for len(args) > 0 && args[0] != "--" {
+		switch {
+		case args[0] == "-w" && len(args) > 1:
+			o.Writable = append(o.Writable, args[1])
+			args = args[1:]
+		case args[0] == "-net":
+			o.Network = true
+		}
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		fail(fmt.Errorf("no command"))
+	}
+	args = args[1:]
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		fail(err)
+	}
+	// The thread that is restricted must be the one that execs.
+	runtime.LockOSThread()
+	if err := restrict(o); err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(path, args, os.Environ()))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "sandbox: %s\n", err)
+	os.Exit(126)
+}
+
+// existing returns p, or its nearest existing parent.
+func existing(p string) string {
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
@@ -0,0 +1,92 @@
+package sandbox
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// readOnly are the rights on the entire filesystem.
+	readOnly = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	// fileRights are the rights that apply to files, the others only apply to directories.
+	fileRights = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE
+	// readWrite are all the rights of the first Landlock ABI.
+	readWrite = 1<<13 - 1
+)
+
+// isolate gives cmd its own network namespace, which only has a loopback interface that is down.
+func isolate(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+}
+
+// Supported returns an error if the kernel doesn't support Landlock, or there is no seccomp filter for this
+// architecture, so nothing can be restricted.
+func Supported() error {
+	_, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("landlock is not supported: %s", errno)
+	}
+	return seccompSupported()
+}
+
+// restrict makes the filesystem read-only for this process and its children, except for o.Writable and
+// /dev/null, and denies the system calls that change the system or get out of the sandbox (see denied). If the
+// kernel doesn't support Landlock an error is returned, the command is never run unrestricted.
+func restrict(o Options) error {
+	attr := unix.LandlockRulesetAttr{Access_fs: readWrite}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno == unix.ENOSYS || errno == unix.EOPNOTSUPP {
+		return fmt.Errorf("landlock is not supported, refusing to run unrestricted")
+	}
+	if errno != 0 {
+		return fmt.Errorf("landlock: create ruleset: %s", errno)
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	if err := allow(ruleset, "/", readOnly); err != nil {
+		return err
+	}
+	if err := allow(ruleset, "/dev/null", readWrite); err != nil {
+		return err
+	}
+	for _, w := range o.Writable {
+		if err := allow(ruleset, existing(w), readWrite); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("no new privileges: %s", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: restrict self: %s", errno)
+	}
+	return seccomp()
+}
+
+// allow adds a rule to ruleset that allows access beneath path.
+func allow(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("landlock: %s: %s", path, err)
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err == nil && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= fileRights
+	}
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: %s: %s", path, errno)
+	}
+	return nil
+}
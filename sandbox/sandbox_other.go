@@ -0,0 +1,16 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// Supported returns an error, the sandbox only exists on Linux.
+func Supported() error { return fmt.Errorf("there is no sandbox on %s", runtime.GOOS) }
+
+func isolate(cmd *exec.Cmd) {}
+
+func restrict(o Options) error { return nil }
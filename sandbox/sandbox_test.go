@@ -0,0 +1,63 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	Main() // we are re-executed by Command
+	os.Exit(m.Run())
+}
+
+func TestCommand(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need root for a network namespace")
+	}
+	Enabled = true
+	defer func() { Enabled = false }()
+
+	dir := t.TempDir()
+	outside := t.TempDir()
+	cmd := Command(context.Background(), Options{Writable: []string{dir}}, "/bin/sh", "-c",
+		"touch "+filepath.Join(dir, "in")+"; touch "+filepath.Join(outside, "out")+"; ip -o link | grep -c . > "+filepath.Join(dir, "links"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Logf("%s", out)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "in")); err != nil {
+		t.Errorf("expected writable dir to be written to: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "out")); err == nil {
+		t.Errorf("expected %q not to be written to", outside)
+	}
+	if links, err := os.ReadFile(filepath.Join(dir, "links")); err == nil && string(links) != "1\n" {
+		t.Errorf("expected only the loopback interface, got %s links", links)
+	}
+}
+
+func TestSeccomp(t *testing.T) {
+	if err := Supported(); err != nil {
+		t.Skip(err)
+	}
+	unshare, err := exec.LookPath("unshare")
+	if err != nil {
+		t.Skip("no unshare")
+	}
+	Enabled = true
+	defer func() { Enabled = false }()
+
+	if out, err := Command(context.Background(), Options{Network: true}, "/bin/sh", "-c", "true").CombinedOutput(); err != nil {
+		t.Fatalf("expected command to run: %s: %s", err, out)
+	}
+	out, err := Command(context.Background(), Options{Network: true}, unshare, "--user", "true").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Operation not permitted") {
+		t.Errorf("expected unshare to be denied, got %v: %s", err, out)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build linux && (amd64 || arm64)
+
+package sandbox
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Actions of a seccomp filter, see seccomp(2).
+const (
+	retAllow       = 0x7fff0000
+	retErrno       = 0x00050000
+	retKillProcess = 0x80000000
+)
+
+// x32 is the bit that marks a system call of the x32 ABI on amd64, these are denied as well.
+const x32 = 0x40000000
+
+// denied are the system calls a sandboxed command has no business making: they change the system (mounts, swap,
+// modules, the clock, reboot), get out of the sandbox (namespaces, ptrace, handles) or widen the attack surface of
+// the kernel (bpf, perf, keyrings, userfaultfd).
+var denied = []uint32{
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE, unix.SYS_KEXEC_LOAD, unix.SYS_KEXEC_FILE_LOAD,
+	unix.SYS_REBOOT, unix.SYS_ACCT, unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME, unix.SYS_CLOCK_ADJTIME, unix.SYS_ADJTIMEX,
+	unix.SYS_UNSHARE, unix.SYS_SETNS, unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+}
+
+// filter returns the seccomp program that fails the denied system calls with EPERM and kills the process on a
+// system call of another architecture.
+func filter() []unix.SockFilter {
+	n := len(denied)
+	f := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4}, // seccomp_data.arch
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: auditArch, Jt: 1},
+		{Code: unix.BPF_RET | unix.BPF_K, K: retKillProcess},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0}, // seccomp_data.nr
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: x32, Jt: uint8(n + 1)},
+	}
+	for i, nr := range denied {
+		f = append(f, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: nr, Jt: uint8(n - i)})
+	}
+	return append(f,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: retAllow},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: retErrno | uint32(unix.EPERM)},
+	)
+}
+
+func seccompSupported() error { return nil }
+
+// seccomp installs the filter for this thread and the processes it execs. No new privileges must be set.
+func seccomp() error {
+	f := filter()
+	prog := unix.SockFprog{Len: uint16(len(f)), Filter: &f[0]}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return fmt.Errorf("seccomp: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build linux && !amd64 && !arm64
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// seccompSupported returns an error, there is no system call filter for this architecture.
+func seccompSupported() error { return fmt.Errorf("there is no seccomp filter for %s", runtime.GOARCH) }
+
+func seccomp() error { return seccompSupported() }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"github.com/miekg/gitopper/reconcile"
+	"go.science.ru.nl/log"
+)
+
+// job is a service as reconciled by the scheduler.
+type job struct {
+	s         *Service
+	gc        *gitcmd.Git
+	ready     bool   // False if the setup of the service hasn't succeeded (yet).
+	standby   bool   // True if the service was setup while in standby, i.e. it still needs to be activated.
+	setupDone func() // If not nil, called after the first setup attempt.
+}
+
+// schedule adds s to the scheduler, its setup is done by the first reconcile, which is due now. If setupDone isn't
+// nil it is called after that setup has been attempted.
+func (d *daemon) schedule(s *Service, setupDone func()) {
+	j := &job{s: s, gc: s.newGitCmd(), standby: s.machine.Standby(), setupDone: setupDone}
+	s.Lock()
+	s.sched, s.job = d.sched, j
+	s.Unlock()
+	s.pruned = time.Now()
+	d.sched.Add(j, time.Now())
+}
+
+// unschedule removes s from the scheduler, if s is being reconciled that is finished first.
+func (d *daemon) unschedule(s *Service) {
+	s.Lock()
+	j := s.job
+	s.sched, s.job = nil, nil
+	s.Unlock()
+	if j != nil {
+		d.sched.Remove(j)
+		// Never setup, but nobody should wait for it either.
+		j.attempted()
+	}
+}
+
+// attempted calls setupDone, once.
+func (j *job) attempted() {
+	if j.setupDone != nil {
+		j.setupDone()
+		j.setupDone = nil
+	}
+}
+
+// runScheduler runs sc until ctx is canceled. When m is in standby all services are reconciled as soon as it is
+// promoted.
+func runScheduler(ctx context.Context, sc *reconcile.Scheduler, m *Machine, workers int) {
+	if m.Standby() {
+		go func() {
+			select {
+			case <-m.Promoted():
+				sc.WakeupAll()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	sc.Run(ctx, workers)
+}
+
+// Next implements reconcile.Task.
+func (j *job) Next(now time.Time) time.Time { return j.s.next(now) }
+
+// Reconcile implements reconcile.Task: it retries the setup if that failed, activates the service when the
+// machine got promoted, or reconciles.
+func (j *job) Reconcile() {
+	s := j.s
+	s.lockOp()
+	defer s.unlockOp()
+	if !j.ready {
+		j.ready = s.setup() == nil
+		j.standby = s.machine.Standby()
+		j.attempted()
+		return
+	}
+	if j.standby && !s.machine.Standby() {
+		j.standby = false
+		log.Infof("Machine %q is promoted, activating service %q", s.Machine, s.Service)
+		s.activate()
+		return
+	}
+	s.SetHash(j.gc.Hash())
+	s.reconcileOnce(j.gc)
+	s.breaker()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// globalFields are the fields of a service that are taken from the global config when not set, see merge.
+var globalFields = []string{"Upstream", "Mirrors", "Failures", "Notify", "Attest", "Calendar", "DropIn", "Webhook", "Strategy", "OnForcePush", "Backend", "Policy", "Secret", "Proxy", "MinFree", "MaxLoad", "Interval", "Schedule"}
+
+// defaults are the defaults of fields that have a non-zero one, keyed by <type>.<field>.
+var defaults = map[string]any{
+	"Service.Branch":      "main",
+	"Service.Enabled":     true,
+	"Service.Strategy":    "ff-only",
+	"Service.OnForcePush": "freeze",
+	"Service.Backend":     "git",
+	"Service.Filter":      "blob:none",
+	"Service.Interval":    "30s",
+	"Bootstrap.Branch":    "main",
+}
+
+var (
+	dirType      = reflect.TypeOf(Dir{})
+	durationType = reflect.TypeOf(Duration(0))
+	sizeType     = reflect.TypeOf(Size(0))
+)
+
+// schema writes the JSON Schema of the config to w. It is generated from the Config struct: field names are
+// lowercased, fields that can be set in the global config have "x-global" set.
+func schema(w io.Writer) error {
+	defs := map[string]any{}
+	s := schemaOf(reflect.TypeOf(Config{}), defs)
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["$defs"] = defs
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// schemaOf returns the schema of t, structs are added to defs and referenced.
+func schemaOf(t reflect.Type, defs map[string]any) map[string]any {
+	switch t {
+	case durationType:
+		return map[string]any{"type": "string", "pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`}
+	case sizeType:
+		return map[string]any{"type": "string", "pattern": `^[0-9]+[KMGT]?$`}
+	case dirType:
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string", "description": "<link>[:<local>]"},
+			schemaStruct(t, defs),
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), defs)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), defs)}
+	case reflect.Struct:
+		if t.Name() != "Config" {
+			if _, ok := defs[t.Name()]; !ok {
+				defs[t.Name()] = nil // break the recursion
+				defs[t.Name()] = schemaStruct(t, defs)
+			}
+			return map[string]any{"$ref": "#/$defs/" + t.Name()}
+		}
+		return schemaStruct(t, defs)
+	}
+	return map[string]any{}
+}
+
+// schemaStruct returns the schema of the struct t, unexported and embedded fields and fields that aren't in the
+// config are skipped.
+func schemaStruct(t reflect.Type, defs map[string]any) map[string]any {
+	props := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Anonymous || f.Tag.Get("toml") == "-" {
+			continue
+		}
+		p := schemaOf(f.Type, defs)
+		if d, ok := defaults[t.Name()+"."+f.Name]; ok {
+			p["default"] = d
+		}
+		if t.Name() == "Service" {
+			for _, g := range globalFields {
+				if g == f.Name {
+					p["x-global"] = true
+				}
+			}
+		}
+		props[strings.ToLower(f.Name)] = p
+	}
+	return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+}
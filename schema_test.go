@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestGlobalFields checks globalFields are exactly the fields merge takes from the global config.
+func TestGlobalFields(t *testing.T) {
+	global := map[string]bool{}
+	for _, g := range globalFields {
+		global[g] = true
+	}
+	typ := reflect.TypeOf(Service{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() || f.Anonymous || f.Tag.Get("toml") == "-" || f.Name == "Branch" {
+			continue
+		}
+		s1 := &Service{}
+		v := reflect.ValueOf(s1).Elem().Field(i)
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			v.SetInt(1)
+		case reflect.Uint64:
+			v.SetUint(1)
+		case reflect.Float64:
+			v.SetFloat(1)
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		default:
+			if global[f.Name] {
+				t.Fatalf("field %s of kind %s can't be tested", f.Name, v.Kind())
+			}
+			continue
+		}
+		s := (&Service{}).merge(s1, 0)
+		merged := !reflect.ValueOf(s).Elem().Field(i).IsZero()
+		if merged != global[f.Name] {
+			t.Errorf("field %s: merged is %t, in globalFields is %t", f.Name, merged, global[f.Name])
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := schema(buf); err != nil {
+		t.Fatal(err)
+	}
+	s := struct {
+		Defs map[string]struct {
+			Properties map[string]map[string]any
+		} `json:"$defs"`
+	}{}
+	if err := json.Unmarshal(buf.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	props := s.Defs["Service"].Properties
+	if props["interval"]["x-global"] != true || props["interval"]["default"] != "30s" {
+		t.Errorf("expected interval to be global with default 30s, got %v", props["interval"])
+	}
+	if _, ok := props["duration"]; ok {
+		t.Errorf("expected no duration in the schema")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Sources of the upstream secret, see Service.Secret.
+const (
+	secretFile = "file:"
+	secretEnv  = "env:"
+	secretExec = "exec:"
+)
+
+// secret returns the secret used to authenticate to upstream. It is read from a file, the environment or the
+// output of a helper command, depending on the prefix of s.Secret.
+func (s *Service) secret() (string, error) {
+	switch {
+	case strings.HasPrefix(s.Secret, secretFile):
+		data, err := os.ReadFile(strings.TrimPrefix(s.Secret, secretFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(s.Secret, secretEnv):
+		name := strings.TrimPrefix(s.Secret, secretEnv)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+		return strings.TrimSpace(v), nil
+	case strings.HasPrefix(s.Secret, secretExec):
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// Only standard output, anything on standard error shouldn't end up as the secret.
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", strings.TrimPrefix(s.Secret, secretExec))
+		cmd.Env = s.environ()
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("secret helper: %s", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", fmt.Errorf("unknown secret source %q", s.Secret)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/gitopper/ospkg"
+)
+
+// check is a single check of the selftest, it returns a detail to show or an error if the check failed.
+type check struct {
+	name string
+	fn   func() (string, error)
+}
+
+// selftest checks if the host can run gitopper and writes the results to w. The mounts of the services in c (which
+// may be empty) are checked for write access, addr is checked for availability if not empty. It returns false if
+// any check failed.
+func selftest(w io.Writer, c Config, network, addr string) bool {
+	checks := []check{
+		{"git", func() (string, error) { return run("git", "--version") }},
+		{"mount", testMount},
+		{"systemctl", func() (string, error) { return run("systemctl", "show", "--property=Version", "--value") }},
+		{"package manager", testPackageManager},
+	}
+	for _, m := range mounts(c) {
+		m := m
+		checks = append(checks, check{"write " + m, func() (string, error) { return testWrite(m) }})
+	}
+	if addr != "" {
+		checks = append(checks, check{"listen " + addr, func() (string, error) {
+			l, err := net.Listen(network, addr)
+			if err != nil {
+				return "", err
+			}
+			return "available", l.Close()
+		}})
+	}
+
+	return report(w, checks, false)
+}
+
+// checkResult is the result of a check as reported in JSON.
+type checkResult struct {
+	Check  string `json:"check"`
+	Result string `json:"result"` // OK or FAIL
+	Detail string `json:"detail"`
+}
+
+// report runs the checks and writes the results to w, as a table or as JSON. It returns false if any check failed.
+func report(w io.Writer, checks []check, asJSON bool) bool {
+	ok := true
+	results := make([]checkResult, len(checks))
+	for i, c := range checks {
+		detail, err := c.fn()
+		results[i] = checkResult{Check: c.name, Result: "OK", Detail: detail}
+		if err != nil {
+			results[i].Result, results[i].Detail, ok = "FAIL", err.Error(), false
+		}
+	}
+	if asJSON {
+		json.NewEncoder(w).Encode(results)
+		return ok
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Check, r.Result, r.Detail)
+	}
+	tw.Flush()
+	return ok
+}
+
+// run runs the command and returns the first line of its output.
+func run(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if err != nil {
+		return "", fmt.Errorf("%s: %s %s", name, err, line)
+	}
+	return line, nil
+}
+
+func testMount() (string, error) {
+	p, err := exec.LookPath("mount")
+	if err != nil {
+		return "", err
+	}
+	if os.Geteuid() != 0 {
+		return "", fmt.Errorf("%s found, but bind mounts need root", p)
+	}
+	return p, nil
+}
+
+func testPackageManager() (string, error) {
+	pm, err := ospkg.New()
+	if err != nil {
+		return "", err
+	}
+	return pm.Name(), nil
+}
+
+// testWrite checks if we can create files in dir, dir is created if it doesn't exist.
+func testWrite(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, ".gitopper-selftest")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return "writable", os.Remove(f.Name())
+}
+
+// mounts returns the unique mount directories of the global config and the services in c.
+func mounts(c Config) []string {
+	seen := map[string]bool{}
+	m := []string{}
+	add := func(s *Service) {
+		if s != nil && s.Mount != "" && !seen[s.Mount] {
+			seen[s.Mount] = true
+			m = append(m, s.Mount)
+		}
+	}
+	add(c.Global)
+	for _, s := range c.Services {
+		add(s)
+	}
+	return m
+}
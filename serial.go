@@ -0,0 +1,46 @@
+package main
+
+import "go.science.ru.nl/log"
+
+// serial runs f, a command from the REST interface, serialized with the reconciles of s. If s is being reconciled
+// f is queued and run, in order, when the reconcile is done, so a command can't interleave with git or systemctl
+// (i.e. a rollback arriving mid-pull). It returns false if f was queued.
+func (s *Service) serial(f func()) bool {
+	if s.op.TryLock() {
+		f()
+		s.unlockOp()
+		return true
+	}
+	s.Lock()
+	s.pending = append(s.pending, f)
+	s.Unlock()
+	// The reconcile may have been done before f was queued, if so run the queue ourselves.
+	if s.op.TryLock() {
+		s.unlockOp()
+		return true
+	}
+	log.Infof("Machine %q, service %q is being reconciled, command queued", s.Machine, s.Service)
+	return false
+}
+
+// lockOp waits until no reconcile or command runs for s and locks it.
+func (s *Service) lockOp() { s.op.Lock() }
+
+// unlockOp runs the queued commands and unlocks s. The queue is checked and op unlocked under the lock of s, so a
+// command is either run here or finds op unlocked.
+func (s *Service) unlockOp() {
+	for {
+		s.Lock()
+		pending := s.pending
+		s.pending = nil
+		if len(pending) == 0 {
+			s.op.Unlock()
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+		for _, f := range pending {
+			f()
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestSerial(t *testing.T) {
+	s := &Service{Service: "test"}
+
+	if !s.serial(func() { s.SetState(StateFreeze, "") }) {
+		t.Fatal("expected command to run")
+	}
+	if st, _ := s.State(); st != StateFreeze {
+		t.Fatalf("expected state %s, got %s", StateFreeze, st)
+	}
+
+	s.lockOp() // reconciling
+	if s.serial(func() { s.SetState(StateRollback, "a") }) {
+		t.Fatal("expected command to be queued")
+	}
+	s.serial(func() { s.SetState(StateRollback, "b") })
+	if st, _ := s.State(); st != StateFreeze {
+		t.Fatalf("expected queued command not to run, got state %s", st)
+	}
+	s.unlockOp()
+	if st, info := s.State(); st != StateRollback || info != "b" {
+		t.Fatalf("expected state %s b, got %s %s", StateRollback, st, info)
+	}
+	if !s.op.TryLock() {
+		t.Fatal("expected op to be unlocked")
+	}
+}
@@ -1,40 +1,121 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
+	"regexp"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/miekg/gitopper/gitcmd"
-	"github.com/miekg/gitopper/osutil"
+	"github.com/miekg/gitopper/mount"
+	"github.com/miekg/gitopper/reconcile"
+	"github.com/miekg/gitopper/systemd"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.science.ru.nl/log"
-	"go.science.ru.nl/mountinfo"
 )
 
+// Backends, see Service.Backend.
+const (
+	backendGit   = "git"
+	backendGoGit = "go-git"
+)
+
+// filterNone disables the partial clone filter, see Service.Filter.
+const filterNone = "none"
+
+// pruneInterval is how often stale branches are pruned from the checkouts.
+const pruneInterval = 24 * time.Hour
+
 // Service contains the service configuration tied to a specific machine.
 type Service struct {
-	Upstream string        // The URL of the (upstream) Git repository.
-	Branch   string        // The branch to track (defaults to 'main').
-	Service  string        // Identifier for the service - will be used for action.
-	Machine  string        // Identifier for this machine - may be shared with multiple machines.
-	Package  string        // The package that might need installing.
-	User     string        // what user to use for checking out the repo.
-	Action   string        // The systemd action to take when files have changed.
-	Mount    string        // Together with Service this is the directory where the sparse git repo is checked out.
-	Dirs     []Dir         // How to map our local directories to the git repository.
-	Duration time.Duration `toml:"_"` // how much to sleep between pulls
-
-	state        State
-	stateInfo    string    // Extra info some states carry.
-	stateStamp   time.Time // When did state change (UTC).
-	hash         string    // Git hash of the current git checkout.
-	sync.RWMutex           // Protects state and friends.
+	Upstream         string            // The URL of the (upstream) Git repository.
+	Mirrors          []string          // Mirrors of Upstream, pulls fail over to the next one when the one in use keeps failing.
+	Bundle           string            // Path to a git bundle that is used instead of Upstream (air-gapped networks).
+	Branch           string            // The branch to track (defaults to 'main').
+	Tag              string            // Track the highest tag matching this glob ("v1.*") or semver constraint ("^1.2", ">=1.2.0 <2") instead of the branch head.
+	Commit           string            // Pin the service to this commit (a full hash), it only moves when the config changes.
+	Secret           string            // Where to get the upstream's token or SSH key path: "file:<path>", "env:<name>" or "exec:<command>".
+	IdentityFile     string            // Private key (deploy key) for an SSH upstream, takes precedence over Secret.
+	CredentialHelper string            // Git credential helper for an HTTP(S) upstream, takes precedence over Secret.
+	Proxy            string            // HTTP(S) or SOCKS proxy for upstream, overrides the network proxy, "none" goes direct.
+	Strategy         string            // How to advance the checkout: ff-only (default), rebase or reset.
+	OnForcePush      string            // What ff-only does when upstream was force pushed: freeze (default), reset or fail.
+	Backend          string            // How to talk to upstream: git (default) runs the git binary, go-git doesn't need git installed.
+	Policy           string            // Command that allows or denies each candidate commit.
+	Validate         string            // Command run in a staged copy of each candidate commit, a non-zero exit status blocks it.
+	RequireSigned    bool              // Only deploy commits (or tags) signed by one of Signers.
+	Signers          []string          // Trusted keys: SSH public keys or GPG fingerprints.
+	HookNetwork      bool              // With -sandbox, allow the policy and validate commands to use the network.
+	BuildNetwork     bool              // With -sandbox, allow the build and the requirements install to use the network.
+	Service          string            // Identifier for the service - will be used for action.
+	Enabled          *bool             // If false the service is not setup nor tracked (defaults to true).
+	Machine          string            // Identifier for this machine - may be shared with multiple machines, may be a glob, /regexp/, @group or !<pattern>.
+	Labels           map[string]string // Labels (from the cloud metadata) a machine must have, instead of matching Machine.
+	Exclude          []string          // Machines (globs or /regexp/) this service is never for.
+	Package          string            // The package that might need installing.
+	Hold             bool              // Hold the package while the service is frozen.
+	PackageManager   string            // Package manager of the package: apt, dnf, yum, snap or flatpak, defaults to the system's.
+	Channel          string            // Channel to pin the package to, only snap supports this.
+	Requirements     string            // Path of a pip requirements file in the repository to install in a virtualenv.
+	Venv             string            // Directory of the virtualenv, defaults to <mount>/<service>.venv.
+	Build            string            // Command to build the service from source in the checkout, i.e. "go build -o app".
+	Artifact         string            // Path of the built binary in the checkout.
+	Manifest         string            // Path of a manifest in the repository with the URL and SHA256 of a binary to download.
+	Install          string            // Where the built or downloaded binary is installed, it is swapped in atomically.
+	Toolchain        string            // Go toolchain to build with (GOTOOLCHAIN), i.e. "go1.21.5".
+	User             string            // what user to use for checking out the repo.
+	Depth            int               // Clone only this many commits of history, 0 (the default) clones all, -lowres defaults it to 1.
+	Filter           string            // Partial clone filter, defaults to "blob:none", "none" clones without a filter.
+	Submodules       bool              // Also check out the submodules in the sparse directories.
+	Env              map[string]string // Environment variables for all commands run for this service: git, systemctl, the package manager and the hooks.
+	Action           string            // The systemd action to take when files have changed, "exec:<command>" to run a plugin, or "nft:<ruleset>" or "iptables:<ruleset>" to apply a firewall ruleset, "zone:bind" or "zone:knot" to check and reload DNS zones.
+	Probe            string            // Health probe: an http(s) URL that must return 2xx, or a command that must exit 0.
+	Mount            string            // Together with Service this is the directory where the sparse git repo is checked out.
+	Dirs             []Dir             // How to map our local directories to the git repository.
+	Priority         int               // Services with a higher priority are started first.
+	Failures         int               // Freeze the service after this many consecutive failures, 0 disables this.
+	MinFree          Size              // Defer applies while less than this is free on the filesystem of Mount, i.e. "2G".
+	MaxLoad          float64           // Defer applies while the 1-minute load average per CPU is above this.
+	Notify           string            // URL to POST notifications to.
+	Attest           string            // URL to POST the provenance of each apply to.
+	Calendar         string            // URL of a change-freeze calendar (iCal or JSON), applies are deferred during a freeze.
+	DropIn           bool              // Write a systemd drop-in with the deployed hash as environment variables.
+	Webhook          string            // Secret used to validate webhooks that trigger a pull.
+	Control          string            // Path of the control file in the repository, see control.go.
+	ControlBranch    string            // Branch holding the control file (defaults to Branch).
+	Config           string            // Path of gitopper's own config in the repository, a change reloads gitopper.
+	Delegate         string            // Directory in the repository with delegated service definitions, see delegate.go.
+	DelegateRoot     string            // Directory the local dirs of delegated services must be in, without it they can't have dirs.
+	Extends          string            // Name of the template (see Config.Templates) this service extends.
+	Interval         Duration          // How often to poll upstream, i.e. "1h", defaults to -d or 30s.
+	Schedule         string            // Cron-style schedule to poll upstream on, instead of Interval.
+	Duration         time.Duration     `toml:"-" yaml:"-" json:"-"` // how much to sleep between pulls
+
+	st           ServiceState         // State of the service, saved in the machine's StateStore.
+	skew         time.Duration        // Estimated clock skew of this machine.
+	machine      *Machine             // The machine we run on.
+	sched        *reconcile.Scheduler // The scheduler reconciling this service.
+	job          *job                 // What sched reconciles for this service.
+	reconcile    uint64               // ID of the current reconcile (see reconcileOnce), used in exemplars.
+	timing       *timing              // Phases of the current reconcile, nil outside of one.
+	pullFailures int                  // Consecutive failed pulls from the upstream in use, see failover.
+	pullErrors   int                  // Consecutive failed pulls, see backoff.
+	pruned       time.Time            // When the checkout was last pruned.
+	delegated    bool                 // The delegated services were read with the config.
+	built        string               // Hash we've last built.
+	group        []string             // Hosts of the group if Machine is "@<group>", see Config.Groups.
+	network      *Network             // See Config.Network.
+	op           sync.Mutex           // Serializes reconciles and commands, see serial.go.
+	pending      []func()             // Commands queued while reconciling.
+	sync.RWMutex                      // Protects state and friends.
 }
 
+// Dir maps a subdirectory of the repository to a local directory, it is bind mounted there. In the config it can
+// also be written as a string: "<link>[:<local>]", where local defaults to /<link>.
 type Dir struct {
 	Local string // The directory on the local filesystem.
 	Link  string // The subdirectory inside the git repo to map to.
@@ -48,6 +129,8 @@ const (
 	StateFreeze                // The service is locked to the current commit, no further updates are done.
 	StateRollback              // The service is rolled back and locked to that commit, no further updates are done.
 	StateBroken                // The service is broken, i.e. didn't start, systemctl error, etc.
+	StateDisabled              // The service is disabled, it's not tracked.
+	StateDegraded              // The checkout is current, but the unit of the service failed.
 )
 
 func (s State) String() string {
@@ -60,6 +143,10 @@ func (s State) String() string {
 		return "ROLLBACK"
 	case StateBroken:
 		return "BROKEN"
+	case StateDisabled:
+		return "DISABLED"
+	case StateDegraded:
+		return "DEGRADED"
 	}
 	return ""
 }
@@ -67,182 +154,811 @@ func (s State) String() string {
 func (s *Service) State() (State, string) {
 	s.RLock()
 	defer s.RUnlock()
-	return s.state, s.stateInfo
+	return s.st.State, s.st.StateInfo
 }
 
 func (s *Service) SetState(st State, info string) {
 	s.Lock()
-	defer s.Unlock()
-	s.stateStamp = time.Now().UTC()
-	s.state = st
-	s.stateInfo = info
+	prev := s.st.State
+	defer func() {
+		s.Unlock()
+		if s.Hold {
+			s.holdPackage(prev, st)
+		}
+	}()
+	s.st.Stamp = time.Now().UTC()
+	s.st.State = st
+	s.st.StateInfo = info
+	s.save()
 
-	metricServiceHash.WithLabelValues(s.Service, s.hash, s.state.String()).Set(1)
+	metricServiceHash.WithLabelValues(s.Service, s.st.Hash, s.st.State.String()).Set(1)
 }
 
 func (s *Service) Hash() string {
 	s.RLock()
 	defer s.RUnlock()
-	return s.hash
+	return s.st.Hash
 }
 
+// SetHash sets the hash of the current git checkout. An empty hash (i.e. git failed) is ignored.
 func (s *Service) SetHash(h string) {
+	s.Lock()
+	if h == "" || h == s.st.Hash {
+		s.Unlock()
+		return
+	}
+	s.st.PrevHash = s.st.Hash
+	s.st.Hash = h
+	s.st.Applied = time.Now().UTC()
+	s.save()
+	s.Unlock()
+
+	s.exportState()
+}
+
+// save saves the state of s in the machine's store, the caller must hold the lock.
+func (s *Service) save() {
+	if s.machine == nil || s.machine.Store == nil {
+		return
+	}
+	if err := s.machine.Store.Save(s.Service, s.st); err != nil {
+		log.Warningf("Machine %q, failed to save state of service %q: %s", s.Machine, s.Service, err)
+	}
+}
+
+// load loads the state of s from the machine's store, if there is any.
+func (s *Service) load() {
+	if s.machine == nil || s.machine.Store == nil {
+		return
+	}
+	st, ok, err := s.machine.Store.Load(s.Service)
+	if err != nil {
+		log.Warningf("Machine %q, failed to load state of service %q: %s", s.Machine, s.Service, err)
+		return
+	}
+	if !ok {
+		return
+	}
 	s.Lock()
 	defer s.Unlock()
-	s.hash = h
+	s.st = st
+	log.Infof("Machine %q, service %q loaded state %s", s.Machine, s.Service, s.st.State)
+}
+
+func (s *Service) Skew() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	return s.skew
+}
+
+// Approve approves commit hash: when it's the candidate commit, its policy and validation are skipped.
+func (s *Service) Approve(hash string) {
+	s.Lock()
+	defer s.Unlock()
+	s.st.Approved = hash
+	s.save()
+}
+
+// Approved returns the commit an operator approved.
+func (s *Service) Approved() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.st.Approved
+}
+
+func (s *Service) SetSkew(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.skew = d
+}
+
+// Wake makes the scheduler reconcile the service immediately instead of waiting for the next poll.
+func (s *Service) Wake() {
+	s.RLock()
+	sc, j := s.sched, s.job
+	s.RUnlock()
+	if sc != nil {
+		log.Infof("Machine %q, service %q woken up", s.Machine, s.Service)
+		sc.Wakeup(j)
+	}
 }
 
 func (s *Service) Change() time.Time {
 	s.RLock()
 	defer s.RUnlock()
-	return s.stateStamp
+	return s.st.Stamp
+}
+
+// ResetFailures resets the number of consecutive failures.
+func (s *Service) ResetFailures() {
+	s.Lock()
+	defer s.Unlock()
+	s.st.Failures = 0
+	s.save()
+}
+
+// fail sets s to BROKEN with info and counts the failure for the breaker. reconcileOnce calls it once for a failed
+// reconcile, the BROKEN states set elsewhere don't count.
+func (s *Service) fail(info string) {
+	s.Lock()
+	s.st.Failures++
+	s.Unlock()
+	s.SetState(StateBroken, info)
 }
 
-// merge merges anything defined in s1 into s and returns the new Service. Currently this is only
-// done for the Upstream field.
+// breaker checks if the number of consecutive failures exceeds s.Failures, if so the service is frozen.
+// It returns true when the breaker tripped.
+func (s *Service) breaker() bool {
+	s.RLock()
+	failures, state := s.st.Failures, s.st.State
+	s.RUnlock()
+	if s.Failures == 0 || failures < s.Failures || state != StateBroken {
+		return false
+	}
+
+	log.Warningf("Machine %q, service %q failed %d times in a row, freezing", s.Machine, s.Service, failures)
+	s.SetState(StateFreeze, fmt.Sprintf("BREAKER: %d consecutive failures", failures))
+	metricServiceBreaker.WithLabelValues(s.Service).Inc()
+	s.notify(fmt.Sprintf("Service %q failed %d times in a row and is frozen", s.Service, failures))
+	return true
+}
+
+// merge merges anything defined in s1 into s and returns the new Service. Currently this is
+// done for the Upstream, Mirrors, Failures, Notify, Attest, Calendar, DropIn, Webhook, Strategy,
+// OnForcePush, Backend, Policy, Secret, Proxy, MinFree, MaxLoad, Interval and Schedule fields.
 func (s *Service) merge(s1 *Service, d time.Duration) *Service {
 	if s1.Upstream != "" {
 		s.Upstream = s1.Upstream
 	}
+	if s.Failures == 0 {
+		s.Failures = s1.Failures
+	}
+	if s.Notify == "" {
+		s.Notify = s1.Notify
+	}
+	if s.Attest == "" {
+		s.Attest = s1.Attest
+	}
+	if s.Calendar == "" {
+		s.Calendar = s1.Calendar
+	}
+	if !s.DropIn {
+		s.DropIn = s1.DropIn
+	}
+	if s.Webhook == "" {
+		s.Webhook = s1.Webhook
+	}
+	if s.Strategy == "" {
+		s.Strategy = s1.Strategy
+	}
+	if s.OnForcePush == "" {
+		s.OnForcePush = s1.OnForcePush
+	}
+	if s.Backend == "" {
+		s.Backend = s1.Backend
+	}
+	if s.Policy == "" {
+		s.Policy = s1.Policy
+	}
+	if s.Secret == "" {
+		s.Secret = s1.Secret
+	}
+	if s.Proxy == "" {
+		s.Proxy = s1.Proxy
+	}
+	if len(s.Mirrors) == 0 {
+		s.Mirrors = s1.Mirrors
+	}
+	if s.MinFree == 0 {
+		s.MinFree = s1.MinFree
+	}
+	if s.MaxLoad == 0 {
+		s.MaxLoad = s1.MaxLoad
+	}
+	if s.Interval == 0 {
+		s.Interval = s1.Interval
+	}
+	if s.Schedule == "" {
+		s.Schedule = s1.Schedule
+	}
 	s.Duration = d
+	if s.Interval > 0 {
+		s.Duration = time.Duration(s.Interval)
+	}
 	if s.Branch == "" {
 		s.Branch = "main"
 	}
 	return s
 }
 
-// forMe compares the hostnames with the service machine name, it there is a match for service is for us.
-func (s *Service) forMe(hostnames []string) bool {
+// next returns when s should be polled after now, following Schedule if set, otherwise Duration with jitter. When
+// pulls keep failing Duration is backed off exponentially.
+func (s *Service) next(now time.Time) time.Time {
+	if s.Schedule != "" {
+		if sc, err := parseSchedule(s.Schedule); err == nil {
+			if t := sc.next(now); !t.IsZero() {
+				return t
+			}
+		}
+	}
+	return now.Add(jitter(backoff(s.Duration, s.pullErrors)))
+}
+
+// forMe matches the hostnames against the service machine name (see matchMachine) or the hosts in its group, it
+// there is a match for service is for us. If the service has labels, all of them must be present in labels instead.
+// A machine name of "!<pattern>" matches when none of the hostnames match pattern, and if any hostname matches
+// Exclude the service is never for us.
+func (s *Service) forMe(hostnames []string, labels map[string]string) bool {
+	for _, h := range hostnames {
+		if matchAny(s.Exclude, h) {
+			return false
+		}
+	}
+	if len(s.Labels) > 0 {
+		for k, v := range s.Labels {
+			if v1, ok := labels[k]; !ok || v1 != v {
+				return false
+			}
+		}
+		return true
+	}
+	if strings.HasPrefix(s.Machine, "!") {
+		for _, h := range hostnames {
+			if matchAny([]string{s.Machine[1:]}, h) {
+				return false
+			}
+		}
+		return true
+	}
+	patterns := []string{s.Machine}
+	if _, ok := group(s.Machine); ok {
+		patterns = s.group
+	}
 	for _, h := range hostnames {
-		if h == s.Machine {
+		if matchAny(patterns, h) {
 			return true
 		}
 	}
 	return false
 }
 
+// matchAny returns true if h matches any of the patterns.
+func matchAny(patterns []string, h string) bool {
+	for _, p := range patterns {
+		if ok, _ := matchMachine(p, h); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMachine matches the hostname h against pattern, which is a hostname, a glob ("web-*") or a regular
+// expression between slashes ("/^db-[0-9]+$/"). An error is returned for an invalid pattern.
+func matchMachine(pattern, h string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(h), nil
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return pattern == h, nil
+	}
+	return path.Match(pattern, h)
+}
+
 func (s *Service) newGitCmd() *gitcmd.Git {
 	dirs := []string{}
 	for _, d := range s.Dirs {
 		dirs = append(dirs, d.Link)
 	}
-	return gitcmd.New(s.Upstream, s.Branch, path.Join(s.Mount, s.Service), s.User, dirs)
+	upstream := s.remote()
+	if s.Bundle != "" {
+		upstream = s.Bundle
+	}
+	gc := gitcmd.New(upstream, s.Branch, path.Join(s.Mount, s.Service), s.User, dirs)
+	gc.Observe(func(network bool, d time.Duration) {
+		if network && s.timing != nil {
+			s.timing.network(d)
+		}
+	})
+	if s.machine != nil && s.machine.LowRes {
+		gc.Depth(1)
+	}
+	if s.Depth > 0 {
+		gc.Depth(s.Depth)
+	}
+	switch s.Filter {
+	case "":
+	case filterNone:
+		gc.Filter("")
+	default:
+		gc.Filter(s.Filter)
+	}
+	if s.Backend == backendGoGit {
+		gc.GoGit()
+	}
+	if s.Submodules {
+		gc.Submodules()
+	}
+	if s.Commit != "" {
+		gc.Pin(s.Commit)
+	}
+	if s.Secret != "" {
+		gc.Secret(s.secret)
+	}
+	if s.IdentityFile != "" {
+		gc.IdentityFile(s.IdentityFile)
+	}
+	if s.CredentialHelper != "" {
+		gc.CredentialHelper(s.CredentialHelper)
+	}
+	s.network.apply(gc)
+	switch s.Proxy {
+	case "":
+	case proxyNone:
+		gc.Proxy("")
+	default:
+		gc.Proxy(s.Proxy)
+	}
+	gc.Env(s.envs())
+	return gc
 }
 
-// TrackUpstream does all the administration to track upstream and issue systemctl commands to keep the process
-// informed.
-func (s *Service) trackUpstream(ctx context.Context) {
-	gc := s.newGitCmd()
+// rollback checks out hash, runs the action and freezes s. On error s is BROKEN, as it is when s requires signed
+// commits and hash isn't. The caller must hold the op lock.
+func (s *Service) rollback(gc *gitcmd.Git, hash string) error {
+	defer s.timed()()
+	start, prev := time.Now(), s.Hash()
+	if s.RequireSigned {
+		s.begin(phaseHooks)
+		if err := gc.Verify(hash, s.Signers); err != nil {
+			log.Warningf("Machine %q, signature of %s for service %q: %s", s.Machine, hash, s.Service, err)
+			s.SetState(StateBroken, unsigned+hash+": "+err.Error())
+			s.journal(prev, hash, "", start, true, err)
+			return err
+		}
+	}
+	s.begin(phaseCheckout)
+	if err := gc.Rollback(hash); err != nil {
+		log.Warningf("Machine %q, error rollback repo %q to %q: %s", s.Machine, s.Upstream, hash, err)
+		s.SetState(StateBroken, fmt.Sprintf("error rolling back %q to %q: %s", s.Upstream, hash, err))
+		s.journal(prev, hash, "", start, true, err)
+		return err
+	}
+	s.SetHash(gc.Hash())
+	summary, _ := gc.Summary(prev, hash)
+
+	s.begin(phaseRestart)
+	if err := s.systemctl(); err != nil {
+		log.Warningf("Machine %q, error running systemctl: %s", s.Machine, err)
+		s.SetState(StateBroken, fmt.Sprintf("error running systemctl %q: %s", s.Upstream, err))
+		s.journal(prev, hash, summary, start, true, err)
+		return err
+	}
+	log.Warningf("Machine %q, successfully rollback repo %q to %s", s.Machine, s.Upstream, hash)
+	s.SetState(StateFreeze, "ROLLBACK: "+hash)
+	s.journal(prev, hash, summary, start, true, nil)
+	return nil
+}
 
-	log.Infof("Launched tracking routine for %q/%q", s.Machine, s.Service)
+// reconcileOnce does a single reconcile of the service: it handles the control file and rollbacks, and pulls
+// from upstream, applying any change.
+func (s *Service) reconcileOnce(gc *gitcmd.Git) {
+	if s.machine.Maintenance() {
+		log.Debugf("Machine %q is in maintenance, not reconciling service %q", s.Machine, s.Service)
+		return
+	}
+	state, info := s.State()
+	s.reconcile++
+	defer s.timed()()
+	s.useRemote(gc, false)
+
+	if s.Control != "" {
+		s.control(gc)
+		state, info = s.State()
+	}
 
-	for {
-		s.SetHash(gc.Hash())
-		state, info := s.State()
+	// this in now only done once... because we set state to broken... Should we keep trying??
+	if state == StateRollback && info != s.Hash() {
+		s.rollback(gc, info)
+		return
+	}
+
+	if state, _ := s.State(); state == StateFreeze || state == StateRollback || state == StateDisabled {
+		log.Warningf("Machine %q is service %q is %s, not pulling", s.Machine, s.Service, state)
+		return
+	}
 
-		select {
-		case <-time.After(s.Duration):
-		case <-ctx.Done():
+	if frozen, reason := s.frozen(time.Now()); frozen && !s.machine.Override() {
+		if state, info := s.State(); info != changeFreeze+reason {
+			log.Warningf("Machine %q, change freeze, deferring applies of service %q: %s", s.Machine, s.Service, reason)
+			s.SetState(state, changeFreeze+reason)
+		}
+		return
+	}
+	if state, info := s.State(); strings.HasPrefix(info, changeFreeze) {
+		log.Infof("Machine %q, change freeze ended for service %q", s.Machine, s.Service)
+		s.SetState(state, "")
+	}
+
+	if s.Bundle != "" && !exists(s.Bundle) {
+		log.Infof("Machine %q, bundle %q not present, not pulling", s.Machine, s.Bundle)
+		return
+	}
+
+	s.begin(phaseFetch)
+	if s.Tag != "" {
+		tag, err := s.track(gc)
+		if err != nil {
+			log.Warningf("Machine %q, error listing tags of %q: %s", s.Machine, s.Upstream, err)
+			s.fail(fmt.Sprintf("error listing tags of %q: %s", s.Upstream, err))
 			return
 		}
+		if tag == "" {
+			log.Warningf("Machine %q, no tag in %q matches %q for service %q", s.Machine, s.Upstream, s.Tag, s.Service)
+			return
+		}
+		log.Debugf("Machine %q, service %q tracks tag %q", s.Machine, s.Service, tag)
+	}
 
-		// this in now only done once... because we set state to broken... Should we keep trying??
-		if state == StateRollback && info != s.hash {
-			if err := gc.Rollback(info); err != nil {
-				log.Warningf("Machine %q, error rollback repo %q to %q: %s", s.Machine, s.Upstream, info, err)
-				s.SetState(StateBroken, fmt.Sprintf("error rolling back %q to %q: %s", s.Upstream, info, err))
-				continue
-			}
+	if s.machine != nil && s.machine.LowRes {
+		if hash, err := gc.Remote(); err == nil && hash == s.Hash() {
+			log.Debugf("Machine %q, no change upstream in %q", s.Machine, s.Upstream)
+			return
+		}
+	}
+
+	if reason := s.resources(); reason != "" {
+		if state, info := s.State(); info != lowResources+reason {
+			log.Warningf("Machine %q, deferring applies of service %q: %s", s.Machine, s.Service, reason)
+			s.SetState(state, lowResources+reason)
+		}
+		return
+	}
+	if state, info := s.State(); strings.HasPrefix(info, lowResources) {
+		log.Infof("Machine %q, resources are back for service %q", s.Machine, s.Service)
+		s.SetState(state, "")
+	}
+
+	s.begin(phaseHooks)
+	// Upstream is fetched once, the hooks vet that commit and Pull advances to exactly it, so nothing pushed in
+	// between can slip in unchecked.
+	target := ""
+	if s.RequireSigned || s.Policy != "" || s.Validate != "" {
+		hash, err := gc.Fetch()
+		if err != nil {
+			log.Warningf("Machine %q, error fetching repo %q: %s", s.Machine, gc.Upstream(), err)
+			s.fail(fmt.Sprintf("error fetching %q: %s", gc.Upstream(), err))
+			s.failover(gc)
+			s.pullErrors++
+			return
+		}
+		target = hash
+	}
 
-			if err := s.systemctl(); err != nil {
-				log.Warningf("Machine %q, error running systemctl: %s", s.Machine, err)
-				s.SetState(StateBroken, fmt.Sprintf("error running systemctl %q: %s", s.Upstream, err))
-				continue
+	// Nothing of an unverified commit may reach the policy and validate commands.
+	if s.RequireSigned {
+		if err := gc.Verify(target, s.Signers); err != nil {
+			hash := target
+			_, info := s.State()
+			s.fail(unsigned + hash + ": " + err.Error())
+			if info != unsigned+hash+": "+err.Error() {
+				log.Warningf("Machine %q, signature of %s for service %q: %s", s.Machine, hash, s.Service, err)
+				s.notify(fmt.Sprintf("Service %q, signature of %s: %s", s.Service, hash, err))
 			}
-			log.Warningf("Machine %q, successfully rollback repo %q to %s", s.Machine, s.Upstream, info)
-			s.SetState(StateFreeze, "ROLLBACK: "+info)
-			continue
+			return
 		}
+		if state, info := s.State(); strings.HasPrefix(info, unsigned) && state == StateBroken {
+			s.SetState(StateOK, "")
+		}
+	}
 
-		if state, _ := s.State(); state == StateFreeze || state == StateRollback {
-			log.Warningf("Machine %q is service %q is %s, not pulling", s.Machine, s.Service, state)
-			continue
+	approved := target != "" && target == s.Approved()
+	if approved && (s.Policy != "" || s.Validate != "") {
+		log.Infof("Machine %q, %s is approved for service %q, skipping policy and validation", s.Machine, target, s.Service)
+	}
+
+	if s.Policy != "" && !approved {
+		hash := target
+		allow, reason, err := s.policy(gc, hash)
+		if err != nil {
+			log.Warningf("Machine %q, error evaluating policy for service %q: %s", s.Machine, s.Service, err)
+			s.fail(fmt.Sprintf("error evaluating policy %q: %s", s.Policy, err))
+			return
+		}
+		if !allow {
+			if state, info := s.State(); info != policyDenied+hash+": "+reason {
+				log.Warningf("Machine %q, policy denied %s for service %q: %s", s.Machine, hash, s.Service, reason)
+				s.SetState(state, policyDenied+hash+": "+reason)
+				s.notify(fmt.Sprintf("Service %q, policy denied %s: %s", s.Service, hash, reason))
+			}
+			return
 		}
+	}
 
-		changed, err := gc.Pull()
+	if s.Validate != "" && !approved {
+		hash := target
+		ok, reason, err := s.validate(gc, hash)
 		if err != nil {
-			log.Warningf("Machine %q, error pulling repo %q: %s", s.Machine, s.Upstream, err)
-			s.SetState(StateBroken, fmt.Sprintf("error pulling %q: %s", s.Upstream, err))
-			continue
+			log.Warningf("Machine %q, error validating service %q: %s", s.Machine, s.Service, err)
+			s.fail(fmt.Sprintf("error validating %q: %s", s.Validate, err))
+			return
+		}
+		if !ok {
+			if state, info := s.State(); info != validateInvalid+hash+": "+reason {
+				log.Warningf("Machine %q, validation of %s failed for service %q: %s", s.Machine, hash, s.Service, reason)
+				s.SetState(state, validateInvalid+hash+": "+reason)
+				s.notify(fmt.Sprintf("Service %q, validation of %s failed: %s", s.Service, hash, reason))
+			}
+			return
+		}
+	}
+
+	start := time.Now()
+	s.begin(phaseCheckout)
+	changed, err := gc.Pull(gitcmd.Strategy(s.Strategy), target)
+	metricServicePull.WithLabelValues(s.Service).(prometheus.ExemplarObserver).ObserveWithExemplar(
+		time.Since(start).Seconds(), s.exemplar(gc.Hash()),
+	)
+	if err == gitcmd.ErrNotFastForward {
+		switch s.OnForcePush {
+		case "reset":
+			log.Warningf("Machine %q, upstream %q is not a descendant of %s, resetting", s.Machine, s.Upstream, s.Hash())
+			s.notify(fmt.Sprintf("Service %q is reset to upstream %q, it is not a descendant of %s", s.Service, s.Upstream, s.Hash()))
+			changed, err = gc.Pull(gitcmd.Reset, target)
+		case "fail":
+			info := fmt.Sprintf("upstream is not a descendant of %s", s.Hash())
+			if _, info1 := s.State(); info1 != info {
+				log.Warningf("Machine %q, upstream %q is not a descendant of %s, failing", s.Machine, s.Upstream, s.Hash())
+				s.notify(fmt.Sprintf("Service %q is broken, upstream %q is not a descendant of %s", s.Service, s.Upstream, s.Hash()))
+			}
+			s.fail(info)
+			return
+		default:
+			log.Warningf("Machine %q, upstream %q is not a descendant of %s, freezing", s.Machine, s.Upstream, s.Hash())
+			s.SetState(StateFreeze, fmt.Sprintf("upstream is not a descendant of %s", s.Hash()))
+			s.notify(fmt.Sprintf("Service %q is frozen, upstream %q is not a descendant of %s", s.Service, s.Upstream, s.Hash()))
+			return
+		}
+	}
+	if err != nil {
+		log.Warningf("Machine %q, error pulling repo %q: %s", s.Machine, gc.Upstream(), err)
+		s.fail(fmt.Sprintf("error pulling %q: %s", gc.Upstream(), err))
+		s.failover(gc)
+		s.pullErrors++
+		return
+	}
+	s.pullFailures, s.pullErrors = 0, 0
+
+	s.checkSkew(gc)
+
+	if time.Since(s.pruned) > pruneInterval {
+		if err := gc.Prune(); err != nil {
+			log.Warningf("Machine %q, error pruning repo %q: %s", s.Machine, s.Upstream, err)
 		}
+		s.pruned = time.Now()
+	}
+
+	if !changed {
+		log.Infof("Machine %q, no diff in repo %q", s.Machine, s.Upstream)
+		s.ResetFailures()
+		return
+	}
+
+	prev := s.Hash()
+	s.SetHash(gc.Hash())
+	state, info = s.State()
+	if strings.HasPrefix(info, policyDenied) || strings.HasPrefix(info, validateInvalid) {
+		info = ""
+	}
+	s.SetState(state, info)
+
+	summary, err := gc.Summary(prev, s.Hash())
+	if err == nil {
+		log.Infof("Machine %q, service %q advanced from %s to %s:\n%s", s.Machine, s.Service, prev, s.Hash(), summary)
+		s.notify(fmt.Sprintf("Service %q advanced from %s to %s:\n%s", s.Service, prev, s.Hash(), summary))
+	}
+
+	log.Infof("Machine %q, diff in repo %q, pinging service: %s", s.Machine, s.Upstream, s.Service)
+	s.begin(phaseRestart)
+	if err := s.systemctl(); err != nil {
+		log.Warningf("Machine %q, error running systemctl: %s", s.Machine, err)
+		s.fail(fmt.Sprintf("error running systemctl %q: %s", s.Upstream, err))
+		s.journal(prev, s.Hash(), summary, start, false, err)
+		return
+	}
+	s.begin(phaseProbe)
+	if err := s.probe(probeTimeout); err != nil {
+		log.Warningf("Machine %q, service %q is unhealthy: %s", s.Machine, s.Service, err)
+		s.fail(fmt.Sprintf("health probe failed: %s", err))
+		s.journal(prev, s.Hash(), summary, start, false, err)
+		return
+	}
+	s.journal(prev, s.Hash(), summary, start, false, nil)
+	s.ResetFailures()
 
-		if !changed {
-			log.Infof("Machine %q, no diff in repo %q", s.Machine, s.Upstream)
+	for _, config := range []string{s.Config, s.Delegate} {
+		if config == "" || prev == "" {
 			continue
 		}
+		if changed, err := gc.Changed(prev, s.Hash(), config); err == nil && changed {
+			log.Infof("Machine %q, config %q changed in service %q, reloading", s.Machine, config, s.Service)
+			select {
+			case signals <- syscall.SIGHUP:
+			default: // reload already pending
+			}
+			break
+		}
+	}
+}
 
-		s.SetHash(gc.Hash())
-		state, info = s.State()
-		s.SetState(state, info)
+// setup does the initial checkout, sets up the bind mounts and restarts the service if needed. Any error is
+// also reflected in the state of the service.
+func (s *Service) setup() error {
+	defer s.timed()()
+	gc := s.newGitCmd()
+
+	// Initial checkout - if needed.
+	s.begin(phaseCheckout)
+	fresh := !gc.IsCheckedOut()
+	err := gc.Checkout()
+	if err != nil {
+		log.Warningf("Machine %q, error pulling repo %q: %s", s.Machine, gc.Upstream(), err)
+		s.SetState(StateBroken, fmt.Sprintf("error pulling %q: %s", gc.Upstream(), err))
+		s.failover(gc)
+		s.pullErrors++
+		return err
+	}
+	s.pullErrors = 0
+	s.useRemote(gc, true)
+
+	// The clone is of the branch, but a tag or pinned commit must be what's deployed from the start. An existing
+	// checkout of a frozen or rolled back service is left as is.
+	state, _ := s.State()
+	if (s.Tag != "" || s.Commit != "") && (fresh || (state != StateFreeze && state != StateRollback)) {
+		if err := s.detach(gc); err != nil {
+			log.Warningf("Machine %q, error checking out %q for service %q: %s", s.Machine, s.Tag+s.Commit, s.Service, err)
+			s.SetState(StateBroken, fmt.Sprintf("error checking out %q: %s", s.Tag+s.Commit, err))
+			return err
+		}
+	}
+
+	// Never mount an unverified checkout.
+	if s.RequireSigned {
+		s.begin(phaseHooks)
+		if hash, err := s.signedCheckout(gc); err != nil {
+			log.Warningf("Machine %q, signature of %s for service %q: %s", s.Machine, hash, s.Service, err)
+			s.SetState(StateBroken, unsigned+hash+": "+err.Error())
+			return err
+		}
+	}
 
-		log.Infof("Machine %q, diff in repo %q, pinging service: %s", s.Machine, s.Upstream, s.Service)
-		if err := s.systemctl(); err != nil {
+	s.SetHash(gc.Hash())
+	log.Infof("Machine %q, repository in %q with %q", s.Machine, gc.Repo(), s.Hash())
+	if state, _ := s.State(); state == StateBroken {
+		s.SetState(StateOK, "")
+	}
+	s.reloadDelegated()
+
+	if s.machine.Standby() {
+		log.Infof("Machine %q is in standby, not activating service %q", s.Machine, s.Service)
+		return nil
+	}
+	return s.activate()
+}
+
+// detach checks out the pinned commit, or the highest tag that matches s.Tag, on a detached HEAD.
+func (s *Service) detach(gc *gitcmd.Git) error {
+	if s.Commit == "" {
+		tag, err := s.track(gc)
+		if err != nil {
+			return err
+		}
+		if tag == "" {
+			return fmt.Errorf("no tag in %q matches %q", s.Upstream, s.Tag)
+		}
+	}
+	_, err := gc.Pull(gitcmd.Strategy(s.Strategy), "")
+	return err
+}
+
+// activate sets up the bind mounts and restarts the service if anything got mounted. Any error is also
+// reflected in the state of the service.
+func (s *Service) activate() error {
+	defer s.timed()()
+	start := time.Now()
+	s.begin(phaseMount)
+	mounts, err := s.bindmount()
+	if err != nil {
+		log.Warningf("Machine %q, error setting up bind mounts for %q: %s", s.Machine, s.Upstream, err)
+		s.SetState(StateBroken, fmt.Sprintf("error setting up bind mounts repo %q: %s", s.Upstream, err))
+		return err
+	}
+
+	// Restart any services as they see new files in their bindmounts. Do this here, because we can't be
+	// sure there is an update to a newer commit that would also kick off a restart.
+	if mounts > 0 {
+		s.begin(phaseRestart)
+		err := s.systemctl()
+		if err != nil {
 			log.Warningf("Machine %q, error running systemctl: %s", s.Machine, err)
 			s.SetState(StateBroken, fmt.Sprintf("error running systemctl %q: %s", s.Upstream, err))
-			continue
+			// no error; maybe git pull will make this work later
 		}
+		s.journal("", s.Hash(), "", start, false, err)
+	}
+	return nil
+}
+
+// IsEnabled returns true if the service is enabled in the config.
+func (s *Service) IsEnabled() bool { return s.Enabled == nil || *s.Enabled }
+
+// enable sets a disabled service to OK. Only a disabled service can be enabled, it doesn't unfreeze.
+func (s *Service) enable() error {
+	if state, _ := s.State(); state != StateDisabled {
+		return fmt.Errorf("service is %s, not %s", state, StateDisabled)
 	}
+	s.SetState(StateOK, "")
+	return nil
 }
 
+// stop stops the unit of the service.
+func (s *Service) stop() error { return systemd.Systemctl("stop", s.Service, s.environ()...) }
+
 func (s *Service) systemctl() error {
 	if s.Action == "" {
 		return nil
 	}
-	ctx := context.TODO()
-	cmd := exec.CommandContext(ctx, "systemctl", s.Action, s.Service)
-	log.Infof("running %v", cmd.Args)
-	return cmd.Run()
+	if s.machine.Standby() {
+		log.Infof("Machine %q is in standby, not running systemctl for %q", s.Machine, s.Service)
+		return nil
+	}
+	if s.DropIn {
+		if err := s.dropIn(); err != nil {
+			return err
+		}
+	}
+	if s.Requirements != "" {
+		if err := s.virtualenv(); err != nil {
+			return err
+		}
+	}
+	if s.Build != "" {
+		if err := s.build(); err != nil {
+			return err
+		}
+	}
+	if s.Manifest != "" {
+		if err := s.download(); err != nil {
+			return err
+		}
+	}
+	if fw, ruleset, ok := firewallAction(s.Action); ok {
+		return s.firewall(fw, ruleset)
+	}
+	if strings.HasPrefix(s.Action, zonePrefix) {
+		return s.zones(strings.TrimPrefix(s.Action, zonePrefix))
+	}
+	if strings.HasPrefix(s.Action, execPrefix) {
+		return s.plugin(strings.TrimPrefix(s.Action, execPrefix))
+	}
+	return systemd.Systemctl(s.Action, s.Service, s.environ()...)
 }
 
 // bindmount sets up the bind mount, the return integer returns how many mounts were performed.
 func (s *Service) bindmount() (int, error) {
 	mounted := 0
 	for _, d := range s.Dirs {
-		gitdir := path.Join(s.Mount, s.Service)
-		gitdir = path.Join(gitdir, d.Link)
-
-		if !exists(d.Local) {
-			if err := os.MkdirAll(d.Local, 0775); err != nil {
-				log.Errorf("Directory %q can not be created", d.Local)
-				return 0, fmt.Errorf("failed to create directory %q: %s", d.Local, err)
-			}
-			// set base to correct owner
-			uid, gid := osutil.User(s.User)
-			if err := os.Chown(path.Base(d.Local), int(uid), int(gid)); err != nil {
-				log.Errorf("Directory %q can not be chown to %q: %s", d.Local, s.User, err)
-				return 0, fmt.Errorf("failed to chown directory %q to %q: %s", d.Local, s.User, err)
-			}
-		}
-
-		if ok, err := mountinfo.Mounted(d.Local); err == nil && ok {
-			log.Infof("Directory %q is already mounted", d.Local)
-			continue
-		}
-
-		ctx := context.TODO()
-		cmd := exec.CommandContext(ctx, "mount", "-r", "--bind", gitdir, d.Local)
-		log.Infof("running %v", cmd.Args)
-		err := cmd.Run()
+		gitdir := path.Join(s.Mount, s.Service, d.Link)
+		ok, err := mount.Bind(gitdir, d.Local, s.User)
 		if err != nil {
-			if exitError, ok := err.(*exec.ExitError); ok {
-				if e := exitError.ExitCode(); e != 0 {
-					return 0, fmt.Errorf("failed to mount %q, exit code %d", gitdir, e)
-				}
-			}
-			return 0, fmt.Errorf("failed to mount %q: %s", gitdir, err)
+			return 0, err
+		}
+		if ok {
+			mounted++
 		}
-		mounted++
-
 	}
 	return mounted, nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestMatchMachine(t *testing.T) {
+	tests := []struct {
+		pattern string
+		h       string
+		exp     bool
+	}{
+		{"web-1", "web-1", true},
+		{"web-1", "web-10", false},
+		{"web-*", "web-10", true},
+		{"web-*", "db-1", false},
+		{"db-[0-9]", "db-7", true},
+		{"/^db-[0-9]+$/", "db-42", true},
+		{"/^db-[0-9]+$/", "db-42.example.org", false},
+		{"/example\\.org$/", "db-42.example.org", true},
+		{"/", "/", true},
+	}
+	for _, tc := range tests {
+		got, err := matchMachine(tc.pattern, tc.h)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.pattern, err)
+		}
+		if got != tc.exp {
+			t.Errorf("%q matching %q: expected %t, got %t", tc.pattern, tc.h, tc.exp, got)
+		}
+	}
+
+	for _, pattern := range []string{"/db-[0-9+/", "db-[0-9"} {
+		if _, err := matchMachine(pattern, ""); err == nil {
+			t.Errorf("%q: expected error, got none", pattern)
+		}
+	}
+}
+
+func TestForMeExclude(t *testing.T) {
+	tests := []struct {
+		s   *Service
+		h   string
+		exp bool
+	}{
+		{&Service{Machine: "!canary-*"}, "web-1", true},
+		{&Service{Machine: "!canary-*"}, "canary-1", false},
+		{&Service{Machine: "*", Exclude: []string{"canary-*", "/^db-/"}}, "web-1", true},
+		{&Service{Machine: "*", Exclude: []string{"canary-*", "/^db-/"}}, "db-2", false},
+		{&Service{Labels: map[string]string{"role": "web"}, Exclude: []string{"canary-*"}}, "canary-1", false},
+		{&Service{Labels: map[string]string{"role": "web"}, Exclude: []string{"canary-*"}}, "web-1", true},
+	}
+	for i, tc := range tests {
+		if got := tc.s.forMe([]string{tc.h}, map[string]string{"role": "web"}); got != tc.exp {
+			t.Errorf("test %d, %q: expected %t, got %t", i, tc.h, tc.exp, got)
+		}
+	}
+}
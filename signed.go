@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/gitopper/gitcmd"
+)
+
+// unsigned prefixes the StateInfo of a service whose candidate commit isn't signed by one of its signers.
+const unsigned = "UNSIGNED "
+
+// signedCheckout verifies the signature of the checkout. If that fails, i.e. the initial clone has an unsigned
+// commit, the candidate commit is checked out if it verifies, so the service starts at a signed commit.
+func (s *Service) signedCheckout(gc *gitcmd.Git) (hash string, err error) {
+	if err := gc.Verify(gc.Hash(), s.Signers); err == nil {
+		return gc.Hash(), nil
+	}
+	if s.Tag != "" {
+		if _, err := s.track(gc); err != nil {
+			return "", err
+		}
+	}
+	if hash, err = gc.Fetch(); err != nil {
+		return "", err
+	}
+	if err := gc.Verify(hash, s.Signers); err != nil {
+		return hash, err
+	}
+	return hash, gc.Rollback(hash)
+}
+
+// validSigner checks the trusted key k: an SSH public key or the full fingerprint of a GPG key.
+func validSigner(k string) error {
+	if strings.HasPrefix(k, "ssh-") || strings.HasPrefix(k, "ecdsa-") || strings.HasPrefix(k, "sk-") {
+		if len(strings.Fields(k)) < 2 {
+			return fmt.Errorf("SSH key %q has no key data", k)
+		}
+		return nil
+	}
+	fpr := strings.ToUpper(strings.ReplaceAll(k, " ", ""))
+	if (len(fpr) != 40 && len(fpr) != 64) || strings.Trim(fpr, "0123456789ABCDEF") != "" {
+		return fmt.Errorf("%q isn't an SSH public key or a full GPG fingerprint", k)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"go.science.ru.nl/log"
+)
+
+func TestUnsignedNotVetted(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+	}
+	upstream := t.TempDir()
+	git(upstream, "init", "-b", "main")
+	os.WriteFile(filepath.Join(upstream, "a.conf"), []byte("a\n"), 0644)
+	git(upstream, "add", ".")
+	git(upstream, "commit", "-m", "initial")
+
+	gc := gitcmd.New(upstream, "main", filepath.Join(t.TempDir(), "checkout"), "", nil)
+	if err := gc.Checkout(); err != nil {
+		t.Fatal(err)
+	}
+	ran := filepath.Join(t.TempDir(), "ran")
+	s := &Service{
+		Service: "grafana-server", Upstream: upstream, Branch: "main",
+		RequireSigned: true, Signers: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFakeKeyForTesting test@example.org"},
+		Policy:   "touch " + ran,
+		Validate: "touch " + ran,
+		machine:  newMachine(false),
+	}
+	s.SetHash(gc.Hash())
+
+	os.WriteFile(filepath.Join(upstream, "a.conf"), []byte("b\n"), 0644)
+	git(upstream, "commit", "-am", "unsigned")
+	s.reconcileOnce(gc)
+
+	if _, err := os.Stat(ran); err == nil {
+		t.Errorf("expected policy and validate not to run on an unsigned commit")
+	}
+	if state, info := s.State(); state != StateBroken || !strings.HasPrefix(info, unsigned) {
+		t.Errorf("expected %s with %q, got %s with %q", StateBroken, unsigned, state, info)
+	}
+}
+
+func TestUnsignedRollback(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	upstream := t.TempDir()
+	git(upstream, "init", "-b", "main")
+	os.WriteFile(filepath.Join(upstream, "a.conf"), []byte("a\n"), 0644)
+	git(upstream, "add", ".")
+	git(upstream, "commit", "-m", "initial")
+	first := git(upstream, "rev-parse", "HEAD")
+	os.WriteFile(filepath.Join(upstream, "a.conf"), []byte("b\n"), 0644)
+	git(upstream, "commit", "-am", "update")
+
+	gc := gitcmd.New(upstream, "main", filepath.Join(t.TempDir(), "checkout"), "", nil)
+	if err := gc.Checkout(); err != nil {
+		t.Fatal(err)
+	}
+	head := gc.Hash()
+	s := &Service{
+		Service: "grafana-server", Upstream: upstream, Branch: "main",
+		RequireSigned: true, Signers: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFakeKeyForTesting test@example.org"},
+		machine: newMachine(false),
+	}
+	s.SetHash(head)
+
+	if err := s.rollback(gc, first); err == nil {
+		t.Errorf("expected rollback to unsigned %s to fail", first)
+	}
+	if gc.Hash() != head {
+		t.Errorf("expected checkout to stay at %s, got %s", head, gc.Hash())
+	}
+	if state, info := s.State(); state != StateBroken || !strings.HasPrefix(info, unsigned) {
+		t.Errorf("expected %s with %q, got %s with %q", StateBroken, unsigned, state, info)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Size is a number of bytes that is written as a string in the config, with an optional K, M, G or T suffix
+// (powers of 1024), i.e. "500M" or "2G".
+type Size uint64
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Size) UnmarshalText(text []byte) error {
+	t := string(text)
+	mult := uint64(1)
+	if i := strings.IndexAny(t, "KMGT"); i > 0 && i == len(t)-1 {
+		mult = 1 << (10 * (1 + strings.IndexByte("KMGT", t[i])))
+		t = t[:i]
+	}
+	n, err := strconv.ParseUint(t, 10, 64)
+	if err != nil || n > (1<<64-1)/mult {
+		return fmt.Errorf("invalid size %q, i.e. \"500M\" or \"2G\"", text)
+	}
+	*s = Size(n * mult)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Size) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// String returns s with the largest suffix that divides it.
+func (s Size) String() string {
+	n, i := uint64(s), 0
+	for n >= 1024 && n%1024 == 0 && i < 4 {
+		n /= 1024
+		i++
+	}
+	return strconv.FormatUint(n, 10) + []string{"", "K", "M", "G", "T"}[i]
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestSize(t *testing.T) {
+	tests := map[string]Size{
+		"0":    0,
+		"512":  512,
+		"500M": 500 << 20,
+		"2G":   2 << 30,
+		"1T":   1 << 40,
+		"1536": 1536,
+	}
+	for in, exp := range tests {
+		var s Size
+		if err := s.UnmarshalText([]byte(in)); err != nil {
+			t.Errorf("%q: %s", in, err)
+			continue
+		}
+		if s != exp {
+			t.Errorf("%q: expected %d, got %d", in, exp, s)
+		}
+		if s.String() != in {
+			t.Errorf("%q: expected String to be %q, got %q", in, in, s.String())
+		}
+	}
+	for _, in := range []string{"", "G", "2g", "2GB", "-1G", "1.5G", "99999999999T"} {
+		var s Size
+		if err := s.UnmarshalText([]byte(in)); err == nil {
+			t.Errorf("%q: expected error, got %d", in, s)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"go.science.ru.nl/log"
+)
+
+// maxSkew is the clock skew we tolerate before warning about it.
+const maxSkew = 30 * time.Second
+
+// skewInterval is how often the server of an upstream host is asked for its time.
+const skewInterval = time.Hour
+
+// hostSkews holds the skew according to each upstream host, see httpSkew.
+var hostSkews = struct {
+	m map[string]hostSkew
+	sync.Mutex
+}{m: map[string]hostSkew{}}
+
+type hostSkew struct {
+	skew    time.Duration
+	checked time.Time
+}
+
+// checkSkew estimates the clock skew of this machine. For HTTP(S) upstreams the Date header of the upstream
+// server in use is used, otherwise we fallback to the commit time of HEAD, which only tells us something when it
+// lies in the future. A positive skew means our clock is behind.
+func (s *Service) checkSkew(gc *gitcmd.Git) {
+	skew := time.Duration(0)
+	upstream := gc.Upstream()
+	if strings.HasPrefix(upstream, "http://") || strings.HasPrefix(upstream, "https://") {
+		if c, err := s.httpClient(upstream); err == nil {
+			skew = httpSkew(c, upstream, time.Now())
+		} else {
+			log.Debugf("Machine %q, not asking %q for its time: %s", s.Machine, upstream, err)
+		}
+	}
+	if commit := gc.Time(); !commit.IsZero() {
+		if future := time.Until(commit); future > skew {
+			skew = future
+		}
+	}
+	skew = skew.Truncate(time.Second)
+
+	if skew > maxSkew || skew < -maxSkew {
+		log.Warningf("Machine %q, clock is skewed by %s according to %q", s.Machine, skew, upstream)
+	}
+	metricServiceSkew.WithLabelValues(s.Service).Set(skew.Seconds())
+	s.SetSkew(skew)
+}
+
+// httpClient returns the client to contact upstream with, it honors the network policy and the proxy of s like
+// git does.
+func (s *Service) httpClient(upstream string) (*http.Client, error) {
+	if s.network != nil {
+		if err := s.network.allow(gitcmd.Host(upstream)); err != nil {
+			return nil, err
+		}
+	}
+	proxy := s.Proxy
+	if proxy == "" && s.network != nil {
+		proxy = s.network.Proxy
+	}
+	tr := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	switch proxy {
+	case "":
+	case proxyNone:
+		tr.Proxy = nil
+	default:
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}, nil
+}
+
+// httpSkew returns the skew according to the Date header of the server of upstream, which is asked with c. Each
+// host is asked at most once per skewInterval, not on every poll of every service, in between the last skew is
+// returned.
+func httpSkew(c *http.Client, upstream string, now time.Time) time.Duration {
+	host := gitcmd.Host(upstream)
+	hostSkews.Lock()
+	hs, ok := hostSkews.m[host]
+	if ok && now.Sub(hs.checked) < skewInterval {
+		hostSkews.Unlock()
+		return hs.skew
+	}
+	// Claim the check, so other services don't ask the same host while we do.
+	hostSkews.m[host] = hostSkew{skew: hs.skew, checked: now}
+	hostSkews.Unlock()
+
+	skew := time.Duration(0)
+	resp, err := c.Head(upstream)
+	if err == nil {
+		resp.Body.Close()
+		if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			skew = date.Sub(time.Now().Truncate(time.Second))
+		}
+	}
+	hostSkews.Lock()
+	hostSkews.m[host] = hostSkew{skew: skew, checked: now}
+	hostSkews.Unlock()
+	return skew
+}
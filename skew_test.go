@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPSkew(t *testing.T) {
+	heads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heads++
+		w.Header().Set("Date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if skew := httpSkew(srv.Client(), srv.URL+"/miekg/gitopper-config", now); skew < 59*time.Second || skew > 61*time.Second {
+			t.Errorf("expected a skew of 1m, got %s", skew)
+		}
+	}
+	if heads != 1 {
+		t.Errorf("expected 1 request within the interval, got %d", heads)
+	}
+	httpSkew(srv.Client(), srv.URL+"/miekg/other", now.Add(skewInterval))
+	if heads != 2 {
+		t.Errorf("expected another request after the interval, got %d", heads)
+	}
+}
+
+func TestHTTPSkewProxy(t *testing.T) {
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Header().Set("Date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	}))
+	defer proxy.Close()
+
+	const upstream = "http://git.example.org/miekg/gitopper-config"
+	s := &Service{Proxy: proxy.URL}
+	c, err := s.httpClient(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skew := httpSkew(c, upstream, time.Now()); skew > -59*time.Second || skew < -61*time.Second {
+		t.Errorf("expected a skew of -1m, got %s", skew)
+	}
+	if proxied != upstream {
+		t.Errorf("expected %q to be asked through the proxy, got %q", upstream, proxied)
+	}
+
+	s = &Service{network: &Network{Hosts: []string{"github.com"}}}
+	if _, err := s.httpClient(upstream); err == nil {
+		t.Errorf("expected the network policy to deny %q", upstream)
+	}
+}
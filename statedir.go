@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/miekg/gitopper/osutil"
+	"go.science.ru.nl/log"
+)
+
+// exportState writes the current hash, previous hash and the time the current hash was applied to small files
+// in <statedir>/<service>/, so the service (and its health checks) can see what is deployed.
+func (s *Service) exportState() {
+	if s.machine == nil || s.machine.StateDir == "" {
+		return
+	}
+	dir := path.Join(s.machine.StateDir, s.Service)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Warningf("Machine %q, failed to create state directory %q: %s", s.Machine, dir, err)
+		return
+	}
+
+	s.RLock()
+	files := map[string]string{
+		"hash":     s.st.Hash,
+		"previous": s.st.PrevHash,
+		"applied":  s.st.Applied.Format(time.RFC3339),
+	}
+	s.RUnlock()
+
+	for name, value := range files {
+		if err := osutil.WriteFileAtomic(path.Join(dir, name), []byte(value+"\n")); err != nil {
+			log.Warningf("Machine %q, failed to write state file: %s", s.Machine, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/miekg/gitopper/osutil"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver, no cgo needed
+)
+
+// ServiceState is the state of a service as kept in a StateStore.
+type ServiceState struct {
+	State     State
+	StateInfo string    // Extra info some states carry.
+	Stamp     time.Time // When did state change (UTC).
+	Hash      string    // Git hash of the current git checkout.
+	PrevHash  string    // Git hash of the previous git checkout.
+	Applied   time.Time // When did the hash change (UTC).
+	Failures  int       // Number of consecutive failures.
+	Upstream  string    // Mirror in use after a fail over, empty for the upstream.
+	Approved  string    // Commit an operator approved, its policy and validation are skipped.
+	Control   string    // Hash of the control file that was last applied.
+}
+
+// JournalEntry records an apply of a new hash for a service.
+type JournalEntry struct {
+	Service  string
+	From     string // Hash before the apply, empty on the initial apply.
+	To       string // Hash after the apply.
+	Summary  string // Summary of the changes between From and To, see gitcmd.Summary.
+	Start    time.Time
+	Duration time.Duration
+	Result   string                   // "OK" or the error.
+	Operator bool                     // Operator initiated (i.e. a rollback), otherwise automatic.
+	Upstream string                   // Where To came from.
+	Signer   string                   // Signer of To, empty if the commit isn't signed.
+	Package  string                   // Package of the service.
+	Version  string                   // Installed version of Package.
+	Phases   map[string]time.Duration // Time spent in each phase of the reconcile.
+}
+
+// StateStore stores the state of services and the journal of applies.
+type StateStore interface {
+	// Load returns the state of service, the boolean is false if there is no state stored.
+	Load(service string) (ServiceState, bool, error)
+	// Save stores the state of service.
+	Save(service string, st ServiceState) error
+	// Append adds e to the journal.
+	Append(e JournalEntry) error
+	// Journal calls fn for each entry in the journal, oldest first. It stops at the first error fn returns.
+	Journal(fn func(JournalEntry) error) error
+}
+
+// maxJournal is the number of journal entries memStore keeps.
+const maxJournal = 1000
+
+// memStore is a StateStore that keeps state in memory, it doesn't survive restarts.
+type memStore struct {
+	states  map[string]ServiceState
+	journal []JournalEntry
+	sync.RWMutex
+}
+
+func newMemStore() *memStore { return &memStore{states: map[string]ServiceState{}} }
+
+func (m *memStore) Load(service string) (ServiceState, bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	st, ok := m.states[service]
+	return st, ok, nil
+}
+
+func (m *memStore) Save(service string, st ServiceState) error {
+	m.Lock()
+	defer m.Unlock()
+	m.states[service] = st
+	return nil
+}
+
+func (m *memStore) Append(e JournalEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	m.journal = append(m.journal, e)
+	if len(m.journal) > maxJournal {
+		m.journal = m.journal[len(m.journal)-maxJournal:]
+	}
+	return nil
+}
+
+func (m *memStore) Journal(fn func(JournalEntry) error) error {
+	m.RLock()
+	entries := append([]JournalEntry(nil), m.journal...)
+	m.RUnlock()
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileStore is a StateStore that keeps the state of each service in a JSON file in the states subdirectory of a
+// directory. The journal is kept in an SQLite database, journal.db in that directory. Keeping them apart means no
+// service name can clash with the journal's files.
+type fileStore struct {
+	dir string
+	db  *sql.DB
+}
+
+// journalSchema creates the journal table, phases holds the JSON of JournalEntry.Phases.
+const journalSchema = `CREATE TABLE IF NOT EXISTS journal (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	service  TEXT NOT NULL,
+	from_    TEXT NOT NULL,
+	to_      TEXT NOT NULL,
+	summary  TEXT NOT NULL,
+	start    INTEGER NOT NULL,
+	duration INTEGER NOT NULL,
+	result   TEXT NOT NULL,
+	operator INTEGER NOT NULL,
+	upstream TEXT NOT NULL,
+	signer   TEXT NOT NULL,
+	package  TEXT NOT NULL,
+	version  TEXT NOT NULL,
+	phases   TEXT NOT NULL
+)`
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(path.Join(dir, "states"), 0755); err != nil {
+		return nil, err
+	}
+	// WAL lets Journal read while Append writes, the busy timeout covers the checkpoints.
+	db, err := sql.Open("sqlite", path.Join(dir, "journal.db")+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(journalSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("journal: %s", err)
+	}
+	f := &fileStore{dir: dir, db: db}
+	if err := f.importStates(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("states: %s", err)
+	}
+	if err := f.importJournal(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("journal: %s", err)
+	}
+	return f, nil
+}
+
+// importStates moves the states older versions kept in dir itself into the states subdirectory. journal.json is left
+// for importJournal.
+func (f *fileStore) importStates() error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || path.Ext(e.Name()) != ".json" || e.Name() == "journal.json" {
+			continue
+		}
+		if err := os.Rename(path.Join(f.dir, e.Name()), path.Join(f.dir, "states", e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importJournal moves the entries of journal.json, the journal of older versions, into the database. The file is
+// renamed to journal.json.imported afterwards. Older versions also kept the state of a service named "journal" in
+// journal.json, as its entries always have a service, such a file is moved to the states subdirectory instead.
+func (f *fileStore) importJournal() error {
+	old := path.Join(f.dir, "journal.json")
+	j, err := os.Open(old)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+	dec := json.NewDecoder(j)
+	for first := true; dec.More(); first = false {
+		e := JournalEntry{}
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("%s: %s", old, err)
+		}
+		if first && e.Service == "" {
+			return os.Rename(old, path.Join(f.dir, "states", "journal.json"))
+		}
+		if err := f.Append(e); err != nil {
+			return err
+		}
+	}
+	return os.Rename(old, old+".imported")
+}
+
+func (f *fileStore) Load(service string) (ServiceState, bool, error) {
+	st := ServiceState{}
+	data, err := os.ReadFile(path.Join(f.dir, "states", service+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, false, nil
+	}
+	if err != nil {
+		return st, false, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err == nil, err
+}
+
+func (f *fileStore) Save(service string, st ServiceState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return osutil.WriteFileAtomic(path.Join(f.dir, "states", service+".json"), data)
+}
+
+func (f *fileStore) Append(e JournalEntry) error {
+	phases, err := json.Marshal(e.Phases)
+	if err != nil {
+		return err
+	}
+	start := int64(0) // the zero time doesn't fit in UnixNano
+	if !e.Start.IsZero() {
+		start = e.Start.UnixNano()
+	}
+	_, err = f.db.Exec(`INSERT INTO journal (service, from_, to_, summary, start, duration, result, operator, upstream, signer, package, version, phases)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Service, e.From, e.To, e.Summary, start, int64(e.Duration), e.Result, e.Operator, e.Upstream, e.Signer, e.Package, e.Version, string(phases))
+	return err
+}
+
+// Journal reads the journal as it is when called, readers don't block Append, so a slow fn (i.e. a slow client)
+// doesn't hold it up.
+func (f *fileStore) Journal(fn func(JournalEntry) error) error {
+	rows, err := f.db.Query(`SELECT service, from_, to_, summary, start, duration, result, operator, upstream, signer, package, version, phases
+		FROM journal ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e               JournalEntry
+			start, duration int64
+			phases          string
+		)
+		if err := rows.Scan(&e.Service, &e.From, &e.To, &e.Summary, &start, &duration, &e.Result, &e.Operator, &e.Upstream, &e.Signer, &e.Package, &e.Version, &phases); err != nil {
+			return err
+		}
+		if start != 0 {
+			e.Start = time.Unix(0, start).UTC()
+		}
+		e.Duration = time.Duration(duration)
+		if err := json.Unmarshal([]byte(phases), &e.Phases); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
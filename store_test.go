@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	temp, err := os.MkdirTemp(os.TempDir(), "")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %q: %s", temp, err)
+	}
+	defer func() { os.RemoveAll(temp) }()
+
+	f, err := newFileStore(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := f.Load("grafana-server"); ok || err != nil {
+		t.Fatalf("Expected no state, got %t: %v", ok, err)
+	}
+	if err := f.Save("grafana-server", ServiceState{State: StateFreeze, Hash: "606eb576c1b91248e4c1c4cd0d720f27ac0deb70"}); err != nil {
+		t.Fatal(err)
+	}
+	st, ok, err := f.Load("grafana-server")
+	if !ok || err != nil {
+		t.Fatalf("Expected state, got %t: %v", ok, err)
+	}
+	if st.State != StateFreeze || st.Hash != "606eb576c1b91248e4c1c4cd0d720f27ac0deb70" {
+		t.Fatalf("Expected loaded state to be equal to saved state, got %+v", st)
+	}
+
+	start := time.Now().UTC()
+	for i := 0; i < 2; i++ {
+		e := JournalEntry{Service: "grafana-server", To: "606eb576c1b91248e4c1c4cd0d720f27ac0deb70", Summary: "1 file changed", Start: start, Duration: time.Second,
+			Result: "OK", Operator: i == 1, Phases: map[string]time.Duration{"fetch": time.Millisecond}}
+		if err := f.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := []JournalEntry{}
+	if err := f.Journal(func(e JournalEntry) error { entries = append(entries, e); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 journal entries, got %d", len(entries))
+	}
+	if e := entries[1]; !e.Start.Equal(start) || e.Duration != time.Second || !e.Operator || e.Summary != "1 file changed" || e.Phases["fetch"] != time.Millisecond {
+		t.Errorf("Expected journal entry to be equal to the appended one, got %+v", e)
+	}
+}
+
+func TestFileStoreImport(t *testing.T) {
+	temp := t.TempDir()
+	old := `{"Service":"grafana-server","To":"606eb576c1b91248e4c1c4cd0d720f27ac0deb70","Result":"OK"}
+{"Service":"grafana-server","From":"606eb576c1b91248e4c1c4cd0d720f27ac0deb70","Result":"OK"}
+`
+	if err := os.WriteFile(filepath.Join(temp, "journal.json"), []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFileStore(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := f.Journal(func(e JournalEntry) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 imported journal entries, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(temp, "journal.json")); err == nil {
+		t.Errorf("Expected journal.json to be moved away")
+	}
+}
+
+func TestFileStoreStates(t *testing.T) {
+	temp := t.TempDir()
+	// Older versions kept the states in temp itself, and journal.json could be the state of a service "journal".
+	for _, service := range []string{"grafana-server", "journal"} {
+		if err := os.WriteFile(filepath.Join(temp, service+".json"), []byte(`{"State":1,"Hash":"606eb576c1b91248e4c1c4cd0d720f27ac0deb70"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := newFileStore(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range []string{"grafana-server", "journal"} {
+		st, ok, err := f.Load(service)
+		if !ok || err != nil || st.Hash != "606eb576c1b91248e4c1c4cd0d720f27ac0deb70" {
+			t.Errorf("Expected state of %q to be moved, got %t: %+v: %v", service, ok, st, err)
+		}
+	}
+	n := 0
+	if err := f.Journal(func(e JournalEntry) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("Expected the state of \"journal\" not to be imported in the journal, got %d entries", n)
+	}
+
+	// A service named "journal" doesn't clash with the journal.
+	if err := f.Save("journal", ServiceState{Hash: "8df1b3db679253ba501d594de285cc3e9ed308ed"}); err != nil {
+		t.Fatal(err)
+	}
+	f.db.Close()
+	if f, err = newFileStore(temp); err != nil {
+		t.Fatal(err)
+	}
+	if st, _, _ := f.Load("journal"); st.Hash != "8df1b3db679253ba501d594de285cc3e9ed308ed" {
+		t.Errorf("Expected state of \"journal\" to survive a restart, got %+v", st)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// flushEvery is the number of list items after which the response is flushed to the client.
+const flushEvery = 100
+
+// list streams a JSON object with a single list named key to w, as {"key":[...]}. Items are written as they are
+// emitted, so the reply is never marshalled in memory as a whole and a slow client slows down the producer
+// instead of the reply being buffered.
+type list struct {
+	w       io.Writer
+	flusher http.Flusher
+	n       int
+}
+
+// newList writes the HTTP header and the start of the list.
+func newList(w http.ResponseWriter, key string) (*list, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	k, _ := json.Marshal(key)
+	_, err := w.Write([]byte("{" + string(k) + ":["))
+	l := &list{w: w}
+	l.flusher, _ = w.(http.Flusher)
+	return l, err
+}
+
+// Emit writes v as the next item in the list.
+func (l *list) Emit(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if l.n > 0 {
+		data = append([]byte{','}, data...)
+	}
+	if _, err := l.w.Write(data); err != nil {
+		return err
+	}
+	l.n++
+	if l.n%flushEvery == 0 && l.flusher != nil {
+		l.flusher.Flush()
+	}
+	return nil
+}
+
+// Close writes the end of the list.
+func (l *list) Close() error {
+	_, err := l.w.Write([]byte("]}"))
+	return err
+}
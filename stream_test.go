@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/gitopper/proto"
+)
+
+func TestList(t *testing.T) {
+	w := httptest.NewRecorder()
+	l, err := newList(w, "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < flushEvery+1; i++ {
+		if err := l.Emit(proto.JournalEntry{Service: "grafana-server", Result: "OK"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Flushed {
+		t.Errorf("Expected reply to be flushed")
+	}
+
+	lj := proto.ListJournal{}
+	if err := json.Unmarshal(w.Body.Bytes(), &lj); err != nil {
+		t.Fatalf("Expected valid JSON, got %s", err)
+	}
+	if len(lj.ListJournal) != flushEvery+1 {
+		t.Fatalf("Expected %d entries, got %d", flushEvery+1, len(lj.ListJournal))
+	}
+}
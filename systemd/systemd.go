@@ -0,0 +1,60 @@
+//go:build !windows
+
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/miekg/gitopper/osutil"
+	"go.science.ru.nl/log"
+)
+
+// DropInDir is where the drop-ins are written, these don't need to survive a reboot.
+const DropInDir = "/run/systemd/system"
+
+// Systemctl runs "systemctl <action> <unit>", with env added to the environment.
+func Systemctl(action, unit string, env ...string) error {
+	ctx := context.TODO()
+	cmd := exec.CommandContext(ctx, "systemctl", action, unit)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	log.Infof("running %v", cmd.Args)
+	return cmd.Run()
+}
+
+// ActiveState returns the active state of unit: active, reloading, inactive, failed, activating or deactivating.
+func ActiveState(unit string) (string, error) {
+	ctx := context.TODO()
+	out, err := exec.CommandContext(ctx, "systemctl", "show", "--property=ActiveState", "--value", unit).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// DaemonReload runs "systemctl daemon-reload".
+func DaemonReload() error {
+	ctx := context.TODO()
+	cmd := exec.CommandContext(ctx, "systemctl", "daemon-reload")
+	log.Infof("running %v", cmd.Args)
+	return cmd.Run()
+}
+
+// DropIn writes conf as the drop-in <name>.conf for unit and reloads systemd. Note the drop-in is only picked
+// up when the unit is (re)started.
+func DropIn(unit, name string, conf []byte) error {
+	dir := path.Join(DropInDir, Unit(unit)+".d")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create drop-in directory %q: %s", dir, err)
+	}
+	if err := osutil.WriteFileAtomic(path.Join(dir, name+".conf"), conf); err != nil {
+		return fmt.Errorf("failed to write drop-in: %s", err)
+	}
+	return DaemonReload()
+}
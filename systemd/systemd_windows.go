@@ -0,0 +1,67 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"go.science.ru.nl/log"
+)
+
+// cmdlets maps the systemctl actions to the PowerShell cmdlets that talk to the Service Control Manager.
+// Windows services can't reload, so a reload is a restart.
+var cmdlets = map[string]string{
+	"start":             "Start-Service",
+	"stop":              "Stop-Service",
+	"restart":           "Restart-Service",
+	"reload":            "Restart-Service",
+	"try-restart":       "Restart-Service",
+	"reload-or-restart": "Restart-Service",
+}
+
+// Systemctl performs action on the Windows service unit, a ".service" suffix is stripped from unit. The env is
+// added to the environment of powershell.
+func Systemctl(action, unit string, env ...string) error {
+	cmdlet, ok := cmdlets[action]
+	if !ok {
+		return fmt.Errorf("action %q is not supported on windows", action)
+	}
+	ctx := context.TODO()
+	cmd := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", cmdlet, "-Name", strings.TrimSuffix(unit, ".service"))
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	log.Infof("running %v", cmd.Args)
+	return cmd.Run()
+}
+
+// ActiveState returns the state of the Windows service unit in systemd's terms, a Windows service never fails: it
+// is active when running and inactive when stopped.
+func ActiveState(unit string) (string, error) {
+	ctx := context.TODO()
+	out, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", "(Get-Service -Name '"+strings.TrimSuffix(unit, ".service")+"').Status").Output()
+	if err != nil {
+		return "", err
+	}
+	switch status := strings.TrimSpace(string(out)); status {
+	case "Running":
+		return "active", nil
+	case "Stopped":
+		return "inactive", nil
+	case "StartPending", "ContinuePending":
+		return "activating", nil
+	default:
+		return "deactivating", nil
+	}
+}
+
+// DaemonReload is a noop on Windows.
+func DaemonReload() error { return nil }
+
+// DropIn is not supported on Windows.
+func DropIn(unit, name string, conf []byte) error {
+	return errors.New("drop-ins are not supported on windows")
+}
@@ -0,0 +1,14 @@
+// Package systemd has the (few) systemd operations gitopper needs: running systemctl on a unit and writing
+// transient drop-ins. It can be used by other programs that want to drive units the same way. On Windows the
+// Service Control Manager is used instead.
+package systemd
+
+import "strings"
+
+// Unit returns name as a unit name, if there is no suffix ".service" is added.
+func Unit(name string) string {
+	if !strings.Contains(name, ".") {
+		return name + ".service"
+	}
+	return name
+}
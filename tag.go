@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/gitopper/gitcmd"
+)
+
+// version is a semantic version: [v]MAJOR[.MINOR[.PATCH]][-PRE].
+type version struct {
+	major, minor, patch int
+	pre                 string
+}
+
+func parseVersion(s string) (version, bool) {
+	v := version{}
+	s, v.pre, _ = strings.Cut(strings.TrimPrefix(s, "v"), "-")
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+// compare returns -1, 0 or 1 if v is smaller, equal or larger than w. A pre-release is smaller than its release,
+// pre-releases are compared as strings.
+func (v version) compare(w version) int {
+	for _, d := range []int{v.major - w.major, v.minor - w.minor, v.patch - w.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.pre == w.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case w.pre == "":
+		return -1
+	case v.pre < w.pre:
+		return -1
+	}
+	return 1
+}
+
+// constraint parses the semver constraint spec: space separated terms that must all hold. A term is a version
+// prefixed with =, !=, >, >=, <, <=, ^ (same major, or same minor for 0.x) or ~ (same minor), no prefix is =.
+func constraint(spec string) (func(version) bool, error) {
+	terms := strings.Fields(strings.ReplaceAll(spec, ",", " "))
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty constraint")
+	}
+	checks := []func(version) bool{}
+	for _, t := range terms {
+		op := t[:len(t)-len(strings.TrimLeft(t, "=!<>^~"))]
+		w, ok := parseVersion(t[len(op):])
+		if !ok {
+			return nil, fmt.Errorf("invalid version in %q", t)
+		}
+		var check func(version) bool
+		switch op {
+		case "", "=":
+			check = func(v version) bool { return v.compare(w) == 0 }
+		case "!=":
+			check = func(v version) bool { return v.compare(w) != 0 }
+		case ">":
+			check = func(v version) bool { return v.compare(w) > 0 }
+		case ">=":
+			check = func(v version) bool { return v.compare(w) >= 0 }
+		case "<":
+			check = func(v version) bool { return v.compare(w) < 0 }
+		case "<=":
+			check = func(v version) bool { return v.compare(w) <= 0 }
+		case "^":
+			check = func(v version) bool {
+				if v.compare(w) < 0 || v.major != w.major {
+					return false
+				}
+				return w.major > 0 || v.minor == w.minor
+			}
+		case "~":
+			check = func(v version) bool { return v.compare(w) >= 0 && v.major == w.major && v.minor == w.minor }
+		default:
+			return nil, fmt.Errorf("invalid operator %q in %q", op, t)
+		}
+		checks = append(checks, check)
+	}
+	return func(v version) bool {
+		for _, check := range checks {
+			if !check(v) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// isGlob returns true if spec is a glob, not a semver constraint.
+func isGlob(spec string) bool { return strings.ContainsAny(spec, "*?[") }
+
+// validTag checks the tag spec of a service, see highest.
+func validTag(spec string) error {
+	if isGlob(spec) {
+		_, err := path.Match(spec, "")
+		return err
+	}
+	_, err := constraint(spec)
+	return err
+}
+
+// highest returns the tag with the highest version that matches spec, a glob (v1.*) or a semver constraint
+// (^1.2, >=1.2.0 <2). Tags that aren't a version are skipped, as are pre-releases unless spec has a "-" in it. It
+// returns the empty string if no tag matches.
+func highest(tags []string, spec string) (string, error) {
+	match := func(tag string, _ version) bool { ok, _ := path.Match(spec, tag); return ok }
+	if !isGlob(spec) {
+		c, err := constraint(spec)
+		if err != nil {
+			return "", err
+		}
+		match = func(_ string, v version) bool { return c(v) }
+	}
+	pre := strings.Contains(spec, "-")
+
+	best, bestv := "", version{}
+	for _, tag := range tags {
+		v, ok := parseVersion(tag)
+		if !ok || (v.pre != "" && !pre) || !match(tag, v) {
+			continue
+		}
+		if best == "" || v.compare(bestv) > 0 {
+			best, bestv = tag, v
+		}
+	}
+	return best, nil
+}
+
+// track makes gc track the highest tag upstream that matches s.Tag. It returns the tag, or the empty string if
+// none match.
+func (s *Service) track(gc *gitcmd.Git) (string, error) {
+	tags, err := gc.Tags()
+	if err != nil {
+		return "", err
+	}
+	tag, err := highest(tags, s.Tag)
+	if err != nil || tag == "" {
+		return "", err
+	}
+	gc.Track(tag)
+	return tag, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.science.ru.nl/log"
+)
+
+func TestHighest(t *testing.T) {
+	tags := []string{"v1.0.0", "v1.2.0", "v1.2.3", "v1.10.0-rc1", "v2.0.0", "v0.3.1", "v0.4.0", "latest", "v3.0.0-beta"}
+	tests := map[string]string{
+		"v1.*":          "v1.2.3",
+		"v1.10*":        "",
+		"v1.10.0-*":     "v1.10.0-rc1",
+		"^1.0":          "v1.2.3",
+		"^0.3":          "v0.3.1",
+		"~1.2.0":        "v1.2.3",
+		">=1.2.0 <2":    "v1.2.3",
+		">=1.0, <1.2.3": "v1.2.0",
+		"v2.0.0":        "v2.0.0",
+		">=2":           "v2.0.0",
+		">=3.0.0-alpha": "v3.0.0-beta",
+		">4":            "",
+	}
+	for spec, exp := range tests {
+		got, err := highest(tags, spec)
+		if err != nil {
+			t.Errorf("%q: %s", spec, err)
+			continue
+		}
+		if got != exp {
+			t.Errorf("%q: expected %q, got %q", spec, exp, got)
+		}
+	}
+	for _, spec := range []string{"latest", "=>1.0", "^x", "[v1"} {
+		if err := validTag(spec); err == nil {
+			t.Errorf("%q: expected error, got nil", spec)
+		}
+	}
+}
+
+func TestSetupDetached(t *testing.T) {
+	log.Discard()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	upstream := t.TempDir()
+	git(upstream, "init", "-b", "main")
+	hashes := []string{}
+	for _, tag := range []string{"v1.0.0", "v1.1.0", "v2.0.0"} {
+		os.WriteFile(filepath.Join(upstream, "version"), []byte(tag+"\n"), 0644)
+		git(upstream, "add", ".")
+		git(upstream, "commit", "-m", tag)
+		git(upstream, "tag", tag)
+		hashes = append(hashes, git(upstream, "rev-parse", "HEAD"))
+	}
+	os.WriteFile(filepath.Join(upstream, "version"), []byte("unreleased\n"), 0644)
+	git(upstream, "commit", "-am", "unreleased")
+
+	tests := []struct {
+		s   *Service
+		exp string
+	}{
+		{&Service{Tag: "^1.0"}, hashes[1]},
+		{&Service{Commit: hashes[0]}, hashes[0]},
+	}
+	for _, tc := range tests {
+		s := tc.s
+		s.Service, s.Upstream, s.Branch, s.Mount, s.machine = "grafana-server", upstream, "main", t.TempDir(), newMachine(false)
+		if err := s.setup(); err != nil {
+			t.Fatalf("tag %q, commit %q: %s", s.Tag, s.Commit, err)
+		}
+		// The hash is set before the service is activated.
+		if s.Hash() != tc.exp {
+			t.Errorf("tag %q, commit %q: expected %s to be deployed, got %s", s.Tag, s.Commit, tc.exp, s.Hash())
+		}
+	}
+}
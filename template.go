@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// extend fills in the fields of each service from the template it extends (and the templates that one extends).
+// Fields set in the service win, maps are merged key by key.
+func (c Config) extend() error {
+	for i, s := range c.Services {
+		seen := map[string]bool{}
+		for name := s.Extends; name != ""; {
+			if seen[name] {
+				return fmt.Errorf("service #%d %q, template %q extends itself", i, s.Service, name)
+			}
+			seen[name] = true
+			t, ok := c.Templates[name]
+			if !ok {
+				return fmt.Errorf("service #%d %q, extends unknown template %q", i, s.Service, name)
+			}
+			fill(s, t)
+			name = t.Extends
+		}
+	}
+	return nil
+}
+
+// fill sets the zero exported fields of s to the ones in t.
+func fill(s, t *Service) {
+	sv, tv := reflect.ValueOf(s).Elem(), reflect.ValueOf(t).Elem()
+	for i := 0; i < sv.NumField(); i++ {
+		f := sv.Type().Field(i)
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		dst, src := sv.Field(i), tv.Field(i)
+		switch {
+		case src.IsZero():
+		case dst.IsZero():
+			dst.Set(src)
+		case dst.Kind() == reflect.Map:
+			m := reflect.MakeMap(dst.Type())
+			for _, k := range src.MapKeys() {
+				m.SetMapIndex(k, src.MapIndex(k))
+			}
+			for _, k := range dst.MapKeys() {
+				m.SetMapIndex(k, dst.MapIndex(k))
+			}
+			dst.Set(m)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// umask sets the umask of the process to mask and returns a function that restores the previous one. The umask is
+// process wide, so only use this while nothing else creates files, i.e. during startup.
+func umask(mask int) func() {
+	old := syscall.Umask(mask)
+	return func() { syscall.Umask(old) }
+}
@@ -0,0 +1,4 @@
+package main
+
+// umask does nothing, Windows has no umask.
+func umask(mask int) func() { return func() {} }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/systemd"
+	"go.science.ru.nl/log"
+)
+
+// hasUnit returns true if the action of s is done on its (systemd) unit, i.e. not a firewall, zone or plugin
+// action.
+func (s *Service) hasUnit() bool {
+	if s.Action == "" {
+		return false
+	}
+	if _, _, ok := firewallAction(s.Action); ok {
+		return false
+	}
+	return !strings.HasPrefix(s.Action, zonePrefix) && !strings.HasPrefix(s.Action, execPrefix)
+}
+
+// checkUnit checks the unit of s: when it failed while s is OK, s is DEGRADED, when it's active again s is OK
+// again. This catches units that crash after the apply, when gitopper thinks all is well.
+func (s *Service) checkUnit() {
+	active, err := systemd.ActiveState(s.Service)
+	if err != nil {
+		log.Debugf("Machine %q, failed to get the state of unit %q: %s", s.Machine, s.Service, err)
+		return
+	}
+	// Don't race with a reconcile, that may be restarting the unit.
+	s.serial(func() {
+		switch state, _ := s.State(); {
+		case state == StateOK && active == "failed":
+			log.Warningf("Machine %q, unit of service %q failed", s.Machine, s.Service)
+			s.SetState(StateDegraded, "unit failed")
+			metricServiceUnitFailures.WithLabelValues(s.Service).Inc()
+			s.notify(fmt.Sprintf("Service %q is degraded, its unit failed", s.Service))
+		case state == StateDegraded && active == "active":
+			log.Infof("Machine %q, unit of service %q is active again", s.Machine, s.Service)
+			s.SetState(StateOK, "")
+		}
+	})
+}
+
+// watchUnits checks the units of the services of this machine every d, until ctx is canceled. Nothing is checked
+// in standby or maintenance, as the units are then expected to be down.
+func (d *daemon) watchUnits(ctx context.Context, every time.Duration) {
+	for {
+		select {
+		case <-time.After(every):
+		case <-ctx.Done():
+			return
+		}
+		if d.machine.Standby() || d.machine.Maintenance() {
+			continue
+		}
+		for _, s := range d.live.Get().Services {
+			if s.forMe(d.hosts, d.labels) && s.IsEnabled() && s.hasUnit() {
+				s.checkUnit()
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/miekg/gitopper/gitcmd"
+	"github.com/miekg/gitopper/sandbox"
+	"go.science.ru.nl/log"
+)
+
+// validateInvalid prefixes the StateInfo of a service whose candidate commit failed validation.
+const validateInvalid = "INVALID "
+
+// hook returns the sandbox for the policy and validate commands of s: only the temporary directory is writable
+// and the network is only available if s.HookNetwork is set.
+func (s *Service) hook() *sandbox.Options {
+	return &sandbox.Options{Writable: []string{os.TempDir()}, Network: s.HookNetwork}
+}
+
+// validate stages the candidate commit hash, which must have been fetched, in a temporary directory and runs
+// s.Validate in it. An exit status of zero allows the commit, anything else blocks it; the output of the command is
+// then the reason. If s.Validate selects a built-in validator (see validators) that is used instead of a command.
+// If the upstream has nothing new, the commit is allowed without validating.
+func (s *Service) validate(gc *gitcmd.Git, hash string) (ok bool, reason string, err error) {
+	if hash == s.Hash() {
+		return true, "", nil
+	}
+	dir, err := os.MkdirTemp("", "gitopper-"+s.Service+"-")
+	if err != nil {
+		return false, "", err
+	}
+	defer os.RemoveAll(dir)
+	if err := gc.Stage(hash, dir); err != nil {
+		return false, "", fmt.Errorf("failed to stage %s: %s", hash, err)
+	}
+
+	if fn, glob, ok := validator(s.Validate); ok {
+		reason, err = checkFiles(fn, dir, glob)
+		if err != nil {
+			return false, "", fmt.Errorf("validate %q: %s", s.Validate, err)
+		}
+		return reason == "", reason, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	o := s.hook()
+	o.Writable = append(o.Writable, dir)
+	cmd := sandbox.Command(ctx, *o, "/bin/sh", "-c", s.Validate)
+	cmd.Dir = dir
+	cmd.Env = append(s.environ(), "GITOPPER_HASH="+hash)
+	log.Infof("running %v in %q", cmd.Args, dir)
+	out, err := cmd.CombinedOutput()
+	reason = strings.TrimSpace(string(out))
+	if _, ok := err.(*exec.ExitError); ok {
+		if reason == "" {
+			reason = err.Error()
+		}
+		return false, reason, nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("validate %q: %s", s.Validate, err)
+	}
+	return true, reason, nil
+}
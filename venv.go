@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/miekg/gitopper/osutil"
+	"github.com/miekg/gitopper/sandbox"
+	"go.science.ru.nl/log"
+)
+
+// venvStamp is the file in the virtualenv holding the hash of the requirements it was last installed from.
+const venvStamp = ".gitopper-requirements"
+
+// venv returns the directory of the virtualenv of the service: Venv or <mount>/<service>.venv.
+func (s *Service) venv() string {
+	if s.Venv != "" {
+		return s.Venv
+	}
+	return path.Join(s.Mount, s.Service+".venv")
+}
+
+// virtualenv creates the virtualenv of the service if it doesn't exist and installs the requirements from the
+// checkout in it. If the requirements didn't change since the last install, nothing is done.
+func (s *Service) virtualenv() error {
+	req, err := os.ReadFile(path.Join(s.Mount, s.Service, s.Requirements))
+	if err != nil {
+		return fmt.Errorf("failed to read requirements: %s", err)
+	}
+	sum := sha256.Sum256(req)
+	hash := []byte(hex.EncodeToString(sum[:]))
+
+	venv := s.venv()
+	if stamp, err := os.ReadFile(path.Join(venv, venvStamp)); err == nil && bytes.Equal(stamp, hash) {
+		return nil
+	}
+
+	ctx := context.TODO()
+	o := s.buildSandbox(venv)
+	if !exists(path.Join(venv, "bin", "pip")) {
+		cmd := sandbox.Command(ctx, *o, "python3", "-m", "venv", venv)
+		cmd.Env = s.buildEnv()
+		log.Infof("running %v", cmd.Args)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create virtualenv %q: %s: %s", venv, err, out)
+		}
+	}
+	cmd := sandbox.Command(ctx, *o, path.Join(venv, "bin", "pip"), "install", "-q", "-r", path.Join(s.Mount, s.Service, s.Requirements))
+	cmd.Env = s.buildEnv()
+	log.Infof("running %v", cmd.Args)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to install requirements in %q: %s: %s", venv, err, out)
+	}
+	return osutil.WriteFileAtomic(path.Join(venv, venvStamp), hash)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.science.ru.nl/log"
+)
+
+// replayWindow is how old a webhook may be, and how long we remember deliveries to detect replays.
+const replayWindow = 5 * time.Minute
+
+// webhook validates webhooks (GitHub, GitLab and Gitea) and rejects replays.
+type webhook struct {
+	seen map[string]time.Time // Delivery IDs seen within the replay window.
+	sync.Mutex
+}
+
+func newWebhook() *webhook { return &webhook{seen: map[string]time.Time{}} }
+
+// validate checks the signature (GitHub, Gitea) or token (GitLab) of the webhook in r with body against secret.
+func (wh *webhook) validate(r *http.Request, body []byte, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(sig), []byte(expected))
+	}
+	if sig := r.Header.Get("X-Gitea-Signature"); sig != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil))))
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
+
+// delivery returns the delivery ID and the time of the push of the webhook in r with body. Each provider has its
+// own: GitHub has pushed_at in the repository, Gitea updates the repository's updated_at on a push and GitLab
+// has no push time, so the time of the pushed commit is used.
+func delivery(r *http.Request, body []byte) (id string, at time.Time, err error) {
+	p := struct {
+		CheckoutSHA string `json:"checkout_sha"`
+		Commits     []struct {
+			ID        string `json:"id"`
+			Timestamp string `json:"timestamp"`
+		} `json:"commits"`
+		Repository struct {
+			PushedAt  json.Number `json:"pushed_at"`  // GitHub, unix seconds.
+			UpdatedAt string      `json:"updated_at"` // Gitea, RFC 3339.
+		} `json:"repository"`
+	}{}
+	json.Unmarshal(body, &p)
+
+	// Gitea sends the GitHub headers too, so check it first.
+	stamp := ""
+	switch {
+	case r.Header.Get("X-Gitea-Delivery") != "":
+		id, stamp = r.Header.Get("X-Gitea-Delivery"), p.Repository.UpdatedAt
+	case r.Header.Get("X-GitHub-Delivery") != "":
+		id = r.Header.Get("X-GitHub-Delivery")
+		if sec, err := p.Repository.PushedAt.Int64(); err == nil {
+			at = time.Unix(sec, 0)
+		}
+	case r.Header.Get("X-Gitlab-Event-UUID") != "":
+		id = r.Header.Get("X-Gitlab-Event-UUID")
+		for _, c := range p.Commits {
+			if c.ID == p.CheckoutSHA {
+				stamp = c.Timestamp
+			}
+		}
+	default:
+		return "", at, errors.New("webhook has no delivery ID")
+	}
+	if stamp != "" {
+		if at, err = time.Parse(time.RFC3339, stamp); err != nil {
+			return id, at, fmt.Errorf("webhook has invalid timestamp %q", stamp)
+		}
+	}
+	if at.IsZero() {
+		return id, at, errors.New("webhook has no timestamp")
+	}
+	return id, at, nil
+}
+
+// replay returns an error if the webhook in r with body was already delivered, if it is too old or if it lacks a
+// delivery ID or timestamp to tell.
+func (wh *webhook) replay(r *http.Request, body []byte, now time.Time) error {
+	id, at, err := delivery(r, body)
+	if err != nil {
+		return err
+	}
+	if d := now.Sub(at); d > replayWindow || d < -replayWindow {
+		return errors.New("webhook outside of replay window")
+	}
+
+	wh.Lock()
+	defer wh.Unlock()
+	for k, t := range wh.seen {
+		if now.Sub(t) > replayWindow {
+			delete(wh.seen, k)
+		}
+	}
+	if _, ok := wh.seen[id]; ok {
+		return errors.New("webhook already delivered")
+	}
+	wh.seen[id] = now
+	return nil
+}
+
+// push is the part of a push event we use to find the services it is for. GitHub and Gitea share the repository
+// fields, GitLab has its own in project.
+type push struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	Project struct {
+		HTTPURL string `json:"git_http_url"`
+		SSHURL  string `json:"git_ssh_url"`
+		WebURL  string `json:"web_url"`
+	} `json:"project"`
+}
+
+// urls returns the non-empty URLs of the repository that was pushed to.
+func (p push) urls() []string {
+	urls := []string{}
+	for _, u := range []string{p.Repository.CloneURL, p.Repository.SSHURL, p.Repository.HTMLURL, p.Project.HTTPURL, p.Project.SSHURL, p.Project.WebURL} {
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// matches returns true if the push is for the branch and one of the upstreams of s. A push that doesn't name a
+// branch or repository (i.e. a ping) matches every service.
+func (p push) matches(s *Service) bool {
+	if p.Ref != "" && p.Ref != "refs/heads/"+s.Branch {
+		return false // Another branch or a tag.
+	}
+	urls := p.urls()
+	if len(urls) == 0 {
+		return true
+	}
+	for _, u := range append([]string{s.Upstream}, s.Mirrors...) {
+		for _, u1 := range urls {
+			if repoKey(u) == repoKey(u1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// repoKey normalizes a git URL to host/path, so the HTTPS, SSH and web URLs of a repository compare equal.
+func repoKey(u string) string {
+	if _, rest, ok := strings.Cut(u, "://"); ok {
+		u = rest
+	} else if host, path, ok := strings.Cut(u, ":"); ok { // scp-like: git@github.com:org/repo.git
+		u = host + "/" + path
+	}
+	host, path, _ := strings.Cut(u, "/")
+	if _, h, ok := strings.Cut(host, "@"); ok { // user
+		host = h
+	}
+	if h, _, ok := strings.Cut(host, ":"); ok { // port
+		host = h
+	}
+	path = strings.TrimSuffix(strings.TrimSuffix(path, "/"), ".git")
+	return strings.ToLower(host) + "/" + path
+}
+
+// Webhook wakes up all services for which the webhook validates and that track the branch and repository that
+// was pushed to.
+func Webhook(c Config, wh *webhook, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	services := []*Service{}
+	for _, service := range c.Services {
+		if wh.validate(r, body, service.Webhook) {
+			services = append(services, service)
+		}
+	}
+	if len(services) == 0 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err := wh.replay(r, body, time.Now()); err != nil {
+		log.Warningf("Rejected webhook from %s: %s", r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusForbidden)+", "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	p := push{}
+	json.Unmarshal(body, &p)
+	matched := services[:0]
+	for _, service := range services {
+		if p.matches(service) {
+			matched = append(matched, service)
+		}
+	}
+	services = matched
+	if len(services) == 0 {
+		log.Infof("Webhook for %q on %q matched no services", p.urls(), p.Ref)
+		http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
+		return
+	}
+
+	names := make([]string, len(services))
+	for i, service := range services {
+		service.Wake()
+		names[i] = service.Service
+	}
+	log.Infof("Webhook woke up services: %s", strings.Join(names, ","))
+	http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebhookValidate(t *testing.T) {
+	wh := newWebhook()
+	body := []byte(`{"ref": "refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+
+	r, _ := http.NewRequest("POST", "/webhook", nil)
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	if !wh.validate(r, body, "secret") {
+		t.Fatal("Expected GitHub webhook to validate")
+	}
+	if wh.validate(r, body, "other") {
+		t.Fatal("Expected GitHub webhook with other secret to fail to validate")
+	}
+
+	r, _ = http.NewRequest("POST", "/webhook", nil)
+	r.Header.Set("X-Gitlab-Token", "secret")
+	if !wh.validate(r, body, "secret") {
+		t.Fatal("Expected GitLab webhook to validate")
+	}
+}
+
+func TestWebhookReplay(t *testing.T) {
+	wh := newWebhook()
+	now := time.Now()
+	body := []byte(fmt.Sprintf(`{"repository": {"pushed_at": %d}}`, now.Unix()))
+
+	r, _ := http.NewRequest("POST", "/webhook", nil)
+	r.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+	if err := wh.replay(r, body, now); err != nil {
+		t.Fatalf("Expected first delivery to be accepted, got: %s", err)
+	}
+	if err := wh.replay(r, body, now); err == nil {
+		t.Fatal("Expected second delivery to be rejected")
+	}
+
+	r.Header.Set("X-GitHub-Delivery", "other")
+	if err := wh.replay(r, body, now.Add(2*replayWindow)); err == nil {
+		t.Fatal("Expected old delivery to be rejected")
+	}
+
+	r.Header.Del("X-GitHub-Delivery")
+	if err := wh.replay(r, body, now); err == nil {
+		t.Fatal("Expected delivery without ID to be rejected")
+	}
+	r.Header.Set("X-GitHub-Delivery", "ping")
+	if err := wh.replay(r, []byte(`{"zen": "Keep it logically awesome."}`), now); err == nil {
+		t.Fatal("Expected delivery without timestamp to be rejected")
+	}
+}
+
+func TestWebhookReplayProviders(t *testing.T) {
+	now := time.Now()
+	stamp := now.Format(time.RFC3339)
+	tests := []struct {
+		header, body string
+	}{
+		{"X-Gitea-Delivery", `{"repository": {"updated_at": "` + stamp + `"}}`},
+		{"X-Gitlab-Event-UUID", `{"checkout_sha": "da1560886d", "commits": [{"id": "da1560886d", "timestamp": "` + stamp + `"}]}`},
+	}
+	for _, tc := range tests {
+		wh := newWebhook()
+		r, _ := http.NewRequest("POST", "/webhook", nil)
+		r.Header.Set(tc.header, "f6a1d9d0")
+		if err := wh.replay(r, []byte(tc.body), now); err != nil {
+			t.Errorf("%s: expected first delivery to be accepted, got: %s", tc.header, err)
+		}
+		if err := wh.replay(r, []byte(tc.body), now); err == nil {
+			t.Errorf("%s: expected second delivery to be rejected", tc.header)
+		}
+		r.Header.Set(tc.header, "other")
+		if err := wh.replay(r, []byte(tc.body), now.Add(2*replayWindow)); err == nil {
+			t.Errorf("%s: expected old delivery to be rejected", tc.header)
+		}
+	}
+}
+
+func TestWebhookPush(t *testing.T) {
+	s := &Service{Upstream: "https://github.com/miekg/gitopper-config", Branch: "main"}
+	tests := []struct {
+		body string
+		exp  bool
+	}{
+		{`{"ref": "refs/heads/main", "repository": {"ssh_url": "git@github.com:miekg/gitopper-config.git"}}`, true},
+		{`{"ref": "refs/heads/main", "repository": {"clone_url": "https://GitHub.com/miekg/gitopper-config.git"}}`, true},
+		{`{"ref": "refs/heads/main", "project": {"git_ssh_url": "ssh://git@github.com:22/miekg/gitopper-config.git"}}`, true},
+		{`{"ref": "refs/heads/dev", "repository": {"clone_url": "https://github.com/miekg/gitopper-config.git"}}`, false},
+		{`{"ref": "refs/tags/main", "repository": {"clone_url": "https://github.com/miekg/gitopper-config.git"}}`, false},
+		{`{"ref": "refs/heads/main", "repository": {"clone_url": "https://github.com/miekg/other.git"}}`, false},
+		{`{"zen": "Keep it logically awesome."}`, true},
+	}
+	for i, tc := range tests {
+		p := push{}
+		if err := json.Unmarshal([]byte(tc.body), &p); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.matches(s); got != tc.exp {
+			t.Errorf("test %d, expected %t, got %t", i, tc.exp, got)
+		}
+	}
+}
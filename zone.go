@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.science.ru.nl/log"
+)
+
+// zonePrefix marks an action that checks and reloads DNS zones instead of running systemctl.
+const zonePrefix = "zone:"
+
+// zoneSuffix is the extension of zone files, the zone name is the file name without it.
+const zoneSuffix = ".zone"
+
+// nameserver knows how to check a zone file and reload zones.
+type nameserver struct {
+	check  func(zone, file string) []string
+	reload func(zone string) []string // Reloads zone, or all zones if zone is empty.
+}
+
+var nameservers = map[string]nameserver{
+	"bind": {
+		check: func(zone, file string) []string { return []string{"named-checkzone", zone, file} },
+		reload: func(zone string) []string {
+			if zone == "" {
+				return []string{"rndc", "reload"}
+			}
+			return []string{"rndc", "reload", zone}
+		},
+	},
+	"knot": {
+		check: func(zone, file string) []string { return []string{"kzonecheck", "-o", zone, file} },
+		reload: func(zone string) []string {
+			if zone == "" {
+				return []string{"knotc", "reload"}
+			}
+			return []string{"knotc", "zone-reload", zone}
+		},
+	},
+}
+
+// zones checks the zone files that changed since the previous hash, and when all of them are valid reloads
+// these zones. If no zone file changed, the name server is reloaded. A broken zone is never loaded.
+func (s *Service) zones(server string) error {
+	ns, ok := nameservers[server]
+	if !ok {
+		return fmt.Errorf("unknown name server %q", server)
+	}
+	s.RLock()
+	prev, hash := s.st.PrevHash, s.st.Hash
+	s.RUnlock()
+
+	repo := path.Join(s.Mount, s.Service)
+	files, err := s.zoneFiles(repo, prev, hash)
+	if err != nil {
+		return err
+	}
+
+	zones := make([]string, len(files))
+	for i, f := range files {
+		zones[i] = strings.TrimSuffix(path.Base(f), zoneSuffix)
+		if out, err := zoneRun(ns.check(zones[i], path.Join(repo, f)), s.environ()); err != nil {
+			return fmt.Errorf("zone %q is broken, not reloading: %s: %s", zones[i], err, out)
+		}
+	}
+	if len(zones) == 0 {
+		if out, err := zoneRun(ns.reload(""), s.environ()); err != nil {
+			return fmt.Errorf("failed to reload %s: %s: %s", server, err, out)
+		}
+		return nil
+	}
+	for _, z := range zones {
+		if out, err := zoneRun(ns.reload(z), s.environ()); err != nil {
+			return fmt.Errorf("failed to reload zone %q: %s: %s", z, err, out)
+		}
+	}
+	log.Infof("Machine %q, service %q reloaded zones %v", s.Machine, s.Service, zones)
+	return nil
+}
+
+// zoneFiles returns the zone files, relative to repo, that changed between prev and hash. If there is no prev,
+// all zone files are returned.
+func (s *Service) zoneFiles(repo, prev, hash string) ([]string, error) {
+	var changed []string
+	if prev != "" && prev != hash {
+		var err error
+		if changed, err = s.newGitCmd().Diff(prev, hash); err != nil {
+			return nil, fmt.Errorf("failed to diff %s..%s: %s", prev, hash, err)
+		}
+	} else {
+		for _, d := range s.Dirs {
+			filepath.WalkDir(path.Join(repo, d.Link), func(p string, e fs.DirEntry, err error) error {
+				if err == nil && !e.IsDir() {
+					rel, _ := filepath.Rel(repo, p)
+					changed = append(changed, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+		}
+	}
+	files := []string{}
+	for _, f := range changed {
+		if strings.HasSuffix(f, zoneSuffix) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func zoneRun(args []string, env []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = env
+	log.Infof("running %v", cmd.Args)
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}